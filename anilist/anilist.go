@@ -1,20 +1,45 @@
 package anilist
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
 
 	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/users"
 	"github.com/marcus-crane/gunslinger/utils"
 )
 
 const (
 	anilistGraphqlEndpoint = "https://graphql.anilist.co"
+	recentMangaQuery       = `query RecentManga($userId: Int) {
+  Page(page: 1, perPage: 10) {
+    activities(userId: $userId, type: MANGA_LIST, sort: ID_DESC) {
+      ... on ListActivity {
+        id
+        status
+        progress
+        createdAt
+        media {
+          chapters
+          id
+          title {
+            userPreferred
+          }
+          coverImage {
+            extraLarge
+          }
+        }
+      }
+    }
+  }
+}`
 )
 
 type AnilistResponse struct {
@@ -52,43 +77,52 @@ type MangaCover struct {
 	ExtraLarge string `json:"extraLarge"`
 }
 
-func GetRecentlyReadManga(cfg config.Config, ps *playback.PlaybackSystem, client http.Client) {
-	payload := strings.NewReader("{\"query\":\"query Test {\\n  Page(page: 1, perPage: 10) {\\n    activities(\\n\\t\\t\\tuserId: 6111545\\n      type: MANGA_LIST\\n      sort: ID_DESC\\n    ) {\\n      ... on ListActivity {\\n        id\\n        status\\n\\t\\t\\t\\tprogress\\n        createdAt\\n        media {\\n          chapters\\n          id\\n          title {\\n            userPreferred\\n          }\\n          coverImage {\\n            extraLarge\\n          }\\n        }\\n      }\\n    }\\n  }\\n}\\n\",\"variables\":{}}")
-	req, err := http.NewRequest("POST", anilistGraphqlEndpoint, payload)
+// GetRecentlyReadManga records any chapters read recently. One bad activity doesn't stop the
+// rest from being saved but we still report it.
+func GetRecentlyReadManga(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, account users.Account) error {
+	userID, err := strconv.Atoi(account.Identity)
 	if err != nil {
-		slog.Error("Failed to build Anilist manga payload", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("anilist user IDs should be a number but %s has %q", account.UserName, account.Identity)
+	}
+	payload, err := json.Marshal(map[string]any{
+		"query":     recentMangaQuery,
+		"variables": map[string]int{"userId": userID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build Anilist manga payload: %w", err)
+	}
+	req, err := http.NewRequest("POST", anilistGraphqlEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build Anilist manga payload: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":        []string{"application/json"},
-		"Authorization": []string{fmt.Sprintf("Bearer %s", cfg.Anilist.Token)},
+		"Authorization": []string{fmt.Sprintf("Bearer %s", account.CredentialOr(cfg.Anilist.Token))},
 		"Content-Type":  []string{"application/json"},
 		"User-Agent":    []string{utils.UserAgent},
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		slog.Error("Failed to contact Anilist for manga updates", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to contact Anilist for manga updates: %w", err)
 	}
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		slog.Error("Failed to read Anilist response", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to read Anilist response: %w", err)
 	}
 	var anilistResponse AnilistResponse
 
 	if err = json.Unmarshal(body, &anilistResponse); err != nil {
-		slog.Error("Error fetching Anilist data", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("error fetching Anilist data: %w", err)
 	}
 
 	if len(anilistResponse.Data.Page.Activities) == 0 {
 		slog.Warn("Found no activities for Anilist")
-		return
+		return nil
 	}
 
+	var errs []error
 	for _, activity := range anilistResponse.Data.Page.Activities {
 		update := playback.Update{
 			MediaItem: playback.MediaItem{
@@ -98,33 +132,29 @@ func GetRecentlyReadManga(cfg config.Config, ps *playback.PlaybackSystem, client
 				Source:   string(playback.Anilist),
 			},
 			Status: playback.StatusStopped,
+			UserID: account.UserID,
 		}
 
 		mediaID := playback.GenerateMediaID(&update)
-		exists, err := ps.HasPlaybackEntry(mediaID)
+		exists, err := ps.HasUserPlaybackEntry(account.UserID, mediaID)
 		if err != nil {
-			slog.Error("Failed to check Anilist entry existence", slog.String("error", err.Error()))
+			errs = append(errs, fmt.Errorf("failed to check Anilist entry existence: %w", err))
 			continue
 		}
 		if exists {
 			continue
 		}
 
-		coverUrl, domColours, err := ps.ResolveCover(cfg, mediaID, activity.Media.CoverImage.ExtraLarge)
+		cover, err := ps.ResolveCover(cfg, mediaID, activity.Media.CoverImage.ExtraLarge)
 		if err != nil {
-			slog.Error("Failed to resolve cover for Anilist",
-				slog.String("error", err.Error()),
-				slog.String("title", update.MediaItem.Title),
-			)
+			errs = append(errs, fmt.Errorf("failed to resolve cover for Anilist (%s): %w", update.MediaItem.Title, err))
 			continue
 		}
-		update.MediaItem.Image = coverUrl
-		update.MediaItem.DominantColours = domColours
+		cover.ApplyTo(&update.MediaItem)
 
 		if err := ps.UpdatePlaybackState(update); err != nil {
-			slog.Error("Failed to save Anilist update",
-				slog.String("error", err.Error()),
-				slog.String("title", update.MediaItem.Title))
+			errs = append(errs, fmt.Errorf("failed to save Anilist update (%s): %w", update.MediaItem.Title, err))
 		}
 	}
+	return errors.Join(errs...)
 }
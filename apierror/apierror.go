@@ -0,0 +1,129 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader is set on every response so errors can be matched up with the logs
+const RequestIDHeader = "X-Request-ID"
+
+// Error is something that went wrong while handling a request, along with how it should be
+// shown to the client. Err is only ever logged as it may contain details we don't want to share.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, "bad_request", message)
+}
+
+func Unauthorized(message string) *Error {
+	return New(http.StatusUnauthorized, "unauthorized", message)
+}
+
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, "forbidden", message)
+}
+
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, "not_found", message)
+}
+
+func MethodNotAllowed() *Error {
+	return New(http.StatusMethodNotAllowed, "method_not_allowed", "That method is invalid for this endpoint")
+}
+
+func TooManyRequests() *Error {
+	return New(http.StatusTooManyRequests, "rate_limited", "You're making requests too quickly, slow down and try again shortly")
+}
+
+// NotConfigured is for endpoints that need settings which haven't been provided
+func NotConfigured(message string) *Error {
+	return New(http.StatusServiceUnavailable, "not_configured", message)
+}
+
+// Unavailable is for when this instance can't do something right now but another one could
+func Unavailable(message string) *Error {
+	return New(http.StatusServiceUnavailable, "unavailable", message)
+}
+
+// Internal hides whatever went wrong behind a friendlier message
+func Internal(message string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal_error", Message: message, Err: err}
+}
+
+// BadGateway is for when someone we depend on let us down
+func BadGateway(message string, err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: "upstream_error", Message: message, Err: err}
+}
+
+type envelope struct {
+	Error body `json:"error"`
+}
+
+type body struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write renders err as our standard JSON envelope. Anything that isn't already an *Error is
+// treated as an internal error so its details don't leak out.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal("Something went wrong handling your request", err)
+	}
+	requestID := w.Header().Get(RequestIDHeader)
+	if apiErr.Status >= http.StatusInternalServerError {
+		slog.Error(apiErr.Message,
+			slog.String("path", r.URL.Path),
+			slog.String("request_id", requestID),
+			slog.Any("error", apiErr.Err),
+		)
+	}
+	// Anything a handler set up for a successful response no longer applies
+	w.Header().Del("ETag")
+	w.Header().Del("Content-Disposition")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(envelope{Error: body{
+		Status:    apiErr.Status,
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		RequestID: requestID,
+	}})
+}
+
+// HandlerFunc lets handlers return an error rather than each one working out how to render it
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (fn HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := fn(w, r); err != nil {
+		Write(w, r, err)
+	}
+}
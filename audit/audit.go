@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/marcus-crane/gunslinger/apierror"
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/export"
+	"github.com/marcus-crane/gunslinger/middleware"
+	"github.com/marcus-crane/gunslinger/ratelimit"
+)
+
+const anonymous = "anonymous"
+
+// Retention is how long entries are kept before Prune clears them out
+const Retention = 90 * 24 * time.Hour
+
+// Entry is a single thing someone did. KeyID is only set when they used an API key.
+type Entry struct {
+	ID         int64     `db:"id" json:"id"`
+	OccurredAt time.Time `db:"occurred_at" json:"occurred_at"`
+	Actor      string    `db:"actor" json:"actor"`
+	KeyID      *int64    `db:"key_id" json:"key_id,omitempty"`
+	Action     string    `db:"action" json:"action"`
+	Detail     string    `db:"detail" json:"detail,omitempty"`
+	Method     string    `db:"method" json:"method"`
+	Path       string    `db:"path" json:"path"`
+	Status     int       `db:"status" json:"status"`
+	ClientIP   string    `db:"client_ip" json:"client_ip"`
+	UserAgent  string    `db:"user_agent" json:"user_agent,omitempty"`
+	RequestID  string    `db:"request_id" json:"request_id,omitempty"`
+}
+
+type Log struct {
+	db *sqlx.DB
+}
+
+func NewLog(db *sqlx.DB) *Log {
+	return &Log{db: db}
+}
+
+func (l *Log) Record(entry Entry) error {
+	_, err := l.db.NamedExec(`
+	  INSERT INTO audit_log (occurred_at, actor, key_id, action, detail, method, path, status, client_ip, user_agent, request_id)
+	  VALUES (:occurred_at, :actor, :key_id, :action, :detail, :method, :path, :status, :client_ip, :user_agent, :request_id)`,
+		entry)
+	return err
+}
+
+// Prune deletes everything recorded before the given time so the log doesn't grow forever
+func (l *Log) Prune(before time.Time) error {
+	result, err := l.db.Exec(`DELETE FROM audit_log WHERE occurred_at < ?`, before)
+	if err != nil {
+		return err
+	}
+	if pruned, err := result.RowsAffected(); err == nil && pruned > 0 {
+		slog.Info("Pruned old audit entries", slog.Int64("entries", pruned))
+	}
+	return nil
+}
+
+// Recent returns the latest entries, newest first
+func (l *Log) Recent(limit int) ([]Entry, error) {
+	entries := []Entry{}
+	err := l.db.Select(&entries, `SELECT * FROM audit_log ORDER BY occurred_at DESC, id DESC LIMIT ?`, limit)
+	return entries, err
+}
+
+// Each streams every entry since the given time, oldest first
+func (l *Log) Each(since time.Time, fn func(Entry) error) error {
+	rows, err := l.db.Queryx(`SELECT * FROM audit_log WHERE occurred_at >= ? ORDER BY occurred_at, id`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry Entry
+		if err := rows.StructScan(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+var csvHeader = []string{"id", "occurred_at", "actor", "key_id", "action", "detail", "method", "path", "status", "client_ip", "user_agent", "request_id"}
+
+// Write exports entries as CSV or JSON lines. Zip bundles only make sense for playback history.
+func (l *Log) Write(format export.Format, since time.Time, w io.Writer) error {
+	switch format {
+	case export.CSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		err := l.Each(since, func(e Entry) error {
+			keyID := ""
+			if e.KeyID != nil {
+				keyID = strconv.FormatInt(*e.KeyID, 10)
+			}
+			return writer.Write([]string{
+				strconv.FormatInt(e.ID, 10), e.OccurredAt.UTC().Format(time.RFC3339), e.Actor, keyID, e.Action, e.Detail,
+				e.Method, e.Path, strconv.Itoa(e.Status), e.ClientIP, e.UserAgent, e.RequestID,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		writer.Flush()
+		return writer.Error()
+	case export.JSONLines:
+		encoder := json.NewEncoder(w)
+		return l.Each(since, func(e Entry) error {
+			return encoder.Encode(e)
+		})
+	}
+	return fmt.Errorf("the audit log can't be exported as %s, expected csv or jsonl", format)
+}
+
+type noteKey struct{}
+
+// Note adds some detail about what a handler did, like which entry was deleted, to the
+// request's audit entry. It does nothing for requests that aren't being audited.
+func Note(ctx context.Context, format string, args ...any) {
+	if detail, ok := ctx.Value(noteKey{}).(*string); ok {
+		*detail = fmt.Sprintf(format, args...)
+	}
+}
+
+type actorKey struct{}
+
+// Actor records who a handler let in when they didn't use an API key or the secret, like
+// someone signed in to the debug page, since the recorder can't tell who that is by itself
+func Actor(ctx context.Context, name string) {
+	if actor, ok := ctx.Value(actorKey{}).(*string); ok {
+		*actor = name
+	}
+}
+
+// Recorder writes an audit entry once each request it watches is done
+type Recorder struct {
+	log            *Log
+	authorizer     *auth.Authorizer
+	clientIPHeader string
+	writable       func() bool
+}
+
+func NewRecorder(log *Log, authorizer *auth.Authorizer, clientIPHeader string) *Recorder {
+	return &Recorder{log: log, authorizer: authorizer, clientIPHeader: clientIPHeader}
+}
+
+// WritesWhen skips recording anything unless writable says we're allowed to write to the
+// database. Read only instances only ever turn writes away so there's little to miss.
+func (rec *Recorder) WritesWhen(writable func() bool) *Recorder {
+	rec.writable = writable
+	return rec
+}
+
+// Middleware records requests as the given action. It should come before any scope checks so
+// that attempts which were turned away show up as well, but after a rate limit so that nobody
+// can fill up the log by hammering away.
+func (rec *Recorder) Middleware(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			detail, actor := new(string), new(string)
+			recorder := &middleware.StatusRecorder{ResponseWriter: w}
+			ctx := context.WithValue(auth.Remember(r.Context()), noteKey{}, detail)
+			r = r.WithContext(context.WithValue(ctx, actorKey{}, actor))
+			next.ServeHTTP(recorder, r)
+			if rec.writable != nil && !rec.writable() {
+				slog.Debug("Not recording audit entry as we're read only", slog.String("action", action))
+				return
+			}
+
+			entry := Entry{
+				OccurredAt: time.Now(),
+				Actor:      anonymous,
+				Action:     action,
+				Detail:     *detail,
+				Method:     r.Method,
+				// The query string is left out as it may hold a token
+				Path:      r.URL.Path,
+				Status:    recorder.Status(),
+				ClientIP:  ratelimit.ClientIP(r, rec.clientIPHeader),
+				UserAgent: r.UserAgent(),
+				RequestID: w.Header().Get(apierror.RequestIDHeader),
+			}
+			// Whoever was let through was put into a context further down that we can't see from here,
+			// but the scope check will have remembered them so this doesn't look their key up again
+			if principal, err := rec.authorizer.Identify(r); err == nil {
+				entry.Actor = principal.Name()
+				if !principal.Legacy {
+					entry.KeyID = &principal.Key.ID
+				}
+			} else if *actor != "" {
+				entry.Actor = *actor
+			}
+			if err := rec.log.Record(entry); err != nil {
+				slog.Error("Failed to record audit entry",
+					slog.String("action", action),
+					slog.String("actor", entry.Actor),
+					slog.String("error", err.Error()),
+				)
+			}
+		})
+	}
+}
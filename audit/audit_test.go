@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/export"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+)
+
+func TestRecorder(t *testing.T) {
+	db := testdb.Open(t)
+
+	keys := auth.NewStore(db)
+	key, secret, err := keys.Create("cleanup script", auth.Scopes{auth.ScopeDelete})
+	require.NoError(t, err)
+
+	log := NewLog(db)
+	recorder := NewRecorder(log, auth.NewAuthorizer(keys, "legacy"), "Fly-Client-IP")
+	h := recorder.Middleware("playback.delete")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		Note(r.Context(), "playback entry %d", 42)
+	}))
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/v4/item?playback_id=42", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	r.Header.Set("Fly-Client-IP", "203.0.113.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	// Turned away attempts are worth knowing about too, and the legacy token never ends up in the log
+	r = httptest.NewRequest(http.MethodDelete, "/api/v4/item?playback_id=42&token=wrong", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries, err := log.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	denied, allowed := entries[0], entries[1]
+	assert.Equal(t, "cleanup script", allowed.Actor)
+	require.NotNil(t, allowed.KeyID)
+	assert.Equal(t, key.ID, *allowed.KeyID)
+	assert.Equal(t, "playback.delete", allowed.Action)
+	assert.Equal(t, "playback entry 42", allowed.Detail)
+	assert.Equal(t, http.StatusOK, allowed.Status)
+	assert.Equal(t, "203.0.113.7", allowed.ClientIP)
+
+	assert.Equal(t, anonymous, denied.Actor)
+	assert.Nil(t, denied.KeyID)
+	assert.Equal(t, http.StatusUnauthorized, denied.Status)
+	assert.Equal(t, "198.51.100.1", denied.ClientIP)
+	assert.Equal(t, "/api/v4/item", denied.Path)
+
+	var csv bytes.Buffer
+	require.NoError(t, log.Write(export.CSV, time.Time{}, &csv))
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[1], "cleanup script")
+	assert.NotContains(t, csv.String(), "wrong")
+
+	var jsonl bytes.Buffer
+	require.NoError(t, log.Write(export.JSONLines, time.Now().Add(time.Hour), &jsonl))
+	assert.Empty(t, jsonl.String())
+	assert.Error(t, log.Write(export.Bundle, time.Time{}, &jsonl))
+}
+
+func TestLog_Prune(t *testing.T) {
+	db := testdb.Open(t)
+
+	log := NewLog(db)
+	now := time.Now()
+	for _, age := range []time.Duration{Retention + time.Hour, Retention - time.Hour, time.Minute} {
+		require.NoError(t, log.Record(Entry{OccurredAt: now.Add(-age), Actor: anonymous, Action: "debug.view"}))
+	}
+
+	require.NoError(t, log.Prune(now.Add(-Retention)))
+	entries, err := log.Recent(10)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestRecorder_Actor(t *testing.T) {
+	db := testdb.Open(t)
+
+	log := NewLog(db)
+	recorder := NewRecorder(log, auth.NewAuthorizer(auth.NewStore(db), "legacy"), "")
+	h := recorder.Middleware("debug.view")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Actor(r.Context(), "legacy token")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/debug", nil))
+
+	entries, err := log.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "legacy token", entries[0].Actor)
+}
+
+func TestRecorder_ReadOnly(t *testing.T) {
+	db := testdb.Open(t)
+
+	log := NewLog(db)
+	recorder := NewRecorder(log, auth.NewAuthorizer(auth.NewStore(db), "legacy"), "").WritesWhen(func() bool { return false })
+	h := recorder.Middleware("debug.view")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/debug?token=legacy", nil))
+
+	entries, err := log.Recent(1)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestRecorder_Flushes(t *testing.T) {
+	db := testdb.Open(t)
+
+	// The event stream needs to flush through whatever is wrapping the response
+	recorder := NewRecorder(NewLog(db), auth.NewAuthorizer(auth.NewStore(db), ""), "")
+	h := recorder.Middleware("events.view")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		w.WriteHeader(http.StatusAccepted)
+		flusher.Flush()
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v4/events", nil))
+	assert.True(t, w.Flushed)
+
+	entries, err := NewLog(db).Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, http.StatusAccepted, entries[0].Status)
+}
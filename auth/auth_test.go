@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("history:read, Delete")
+	require.NoError(t, err)
+	assert.Equal(t, Scopes{ScopeReadHistory, ScopeDelete}, scopes)
+	assert.True(t, scopes.Allows(ScopeDelete))
+	assert.False(t, scopes.Allows(ScopeWritePlayback))
+	assert.True(t, Scopes{ScopeAdmin}.Allows(ScopeWritePlayback))
+
+	_, err = ParseScopes("history:write")
+	assert.Error(t, err)
+	_, err = ParseScopes("")
+	assert.Error(t, err)
+}
+
+func TestAuthorizer(t *testing.T) {
+	db := testdb.Open(t)
+
+	keys := NewStore(db)
+	key, secret, err := keys.Create("glance", Scopes{ScopeReadHistory})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, key.Prefix+"_"))
+
+	var stored string
+	require.NoError(t, db.Get(&stored, `SELECT key_hash FROM api_keys WHERE id = ?`, key.ID))
+	assert.NotContains(t, stored, secret)
+
+	authorizer := NewAuthorizer(keys, "legacy")
+	request := func(header, token string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api/v4/export?"+url.Values{"token": {token}}.Encode(), nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		return r
+	}
+
+	principal, err := authorizer.Authorize(request("Bearer "+secret, ""), ScopeReadHistory)
+	require.NoError(t, err)
+	assert.Equal(t, "glance", principal.Name())
+
+	_, err = authorizer.Authorize(request("Bearer "+secret, ""), ScopeDelete)
+	assert.ErrorIs(t, err, ErrInsufficientScope)
+
+	_, err = authorizer.Authorize(request("Bearer gs_nope_nope", ""), ScopeReadHistory)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	_, err = authorizer.Authorize(request("", ""), ScopeReadHistory)
+	assert.ErrorIs(t, err, ErrMissingCredentials)
+
+	// The old shared token still works while everything moves over
+	principal, err = authorizer.Authorize(request("", "legacy"), ScopeDelete)
+	require.NoError(t, err)
+	assert.True(t, principal.Legacy)
+	_, err = authorizer.Authorize(request("", "wrong"), ScopeDelete)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewAuthorizer(keys, "").Authorize(request("", ""), ScopeDelete)
+	assert.ErrorIs(t, err, ErrMissingCredentials)
+
+	listed, err := keys.List()
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.NotNil(t, listed[0].LastUsedAt)
+
+	require.NoError(t, keys.Revoke(key.ID))
+	assert.ErrorIs(t, keys.Revoke(key.ID), ErrKeyNotFound)
+	_, err = authorizer.Authorize(request("Bearer "+secret, ""), ScopeReadHistory)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestAuthorizer_ReadOnly(t *testing.T) {
+	db := testdb.Open(t)
+
+	keys := NewStore(db)
+	_, secret, err := keys.Create("glance", Scopes{ScopeReadHistory})
+	require.NoError(t, err)
+
+	writable := false
+	authorizer := NewAuthorizer(keys, "").WritesWhen(func() bool { return writable })
+	r := httptest.NewRequest(http.MethodGet, "/api/v4/history", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+
+	// A follower still lets the key in but leaves the database alone
+	_, err = authorizer.Authorize(r, ScopeReadHistory)
+	require.NoError(t, err)
+	listed, err := keys.List()
+	require.NoError(t, err)
+	assert.Nil(t, listed[0].LastUsedAt)
+
+	writable = true
+	_, err = authorizer.Authorize(r, ScopeReadHistory)
+	require.NoError(t, err)
+	listed, err = keys.List()
+	require.NoError(t, err)
+	assert.NotNil(t, listed[0].LastUsedAt)
+}
+
+func TestPresentedKey(t *testing.T) {
+	request := func(header string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api/v4/history", nil)
+		r.Header.Set("Authorization", header)
+		return r
+	}
+	key, ok := PresentedKey(request("Bearer gs_abcd1234_secret"))
+	assert.True(t, ok)
+	assert.Equal(t, "gs_abcd1234", key)
+
+	for _, header := range []string{"", "Bearer gs_nope_nope", "Bearer gs_abcd1234_", "Basic gs_abcd1234_secret", "Bearer something"} {
+		_, ok := PresentedKey(request(header))
+		assert.False(t, ok, header)
+	}
+}
+
+func TestAuthorizer_Remember(t *testing.T) {
+	db := testdb.Open(t)
+
+	keys := NewStore(db)
+	key, secret, err := keys.Create("glance", Scopes{ScopeReadHistory})
+	require.NoError(t, err)
+	authorizer := NewAuthorizer(keys, "")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v4/history", nil)
+	r.Header.Set("Authorization", "Bearer "+secret)
+	r = r.WithContext(Remember(r.Context()))
+	_, err = authorizer.Authorize(r, ScopeReadHistory)
+	require.NoError(t, err)
+
+	// Whoever was worked out the first time is reused for the rest of the request
+	require.NoError(t, keys.Revoke(key.ID))
+	principal, err := authorizer.Identify(r)
+	require.NoError(t, err)
+	assert.Equal(t, "glance", principal.Name())
+
+	_, err = authorizer.Identify(httptest.NewRequest(http.MethodGet, "/api/v4/history", nil))
+	assert.ErrorIs(t, err, ErrMissingCredentials)
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMissingCredentials = errors.New("no credentials were provided")
+	ErrInvalidKey         = errors.New("API key is invalid or has been revoked")
+	ErrInsufficientScope  = errors.New("API key is missing the required scope")
+)
+
+// Principal is whoever made a request. Legacy is set when they got in with the old shared
+// token rather than an API key.
+type Principal struct {
+	Key    Key
+	Legacy bool
+}
+
+func (p Principal) Name() string {
+	if p.Legacy {
+		return "legacy token"
+	}
+	return p.Key.Name
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns whoever was authorized for this request, if anyone was
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+type identityKey struct{}
+
+type identity struct {
+	principal Principal
+	err       error
+	done      bool
+}
+
+// Remember holds onto whoever Identify works out made a request, so that middleware further up
+// can find out without looking up their key all over again
+func Remember(ctx context.Context) context.Context {
+	return context.WithValue(ctx, identityKey{}, &identity{})
+}
+
+// Authorizer checks requests for an API key in the Authorization header. Until everything has
+// moved over, the old SuperSecretToken is still accepted as ?token= and is allowed to do anything.
+type Authorizer struct {
+	keys        *Store
+	legacyToken string
+	writable    func() bool
+}
+
+func NewAuthorizer(keys *Store, legacyToken string) *Authorizer {
+	return &Authorizer{keys: keys, legacyToken: legacyToken}
+}
+
+// WritesWhen only lets us note when a key was last used while writable says we're allowed to
+// write to the database, so that read only instances stay that way
+func (a *Authorizer) WritesWhen(writable func() bool) *Authorizer {
+	a.writable = writable
+	return a
+}
+
+func (a *Authorizer) Authorize(r *http.Request, scope Scope) (Principal, error) {
+	principal, err := a.Identify(r)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !principal.Legacy && !principal.Key.Scopes.Allows(scope) {
+		return principal, ErrInsufficientScope
+	}
+	return principal, nil
+}
+
+// Identify works out who made a request without caring what they're allowed to do. It only
+// does the work once per request if something further up asked us to Remember.
+func (a *Authorizer) Identify(r *http.Request) (Principal, error) {
+	remembered, ok := r.Context().Value(identityKey{}).(*identity)
+	if !ok {
+		return a.identify(r)
+	}
+	if !remembered.done {
+		remembered.principal, remembered.err = a.identify(r)
+		remembered.done = true
+	}
+	return remembered.principal, remembered.err
+}
+
+func (a *Authorizer) identify(r *http.Request) (Principal, error) {
+	if presented, ok := bearerToken(r); ok {
+		key, err := a.keys.lookup(presented, a.writable)
+		if err != nil {
+			return Principal{}, err
+		}
+		return Principal{Key: key}, nil
+	}
+
+	if token := legacyToken(r); token != "" && a.legacyToken != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.legacyToken)) == 1 {
+			slog.Debug("Request authorized with legacy query token", slog.String("path", r.URL.Path))
+			return Principal{Legacy: true}, nil
+		}
+		return Principal{}, ErrInvalidKey
+	}
+
+	return Principal{}, ErrMissingCredentials
+}
+
+// PresentedKey is the public part of whatever API key a request carries, ie; gs_abcd1234, going
+// only by its shape. Nothing is checked against the database so it may well be made up.
+func PresentedKey(r *http.Request) (string, bool) {
+	presented, ok := bearerToken(r)
+	if !ok {
+		return "", false
+	}
+	rest, found := strings.CutPrefix(presented, keyPrefix)
+	if !found {
+		return "", false
+	}
+	id, secret, found := strings.Cut(rest, "_")
+	if !found || len(id) != keyIDLength || secret == "" {
+		return "", false
+	}
+	return keyPrefix + id, true
+}
+
+// bearerToken accepts both "Bearer <key>" and "Token <key>" as some clients only do one or the other
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || (!strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "Token")) {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// legacyToken looks in the query string and, for forms like the ones on the debug page, the body
+func legacyToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.PostFormValue("token")
+	}
+	return ""
+}
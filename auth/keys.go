@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Scope string
+
+const (
+	ScopeReadHistory    Scope = "history:read"
+	ScopeWritePlayback  Scope = "playback:write"
+	ScopeDelete         Scope = "delete"
+	ScopeReadwiseIngest Scope = "readwise:ingest"
+	// ScopeAdmin is allowed to do anything, including managing other keys
+	ScopeAdmin Scope = "admin"
+)
+
+var AllScopes = []Scope{ScopeReadHistory, ScopeWritePlayback, ScopeDelete, ScopeReadwiseIngest, ScopeAdmin}
+
+const (
+	// Keys look like gs_<prefix>_<secret> so they're easy to spot if they end up somewhere they shouldn't
+	keyPrefix        = "gs_"
+	keyIDLength      = 8
+	keySecretEntropy = 20
+	// There's no point writing to the database on every single request just to bump a timestamp
+	lastUsedGranularity = time.Minute
+)
+
+var (
+	ErrKeyNotFound = errors.New("no API key matches that ID")
+	encoding       = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// ParseScopes accepts a comma separated list of scopes ie; history:read,delete
+func ParseScopes(raw string) (Scopes, error) {
+	var scopes Scopes
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		scope := Scope(name)
+		if !scope.valid() {
+			return nil, fmt.Errorf("unknown scope %q, expected some of %s", name, strings.Join(scopeNames(), ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required, expected some of %s", strings.Join(scopeNames(), ", "))
+	}
+	return scopes, nil
+}
+
+func (s Scope) valid() bool {
+	for _, known := range AllScopes {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeNames() []string {
+	names := make([]string, len(AllScopes))
+	for i, scope := range AllScopes {
+		names[i] = string(scope)
+	}
+	return names
+}
+
+// Scopes are stored as a comma separated value in the same way as SerializableColours
+type Scopes []Scope
+
+func (s Scopes) Allows(scope Scope) bool {
+	for _, granted := range s {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scopes) String() string {
+	names := make([]string, len(s))
+	for i, scope := range s {
+		names[i] = string(scope)
+	}
+	return strings.Join(names, ",")
+}
+
+func (s Scopes) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+func (s *Scopes) Scan(src interface{}) error {
+	raw, ok := src.(string)
+	if !ok {
+		return errors.New("incompatible type for Scopes")
+	}
+	*s = nil
+	for _, name := range strings.Split(raw, ",") {
+		if name != "" {
+			*s = append(*s, Scope(name))
+		}
+	}
+	return nil
+}
+
+type Key struct {
+	ID         int64      `db:"id" json:"id"`
+	Name       string     `db:"name" json:"name"`
+	Prefix     string     `db:"prefix" json:"prefix"`
+	Scopes     Scopes     `db:"scopes" json:"scopes"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Store keeps API keys in SQLite. Only a hash of each key is ever saved, and as they're long
+// random strings rather than passwords a plain SHA-256 is plenty.
+type Store struct {
+	db *sqlx.DB
+}
+
+func NewStore(db *sqlx.DB) *Store {
+	return &Store{db: db}
+}
+
+// Create generates a new key, returning it in full. It can't be recovered afterwards.
+func (s *Store) Create(name string, scopes Scopes) (Key, string, error) {
+	if name == "" {
+		return Key{}, "", errors.New("API keys need a name")
+	}
+	if len(scopes) == 0 {
+		return Key{}, "", errors.New("API keys need at least one scope")
+	}
+	id, err := randomString(keyIDLength)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret, err := randomString(keySecretEntropy * 8 / 5)
+	if err != nil {
+		return Key{}, "", err
+	}
+	full := keyPrefix + id + "_" + secret
+
+	key := Key{Name: name, Prefix: keyPrefix + id, Scopes: scopes, CreatedAt: time.Now()}
+	result, err := s.db.Exec(`
+	  INSERT INTO api_keys (name, prefix, key_hash, scopes, created_at)
+	  VALUES (?, ?, ?, ?, ?)`,
+		key.Name, key.Prefix, hashKey(full), key.Scopes, key.CreatedAt)
+	if err != nil {
+		return Key{}, "", err
+	}
+	if key.ID, err = result.LastInsertId(); err != nil {
+		return Key{}, "", err
+	}
+	return key, full, nil
+}
+
+func (s *Store) List() ([]Key, error) {
+	keys := []Key{}
+	err := s.db.Select(&keys, `
+	  SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+	  FROM api_keys ORDER BY revoked_at IS NOT NULL, created_at DESC`)
+	return keys, err
+}
+
+// Revoke keeps the key around so it's clear in hindsight that it existed and when it was last used
+func (s *Store) Revoke(id int64) error {
+	result, err := s.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Lookup finds the live key matching what a client presented
+func (s *Store) Lookup(presented string) (Key, error) {
+	return s.lookup(presented, nil)
+}
+
+// lookup skips noting that the key was used unless writable says we can, or is nil
+func (s *Store) lookup(presented string, writable func() bool) (Key, error) {
+	var key Key
+	err := s.db.Get(&key, `
+	  SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+	  FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`, hashKey(presented))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Key{}, ErrInvalidKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	now := time.Now()
+	stale := key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > lastUsedGranularity
+	if stale && (writable == nil || writable()) {
+		if _, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now, key.ID); err != nil {
+			return Key{}, err
+		}
+		key.LastUsedAt = &now
+	}
+	return key, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(encoding.EncodeToString(b))[:length], nil
+}
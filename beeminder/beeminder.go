@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/users"
 )
 
 const (
-	datapointsFmtUrl = "https://www.beeminder.com/api/v1/users/utf9k/goals/%s/datapoints.json"
-	goalsUrl         = "https://www.beeminder.com/api/v1/users/utf9k/goals.json"
+	datapointsFmtUrl = "https://www.beeminder.com/api/v1/users/%s/goals/%s/datapoints.json"
+	goalsFmtUrl      = "https://www.beeminder.com/api/v1/users/%s/goals.json"
 )
 
 type Goal struct {
@@ -32,9 +34,10 @@ type Contract struct {
 	Amount float32 `json:"amount"`
 }
 
-func FetchGoals(cfg config.Config) ([]Goal, error) {
+func FetchGoals(cfg config.Config, account users.Account) ([]Goal, error) {
 	var goals []Goal
-	resp, err := http.Get(fmt.Sprintf("%s?auth_token=%s", goalsUrl, cfg.Beeminder.Token))
+	goalsUrl := fmt.Sprintf(goalsFmtUrl, url.PathEscape(account.Identity))
+	resp, err := http.Get(fmt.Sprintf("%s?auth_token=%s", goalsUrl, account.CredentialOr(cfg.Beeminder.Token)))
 	if err != nil {
 		return goals, err
 	}
@@ -52,9 +55,9 @@ func FetchGoals(cfg config.Config) ([]Goal, error) {
 	return goals, nil
 }
 
-func SubmitDatapoint(cfg config.Config, goalName string, value string, comment string) error {
-	url := fmt.Sprintf(datapointsFmtUrl, goalName)
-	req, err := http.NewRequest("POST", url, nil)
+func SubmitDatapoint(cfg config.Config, account users.Account, goalName string, value string, comment string) error {
+	datapointsUrl := fmt.Sprintf(datapointsFmtUrl, url.PathEscape(account.Identity), goalName)
+	req, err := http.NewRequest("POST", datapointsUrl, nil)
 	if err != nil {
 		return err
 	}
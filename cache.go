@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// notModified tags the response with etag and reports whether the client already holds that
+// version, in which case a 304 has been sent and the handler has nothing left to do
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches uses the weak comparison that If-None-Match calls for so a W/ prefix on
+// either side doesn't stop a match
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// stateETag describes the playback state as of version, which is all the playing and history
+// endpoints are built from
+func stateETag(version int64) string {
+	return `"v` + strconv.FormatInt(version, 36) + `"`
+}
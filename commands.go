@@ -0,0 +1,437 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pressly/goose/v3"
+
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
+	gdb "github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/debug"
+	"github.com/marcus-crane/gunslinger/export"
+	"github.com/marcus-crane/gunslinger/importer"
+	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/plex"
+	"github.com/marcus-crane/gunslinger/shared"
+	"github.com/marcus-crane/gunslinger/storage"
+	"github.com/marcus-crane/gunslinger/users"
+)
+
+// runMigrate looks after the database schema ie; gunslinger migrate status
+func runMigrate(cfg config.Config, args []string) {
+	usage := "Usage: gunslinger migrate up | down | status"
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	db := connectDatabase(cfg)
+	defer db.Close()
+
+	var err error
+	switch args[0] {
+	case "up":
+		err = goose.Up(db.DB, ".")
+	case "down":
+		// Only ever one step at a time since going down usually throws data away
+		err = goose.Down(db.DB, ".")
+	case "status":
+		err = goose.Status(db.DB, ".")
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("Failed to migrate", slog.String("direction", args[0]), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+}
+
+// runImport backfills history from an export file ie; gunslinger import -format lastfm-csv scrobbles.csv
+func runImport(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", fmt.Sprintf("format of the export file (%s)", strings.Join(importer.Formats(), ", ")))
+	covers := fs.Bool("covers", false, "download artwork for imported items where the export references it")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: gunslinger import -format <format> [-covers] <file>")
+		os.Exit(2)
+	}
+
+	f, err := importer.ParseFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		slog.Error("Failed to open export file", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	ps := newPlaybackSystem(cfg, openDatabase(cfg))
+
+	summary, err := importer.Import(cfg, ps, f, file, importer.Options{FetchCovers: *covers})
+	if err != nil {
+		slog.Error("Failed to import history", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Inserted %d, skipped %d, merged %d, malformed %d\n", summary.Inserted, summary.Skipped, summary.Merged, summary.Malformed)
+}
+
+// runBackfill pulls watch history from an upstream source ie; gunslinger backfill -since 2023-01-01 plex
+func runBackfill(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := fs.String("since", "", "only backfill plays on or after this date (YYYY-MM-DD), defaults to all history")
+	user := fs.String("user", "", "only backfill this user's history, defaults to everyone with a Plex account")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || fs.Arg(0) != "plex" {
+		fmt.Fprintln(os.Stderr, "Usage: gunslinger backfill [-since YYYY-MM-DD] [-user <name>] plex")
+		os.Exit(2)
+	}
+
+	var sinceTime time.Time
+	if *since != "" {
+		t, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since date %q\n", *since)
+			os.Exit(2)
+		}
+		sinceTime = t
+	}
+
+	db := openDatabase(cfg)
+	ps := newPlaybackSystem(cfg, db)
+	client := http.Client{Timeout: 30 * time.Second}
+
+	accounts, err := newUserStore(db, newStore(cfg, db).Keyring).Accounts(cfg, users.Plex)
+	if err != nil {
+		slog.Error("Failed to load Plex accounts", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	for _, account := range accounts {
+		if *user != "" && account.UserName != *user {
+			continue
+		}
+		summary, err := plex.BackfillHistory(cfg, ps, client, account, sinceTime)
+		if err != nil {
+			slog.Error("Failed to backfill history", slog.String("user", account.UserName), slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("%s: inserted %d, skipped %d, merged %d\n", account.UserName, summary.Inserted, summary.Skipped, summary.Merged)
+	}
+}
+
+// runExport writes out history ie; gunslinger export -format jsonl -from 2024-01-01 -o history.jsonl
+func runExport(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "csv", "format to export as (csv, jsonl, zip)")
+	from := fs.String("from", "", "only export plays on or after this date (YYYY-MM-DD or RFC3339)")
+	to := fs.String("to", "", "only export plays up to and including this date (YYYY-MM-DD or RFC3339)")
+	source := fs.String("source", "", "only export plays from this source ie; plex")
+	category := fs.String("category", "", "only export plays of this category ie; track")
+	output := fs.String("o", "", "file to write to, defaults to stdout")
+	fs.Parse(args)
+
+	f, err := export.ParseFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	filter, err := playback.ParseHistoryFilter(url.Values{
+		"from":     {*from},
+		"to":       {*to},
+		"source":   {*source},
+		"category": {*category},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			slog.Error("Failed to create export file", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+
+	ps := newPlaybackSystem(cfg, openDatabase(cfg))
+
+	if err := export.Write(cfg, ps, f, filter, out); err != nil {
+		slog.Error("Failed to export history", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+}
+
+// runMigrateCovers copies covers between storage backends ie; gunslinger migrate-covers -from filesystem -to s3
+func runMigrateCovers(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("migrate-covers", flag.ExitOnError)
+	from := fs.String("from", storage.FilesystemBackend, "backend to copy covers from (filesystem, s3)")
+	to := fs.String("to", storage.S3Backend, "backend to copy covers to (filesystem, s3)")
+	fs.Parse(args)
+
+	if strings.EqualFold(*from, *to) {
+		fmt.Fprintln(os.Stderr, "Usage: gunslinger migrate-covers -from <backend> -to <backend>, where the backends differ")
+		os.Exit(2)
+	}
+
+	source, err := storage.Named(cfg, *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	destination, err := storage.Named(cfg, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	summary, err := covers.Migrate(source, destination)
+	if err != nil {
+		slog.Error("Failed to migrate covers", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	fmt.Printf("Copied %d, skipped %d already present\n", summary.Copied, summary.Skipped)
+}
+
+// runKeys manages API keys ie; gunslinger keys create -name glance -scopes history:read
+func runKeys(cfg config.Config, args []string) {
+	usage := "Usage: gunslinger keys list | create -name <name> -scopes <scope,...> | revoke <id>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := auth.NewStore(openDatabase(cfg)).List()
+		if err != nil {
+			slog.Error("Failed to list API keys", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tKEY\tSCOPES\tCREATED\tLAST USED\tREVOKED")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%d\t%s\t%s_…\t%s\t%s\t%s\t%s\n",
+				key.ID, key.Name, key.Prefix, key.Scopes, key.CreatedAt.Format("2006-01-02"), formatOptionalTime(key.LastUsedAt), formatOptionalTime(key.RevokedAt))
+		}
+		w.Flush()
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+		name := fs.String("name", "", "what the key is for so it can be recognised later")
+		scopeList := fs.String("scopes", "", fmt.Sprintf("comma separated scopes to grant (%s)", auth.Scopes(auth.AllScopes)))
+		fs.Parse(args[1:])
+
+		scopes, err := auth.ParseScopes(*scopeList)
+		if err != nil || *name == "" {
+			fmt.Fprintln(os.Stderr, usage)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+			os.Exit(2)
+		}
+		_, secret, err := auth.NewStore(openDatabase(cfg)).Create(*name, scopes)
+		if err != nil {
+			slog.Error("Failed to create API key", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "Copy this key now as it won't be shown again:")
+		fmt.Println(secret)
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid key ID %q\n", args[1])
+			os.Exit(2)
+		}
+		if err := auth.NewStore(openDatabase(cfg)).Revoke(id); err != nil {
+			slog.Error("Failed to revoke API key", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("Revoked key %d\n", id)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// runReauth signs in with an OAuth provider again without needing the debug page. The first
+// run prints a URL to sign in with and the second saves the code handed back ie;
+// gunslinger reauth trakt, then gunslinger reauth -code <code> trakt
+func runReauth(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("reauth", flag.ExitOnError)
+	code := fs.String("code", "", "the code parameter from the page you were sent back to after signing in")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || !slices.Contains(debug.OAuthProviders, fs.Arg(0)) {
+		fmt.Fprintf(os.Stderr, "Usage: gunslinger reauth [-code <code>] <%s>\n", strings.Join(debug.OAuthProviders, "|"))
+		os.Exit(2)
+	}
+	provider := fs.Arg(0)
+
+	if *code == "" {
+		authURL, err := debug.AuthURL(cfg, provider, shared.GenerateRandomString(16))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(2)
+		}
+		// The server has never heard of our state so its callback turns us away, but the code is still in the URL
+		fmt.Fprintf(os.Stderr, "Sign in at the URL below. The page you end up on will complain about the state, which is expected.\nCopy the code parameter from its URL and run gunslinger reauth -code <code> %s\n\n", provider)
+		fmt.Println(authURL)
+		return
+	}
+
+	db := openDatabase(cfg)
+	store := newStore(cfg, db)
+	if err := debug.CompleteOAuth(cfg, &store, provider, *code); err != nil {
+		slog.Error("Failed to reauthorize", slog.String("provider", provider), slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	fmt.Printf("Saved new tokens for %s\n", provider)
+}
+
+// runTokens shows which OAuth tokens we have without ever printing them
+func runTokens(cfg config.Config, args []string) {
+	if len(args) != 1 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "Usage: gunslinger tokens list")
+		os.Exit(2)
+	}
+
+	// No keys are needed to see what's there so the tokens are left exactly as they are
+	store := gdb.SqliteStore{DB: openDatabase(cfg)}
+	tokens, err := store.ListTokens()
+	if err != nil {
+		slog.Error("Failed to list tokens", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tENCRYPTED\tCREATED\tEXPIRES")
+	for _, token := range tokens {
+		expires := formatOptionalTime(token.ExpiresAt)
+		if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", token.ID, token.Encrypted, formatOptionalTime(token.CreatedAt), expires)
+	}
+	w.Flush()
+}
+
+// runUsers manages who is followed ie; gunslinger users set-source alice steam 76561197960287930
+func runUsers(cfg config.Config, args []string) {
+	usage := "Usage: gunslinger users list | add <name> | rename <name> <new name> | set-source [-credential <token>] <name> <source> <identity> | remove-source <name> <source>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	db := openDatabase(cfg)
+	userStore := newUserStore(db, newStore(cfg, db).Keyring)
+
+	switch args[0] {
+	case "list":
+		list, err := userStore.List()
+		if err != nil {
+			slog.Error("Failed to list users", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		sources := map[int64][]string{}
+		for _, source := range users.Sources {
+			accounts, err := userStore.Accounts(cfg, source)
+			if err != nil {
+				slog.Error("Failed to list accounts", slog.String("source", source), slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			for _, account := range accounts {
+				sources[account.UserID] = append(sources[account.UserID], source+":"+account.Identity)
+			}
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tCREATED\tSOURCES")
+		for _, u := range list {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", u.ID, u.Name, u.CreatedAt.Format("2006-01-02"), strings.Join(sources[u.ID], " "))
+		}
+		w.Flush()
+	case "add":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		user, err := userStore.Create(args[1])
+		if err != nil {
+			slog.Error("Failed to add user", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("Added %s as user %d\n", user.Name, user.ID)
+	case "rename":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := userStore.Rename(args[1], args[2]); err != nil {
+			slog.Error("Failed to rename user", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("Renamed %s to %s\n", args[1], args[2])
+	case "set-source":
+		fs := flag.NewFlagSet("users set-source", flag.ExitOnError)
+		credential := fs.String("credential", "", "an API key or token for this user, defaults to the instance wide one")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := userStore.SetAccount(fs.Arg(0), fs.Arg(1), fs.Arg(2), *credential); err != nil {
+			slog.Error("Failed to set source", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("Following %s on %s as %s\n", fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	case "remove-source":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := userStore.RemoveAccount(args[1], args[2]); err != nil {
+			slog.Error("Failed to remove source", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		fmt.Printf("No longer following %s on %s\n", args[1], args[2])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
@@ -6,76 +6,114 @@ import (
 )
 
 type Config struct {
-	Anilist           AnilistConfig
-	Beeminder         BeeminderConfig
-	Gunslinger        GunslingerConfig
-	Kagi              KagiConfig
-	Plex              PlexConfig
-	Pushover          PushoverConfig
-	Readwise          ReadwiseConfig
-	RetroAchievements RetroAchievementsConfig
-	Spotify           SpotifyConfig
-	Steam             SteamConfig
-	Trakt             TraktConfig
+	Anilist           AnilistConfig           `toml:"anilist" yaml:"anilist"`
+	Beeminder         BeeminderConfig         `toml:"beeminder" yaml:"beeminder"`
+	Gunslinger        GunslingerConfig        `toml:"gunslinger" yaml:"gunslinger"`
+	Kagi              KagiConfig              `toml:"kagi" yaml:"kagi"`
+	Plex              PlexConfig              `toml:"plex" yaml:"plex"`
+	Pushover          PushoverConfig          `toml:"pushover" yaml:"pushover"`
+	RateLimit         RateLimitConfig         `toml:"rate_limit" yaml:"rate_limit"`
+	Readwise          ReadwiseConfig          `toml:"readwise" yaml:"readwise"`
+	RetroAchievements RetroAchievementsConfig `toml:"retroachievements" yaml:"retroachievements"`
+	Spotify           SpotifyConfig           `toml:"spotify" yaml:"spotify"`
+	Steam             SteamConfig             `toml:"steam" yaml:"steam"`
+	Sources           SourcesConfig           `toml:"sources" yaml:"sources"`
+	Storage           StorageConfig           `toml:"storage" yaml:"storage"`
+	Trakt             TraktConfig             `toml:"trakt" yaml:"trakt"`
 }
 
+// The identities below are for the owner of the instance. Anyone else is set up with the users command.
+
 type AnilistConfig struct {
-	Token string `env:"ANILIST_TOKEN"`
+	Token  string `env:"ANILIST_TOKEN" toml:"token" yaml:"token"`
+	UserID string `env:"ANILIST_USER_ID" toml:"user_id" yaml:"user_id"`
 }
 
 type BeeminderConfig struct {
-	Token string `env:"BEEMINDER_TOKEN"`
+	Token    string `env:"BEEMINDER_TOKEN" toml:"token" yaml:"token"`
+	Username string `env:"BEEMINDER_USERNAME" toml:"username" yaml:"username"`
 }
 
 type GunslingerConfig struct {
-	BackgroundJobsEnabled bool   `env:"BACKGROUND_JOBS_ENABLED"`
-	DbPath                string `env:"DB_PATH"`
-	LogLevel              string `env:"LOG_LEVEL"`
-	StorageDir            string `env:"STORAGE_DIR"`
-	SuperSecretToken      string `env:"SUPER_SECRET_TOKEN"`
+	BackgroundJobsEnabled bool   `env:"BACKGROUND_JOBS_ENABLED" toml:"background_jobs_enabled" yaml:"background_jobs_enabled"`
+	DbPath                string `env:"DB_PATH" toml:"db_path" yaml:"db_path"`
+	LogLevel              string `env:"LOG_LEVEL" toml:"log_level" yaml:"log_level"`
+	StorageDir            string `env:"STORAGE_DIR" toml:"storage_dir" yaml:"storage_dir"`
+	SuperSecretToken      string `env:"SUPER_SECRET_TOKEN" toml:"super_secret_token" yaml:"super_secret_token"`
+	// TokenKeys encrypts OAuth tokens in the database, see db.Keyring for the format
+	TokenKeys string `env:"TOKEN_ENCRYPTION_KEYS" toml:"token_keys" yaml:"token_keys"`
+	// CORSOrigins is a comma separated list of sites that can call the API from a browser
+	CORSOrigins string `env:"CORS_ORIGINS" toml:"cors_origins" yaml:"cors_origins"`
 }
 
 type KagiConfig struct {
-	Token string `env:"KAGI_TOKEN"`
+	Token string `env:"KAGI_TOKEN" toml:"token" yaml:"token"`
 }
 
 type PlexConfig struct {
-	Token string `env:"PLEX_TOKEN"`
-	URL   string `env:"PLEX_URL"`
+	Token     string `env:"PLEX_TOKEN" toml:"token" yaml:"token"`
+	URL       string `env:"PLEX_URL" toml:"url" yaml:"url"`
+	AccountID string `env:"PLEX_ACCOUNT_ID" toml:"account_id" yaml:"account_id"`
 }
 
 type PushoverConfig struct {
-	Recipient string `env:"PUSHOVER_RECIPIENT"`
-	Token     string `env:"PUSHOVER_TOKEN"`
+	Recipient string `env:"PUSHOVER_RECIPIENT" toml:"recipient" yaml:"recipient"`
+	Token     string `env:"PUSHOVER_TOKEN" toml:"token" yaml:"token"`
+}
+
+// RateLimitConfig sets how often each client can hit a group of routes, written as
+// <requests>/<s|m|h> with an optional burst ie; 5/s:20. Anything left empty uses our defaults.
+type RateLimitConfig struct {
+	Disabled bool   `env:"RATE_LIMIT_DISABLED" toml:"disabled" yaml:"disabled"`
+	Public   string `env:"RATE_LIMIT_PUBLIC" toml:"public" yaml:"public"`
+	Static   string `env:"RATE_LIMIT_STATIC" toml:"static" yaml:"static"`
+	Events   string `env:"RATE_LIMIT_EVENTS" toml:"events" yaml:"events"`
+	API      string `env:"RATE_LIMIT_API" toml:"api" yaml:"api"`
+	// ClientIPHeader is trusted to hold the real client address when we're behind a proxy ie; Fly-Client-IP
+	ClientIPHeader string `env:"CLIENT_IP_HEADER" toml:"client_ip_header" yaml:"client_ip_header"`
 }
 
 type ReadwiseConfig struct {
-	Token string `env:"READWISE_TOKEN"`
+	Token string `env:"READWISE_TOKEN" toml:"token" yaml:"token"`
 }
 
 type RetroAchievementsConfig struct {
-	Username string `env:"RETROACHIEVEMENTS_USERNAME"`
-	Token    string `env:"RETROACHIEVEMENTS_TOKEN"`
+	Username string `env:"RETROACHIEVEMENTS_USERNAME" toml:"username" yaml:"username"`
+	Token    string `env:"RETROACHIEVEMENTS_TOKEN" toml:"token" yaml:"token"`
 }
 
 type SpotifyConfig struct {
-	ConnectPlayerName string `env:"SPOTIFY_CONNECT_PLAYER_NAME"`
-	ClientId          string `env:"SPOTIFY_CLIENT_ID"`
-	ClientSecret      string `env:"SPOTIFY_CLIENT_SECRET"`
-	DeviceId          string `env:"SPOTIFY_DEVICE_ID"`
-	RedirectUri       string `env:"SPOTIFY_REDIRECT_URI"`
-	Username          string `env:"SPOTIFY_USERNAME"`
+	ConnectPlayerName string `env:"SPOTIFY_CONNECT_PLAYER_NAME" toml:"connect_player_name" yaml:"connect_player_name"`
+	ClientId          string `env:"SPOTIFY_CLIENT_ID" toml:"client_id" yaml:"client_id"`
+	ClientSecret      string `env:"SPOTIFY_CLIENT_SECRET" toml:"client_secret" yaml:"client_secret"`
+	DeviceId          string `env:"SPOTIFY_DEVICE_ID" toml:"device_id" yaml:"device_id"`
+	RedirectUri       string `env:"SPOTIFY_REDIRECT_URI" toml:"redirect_uri" yaml:"redirect_uri"`
+	Username          string `env:"SPOTIFY_USERNAME" toml:"username" yaml:"username"`
 }
 
 type SteamConfig struct {
-	Token string `env:"STEAM_TOKEN"`
+	Token  string `env:"STEAM_TOKEN" toml:"token" yaml:"token"`
+	UserID string `env:"STEAM_USER_ID" toml:"user_id" yaml:"user_id"`
+}
+
+// StorageConfig controls where covers are kept. The filesystem backend uses STORAGE_DIR.
+type StorageConfig struct {
+	Backend           string `env:"STORAGE_BACKEND" toml:"backend" yaml:"backend"`
+	S3Endpoint        string `env:"S3_ENDPOINT" toml:"s3_endpoint" yaml:"s3_endpoint"`
+	S3Bucket          string `env:"S3_BUCKET" toml:"s3_bucket" yaml:"s3_bucket"`
+	S3Region          string `env:"S3_REGION" toml:"s3_region" yaml:"s3_region"`
+	S3Prefix          string `env:"S3_PREFIX" toml:"s3_prefix" yaml:"s3_prefix"`
+	S3AccessKeyID     string `env:"S3_ACCESS_KEY_ID" toml:"s3_access_key_id" yaml:"s3_access_key_id"`
+	S3SecretAccessKey string `env:"S3_SECRET_ACCESS_KEY" toml:"s3_secret_access_key" yaml:"s3_secret_access_key"`
+	S3Insecure        bool   `env:"S3_INSECURE" toml:"s3_insecure" yaml:"s3_insecure"`
 }
 
 type TraktConfig struct {
-	ClientId     string `env:"TRAKT_CLIENT_ID"`
-	ClientSecret string `env:"TRAKT_CLIENT_SECRET"`
-	RedirectUri  string `env:"TRAKT_REDIRECT_URI"`
-	TMDBToken    string `env:"TMDB_TOKEN"`
+	ClientId     string `env:"TRAKT_CLIENT_ID" toml:"client_id" yaml:"client_id"`
+	ClientSecret string `env:"TRAKT_CLIENT_SECRET" toml:"client_secret" yaml:"client_secret"`
+	RedirectUri  string `env:"TRAKT_REDIRECT_URI" toml:"redirect_uri" yaml:"redirect_uri"`
+	TMDBToken    string `env:"TMDB_TOKEN" toml:"tmdb_token" yaml:"tmdb_token"`
+	Username     string `env:"TRAKT_USERNAME" toml:"username" yaml:"username"`
 }
 
 func (c *Config) GetLogLevel() slog.Leveler {
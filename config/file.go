@@ -0,0 +1,188 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFiles are looked for in the working directory when CONFIG_FILE isn't set
+var DefaultFiles = []string{"gunslinger.toml", "gunslinger.yaml", "gunslinger.yml"}
+
+// Nothing polls faster than this, which is already about as often as Plex can keep up with
+const minimumInterval = time.Second
+
+// SourcesConfig controls how each source is polled. Unlike everything else, it can only be
+// set from a config file as it doesn't map onto environment variables very well.
+type SourcesConfig struct {
+	Anilist           SourceConfig `toml:"anilist" yaml:"anilist"`
+	Plex              SourceConfig `toml:"plex" yaml:"plex"`
+	RetroAchievements SourceConfig `toml:"retroachievements" yaml:"retroachievements"`
+	Spotify           SourceConfig `toml:"spotify" yaml:"spotify"`
+	Steam             SourceConfig `toml:"steam" yaml:"steam"`
+	Trakt             SourceConfig `toml:"trakt" yaml:"trakt"`
+}
+
+// SourceConfig is how one source is polled and what we keep from it. Anything left unset
+// falls back to how we've always behaved.
+type SourceConfig struct {
+	// Enabled is true unless explicitly turned off
+	Enabled *bool `toml:"enabled" yaml:"enabled"`
+	// Interval is how often we check in ie; "15s", at least while something is playing
+	Interval Duration `toml:"interval" yaml:"interval"`
+	// Backfill is how often recent history is pulled in to catch anything we missed. Only Plex has this.
+	Backfill Duration `toml:"backfill" yaml:"backfill"`
+	// Priority decides which source comes first when more than one thing is playing, highest first
+	Priority int `toml:"priority" yaml:"priority"`
+	// Categories only keeps playback of these categories ie; ["episode", "movie"], or everything when empty
+	Categories []string `toml:"categories" yaml:"categories"`
+	// Ignore drops anything with a title or subtitle matching one of these regular expressions
+	Ignore []string `toml:"ignore" yaml:"ignore"`
+}
+
+func (s SourceConfig) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// Every is the configured interval or the fallback if one isn't set
+func (s SourceConfig) Every(fallback time.Duration) time.Duration {
+	if s.Interval > 0 {
+		return time.Duration(s.Interval)
+	}
+	return fallback
+}
+
+// BackfillEvery is the configured backfill interval or the fallback if one isn't set
+func (s SourceConfig) BackfillEvery(fallback time.Duration) time.Duration {
+	if s.Backfill > 0 {
+		return time.Duration(s.Backfill)
+	}
+	return fallback
+}
+
+// Named returns each source's config by the name it goes by in the file
+func (c SourcesConfig) Named() map[string]SourceConfig {
+	return map[string]SourceConfig{
+		"anilist":           c.Anilist,
+		"plex":              c.Plex,
+		"retroachievements": c.RetroAchievements,
+		"spotify":           c.Spotify,
+		"steam":             c.Steam,
+		"trakt":             c.Trakt,
+	}
+}
+
+// Duration is a time.Duration that's written as a string like "1m30s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// FindFile returns the config file we should load, if there is one
+func FindFile() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	for _, path := range DefaultFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// LoadFile reads a TOML or YAML file into cfg, depending on its extension. Unknown keys are
+// an error so that a typo doesn't quietly leave something at its default.
+func LoadFile(path string, cfg *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		md, err := toml.Decode(string(contents), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		// An empty file is fine, it just doesn't change anything
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: config files need to end in .toml, .yaml or .yml", path)
+	}
+	return nil
+}
+
+// Categories are everything a source can record, matching the categories in playback. They
+// live out here so that Validate can catch a typo in categories along with everything else.
+var Categories = []string{"episode", "gaming", "manga", "movie", "podcast_episode", "track"}
+
+// Validate checks everything that can be checked without reaching out anywhere, reporting
+// all of the problems at once rather than making people fix them one restart at a time
+func (c *Config) Validate() error {
+	var errs []error
+	sources := c.Sources.Named()
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		source := sources[name]
+		key := "sources." + name
+		if source.Interval != 0 && time.Duration(source.Interval) < minimumInterval {
+			errs = append(errs, fmt.Errorf("%s.interval: must be at least %s", key, minimumInterval))
+		}
+		if source.Backfill != 0 && name != "plex" {
+			errs = append(errs, fmt.Errorf("%s.backfill: only plex supports backfilling", key))
+		} else if source.Backfill != 0 && time.Duration(source.Backfill) < time.Minute {
+			errs = append(errs, fmt.Errorf("%s.backfill: must be at least %s", key, time.Minute))
+		}
+		if source.Interval != 0 && name == "spotify" {
+			errs = append(errs, fmt.Errorf("%s.interval: spotify pushes updates to us so it has no interval", key))
+		}
+		for _, category := range source.Categories {
+			if strings.TrimSpace(category) == "" {
+				errs = append(errs, fmt.Errorf("%s.categories: can't include an empty category", key))
+			} else if !slices.Contains(Categories, category) {
+				errs = append(errs, fmt.Errorf("%s.categories: unknown category %q, expected one of %v", key, category, Categories))
+			}
+		}
+		for _, pattern := range source.Ignore {
+			if _, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Errorf("%s.ignore: %q is not a valid regular expression: %w", key, pattern, err))
+			}
+		}
+	}
+	if c.Sources.Spotify.IsEnabled() && c.Spotify.RedirectUri == "" {
+		errs = append(errs, fmt.Errorf("sources.spotify: enabled without SPOTIFY_REDIRECT_URI, set it or disable spotify with enabled = false"))
+	}
+	return errors.Join(errs...)
+}
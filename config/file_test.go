@@ -0,0 +1,98 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	toml := writeFile(t, "gunslinger.toml", `
+[plex]
+url = "http://plex.local:32400"
+
+[spotify]
+redirect_uri = "http://localhost:8081/callback"
+
+[sources.plex]
+interval = "2s"
+backfill = "30m"
+priority = 10
+categories = ["episode"]
+
+[sources.retroachievements]
+enabled = false
+`)
+	yaml := writeFile(t, "gunslinger.yaml", `
+plex:
+  url: http://plex.local:32400
+spotify:
+  redirect_uri: http://localhost:8081/callback
+sources:
+  plex:
+    interval: 2s
+    backfill: 30m
+    priority: 10
+    categories: [episode]
+  retroachievements:
+    enabled: false
+`)
+
+	for _, path := range []string{toml, yaml} {
+		var cfg Config
+		require.NoError(t, LoadFile(path, &cfg), path)
+		assert.Equal(t, "http://plex.local:32400", cfg.Plex.URL)
+		assert.Equal(t, 2*time.Second, cfg.Sources.Plex.Every(time.Second))
+		assert.Equal(t, 30*time.Minute, cfg.Sources.Plex.BackfillEvery(time.Hour))
+		assert.Equal(t, 10, cfg.Sources.Plex.Priority)
+		assert.Equal(t, []string{"episode"}, cfg.Sources.Plex.Categories)
+		assert.False(t, cfg.Sources.RetroAchievements.IsEnabled())
+		// Anything left out keeps behaving like it always has
+		assert.True(t, cfg.Sources.Steam.IsEnabled())
+		assert.Equal(t, 15*time.Second, cfg.Sources.Steam.Every(15*time.Second))
+		assert.NoError(t, cfg.Validate())
+	}
+
+	// Typos shouldn't go unnoticed
+	var cfg Config
+	assert.ErrorContains(t, LoadFile(writeFile(t, "typo.toml", "[sources.plex]\nintervall = \"2s\"\n"), &cfg), "sources.plex.intervall")
+	assert.Error(t, LoadFile(writeFile(t, "typo.yaml", "sources:\n  plex:\n    intervall: 2s\n"), &cfg))
+	assert.Error(t, LoadFile(writeFile(t, "bad.toml", "[sources.plex]\ninterval = \"soon\"\n"), &cfg))
+	assert.Error(t, LoadFile(writeFile(t, "gunslinger.json", "{}"), &cfg))
+	assert.NoError(t, LoadFile(writeFile(t, "empty.yaml", ""), &cfg))
+}
+
+func TestValidate(t *testing.T) {
+	var cfg Config
+	cfg.Sources.Steam.Interval = Duration(100 * time.Millisecond)
+	cfg.Sources.Steam.Backfill = Duration(time.Hour)
+	cfg.Sources.Spotify.Interval = Duration(time.Minute)
+	cfg.Sources.Trakt.Ignore = []string{"(unclosed"}
+	cfg.Sources.Plex.Categories = []string{"banana"}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	// Everything wrong is reported at once
+	assert.ErrorContains(t, err, "sources.steam.interval")
+	assert.ErrorContains(t, err, "sources.steam.backfill")
+	assert.ErrorContains(t, err, "sources.spotify.interval")
+	assert.ErrorContains(t, err, "sources.trakt.ignore")
+	assert.ErrorContains(t, err, `sources.plex.categories: unknown category "banana"`)
+	// Spotify is on unless it's turned off so it needs somewhere to send us back to
+	assert.ErrorContains(t, err, "sources.spotify: enabled without SPOTIFY_REDIRECT_URI")
+
+	cfg = Config{}
+	disabled := false
+	cfg.Sources.Spotify.Enabled = &disabled
+	assert.NoError(t, cfg.Validate())
+}
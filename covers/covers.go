@@ -0,0 +1,237 @@
+package covers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/marcus-crane/gunslinger/storage"
+)
+
+// URLPrefix is where processed covers are served from. Anything else under /static is a legacy
+// cover saved as whatever bytes the upstream happened to give us.
+const URLPrefix = "/static/covers/"
+
+const jpegQuality = 85
+
+// maxPixels is as big an upstream image as we'll decode. Anything past this is either a mistake
+// or someone trying to make us allocate a few gigabytes, and no cover needs to be that large.
+const maxPixels = 50_000_000
+
+type Size string
+
+const (
+	Small    Size = "small"
+	Medium   Size = "medium"
+	Large    Size = "large"
+	Original Size = "original"
+)
+
+// Sizes lists every variant we produce along with the bounding box, in pixels, that it's scaled
+// to fit inside. Original keeps the upstream dimensions but is still capped as some sources
+// (looking at you TMDB) will hand over posters several thousand pixels tall.
+var Sizes = map[Size]int{
+	Small:    150,
+	Medium:   300,
+	Large:    600,
+	Original: 1500,
+}
+
+// sizeOrder is the order variants are written in, smallest to largest
+var sizeOrder = []Size{Small, Medium, Large, Original}
+
+type Format string
+
+const (
+	WebP Format = "webp"
+	JPEG Format = "jpeg"
+)
+
+// Formats lists every variant we store for each size. The WebP variant is whichever of WebP and
+// JPEG came out smaller, since our encoder is lossless and often loses to JPEG on photos, so it
+// should be served with a sniffed content type rather than assuming it's always WebP.
+var Formats = []Format{WebP, JPEG}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Save normalises an upstream image into every size and format we serve, stored under a digest
+// of the original bytes so the same artwork is only ever processed and stored once
+func Save(store storage.Backend, original []byte) (string, error) {
+	digest := Digest(original)
+
+	// The original JPEG is always written last so if it's there, everything else is too
+	complete, err := store.Exists(Key(digest, Original, JPEG))
+	if err != nil {
+		return "", err
+	}
+	if complete {
+		return digest, nil
+	}
+
+	header, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode cover: %w", err)
+	}
+	if header.Width*header.Height > maxPixels {
+		return "", fmt.Errorf("cover is too large at %dx%d", header.Width, header.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode cover: %w", err)
+	}
+
+	for _, size := range sizeOrder {
+		scaled := resize(src, Sizes[size])
+		variants := map[Format][]byte{}
+		for _, format := range Formats {
+			var buf bytes.Buffer
+			if err := encode(&buf, scaled, format); err != nil {
+				return "", fmt.Errorf("failed to encode %s %s cover: %w", size, format, err)
+			}
+			variants[format] = buf.Bytes()
+		}
+		// Clients that take WebP would be worse off getting it if the JPEG is smaller
+		if len(variants[WebP]) > len(variants[JPEG]) {
+			variants[WebP] = variants[JPEG]
+		}
+		for _, format := range Formats {
+			if err := store.Put(Key(digest, size, format), variants[format]); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	slog.With(slog.String("digest", digest)).Debug("Saved processed cover")
+	return digest, nil
+}
+
+// Digest is what a cover will be stored under once it's saved
+func Digest(original []byte) string {
+	sum := sha256.Sum256(original)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load returns the bytes for one variant of a processed cover
+func Load(store storage.Backend, digest string, size Size, format Format) ([]byte, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("invalid cover digest %q", digest)
+	}
+	return store.Get(Key(digest, size, format))
+}
+
+// Key is where a variant of a processed cover lives within storage
+func Key(digest string, size Size, format Format) string {
+	return fmt.Sprintf("covers/%s/%s.%s", digest, size, format)
+}
+
+// Keys lists every variant of a processed cover in the order they're written
+func Keys(digest string) []string {
+	var keys []string
+	for _, size := range sizeOrder {
+		for _, format := range Formats {
+			keys = append(keys, Key(digest, size, format))
+		}
+	}
+	return keys
+}
+
+func URL(digest string) string {
+	return URLPrefix + digest
+}
+
+// DigestFromURL pulls the digest back out of a processed cover URL
+func DigestFromURL(url string) (string, bool) {
+	digest, found := strings.CutPrefix(url, URLPrefix)
+	if !found || !validDigest(digest) {
+		return "", false
+	}
+	return digest, true
+}
+
+// ParseSize accepts a size name from a request, defaulting to large when none is given
+func ParseSize(name string) (Size, error) {
+	if name == "" {
+		return Large, nil
+	}
+	size := Size(strings.ToLower(name))
+	if _, ok := Sizes[size]; !ok {
+		return "", fmt.Errorf("unknown cover size %q, expected small, medium, large or original", name)
+	}
+	return size, nil
+}
+
+// Negotiate picks the best format a client says it can handle based on its Accept header.
+// Everything understands JPEG so that's what we fall back to.
+func Negotiate(accept string) Format {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(mediaType) != WebP.ContentType() {
+			continue
+		}
+		// image/webp;q=0 is a client explicitly saying no thanks
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					return JPEG
+				}
+			}
+		}
+		return WebP
+	}
+	return JPEG
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
+
+// resize scales an image down to fit within a square bound, leaving it alone if it already fits
+func resize(src image.Image, bound int) image.Image {
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= bound && height <= bound {
+		return src
+	}
+	if width >= height {
+		height = max(1, height*bound/width)
+		width = bound
+	} else {
+		width = max(1, width*bound/height)
+		height = bound
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+func encode(buf *bytes.Buffer, img image.Image, format Format) error {
+	switch format {
+	case WebP:
+		// This is a lossless encoder so Save only keeps what it makes when it beats JPEG
+		return nativewebp.Encode(buf, img, nil)
+	case JPEG:
+		// JPEG has no alpha so transparent areas (mostly RetroAchievements icons) end up black
+		return jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	return fmt.Errorf("unknown cover format %q", format)
+}
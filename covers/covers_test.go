@@ -0,0 +1,163 @@
+package covers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/storage"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestSave(t *testing.T) {
+	store := storage.Filesystem{Root: t.TempDir()}
+	original := testPNG(t, 800, 400)
+
+	digest, err := Save(store, original)
+	require.NoError(t, err)
+	assert.Equal(t, URL(digest), URLPrefix+digest)
+
+	found, ok := DigestFromURL(URL(digest))
+	assert.True(t, ok)
+	assert.Equal(t, digest, found)
+
+	// Everything is scaled to fit its bounding box without ever being upscaled
+	expected := map[Size]image.Point{
+		Small:    {150, 75},
+		Medium:   {300, 150},
+		Large:    {600, 300},
+		Original: {800, 400},
+	}
+	for size, dimensions := range expected {
+		for _, format := range Formats {
+			content, err := Load(store, digest, size, format)
+			require.NoError(t, err)
+			decoded, kind, err := image.DecodeConfig(bytes.NewReader(content))
+			require.NoError(t, err)
+			if format == JPEG {
+				assert.Equal(t, string(format), kind)
+			}
+			assert.Equal(t, dimensions, image.Point{decoded.Width, decoded.Height}, "%s %s", size, format)
+		}
+	}
+
+	// The same artwork again is a no-op
+	again, err := Save(store, original)
+	require.NoError(t, err)
+	assert.Equal(t, digest, again)
+	keys, err := store.List("covers/")
+	require.NoError(t, err)
+	assert.Len(t, keys, len(Sizes)*len(Formats))
+
+	_, err = Save(store, []byte("not an image"))
+	assert.Error(t, err)
+
+	_, err = Load(store, "../../etc/passwd", Large, JPEG)
+	assert.Error(t, err)
+}
+
+func TestSave_WebPNeverLargerThanJPEG(t *testing.T) {
+	store := storage.Filesystem{Root: t.TempDir()}
+	// Photos are where a lossless encoder really struggles
+	original, err := os.ReadFile("../fixtures/dog.jpg")
+	require.NoError(t, err)
+
+	digest, err := Save(store, original)
+	require.NoError(t, err)
+	for _, size := range sizeOrder {
+		webp, err := Load(store, digest, size, WebP)
+		require.NoError(t, err)
+		jpeg, err := Load(store, digest, size, JPEG)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(webp), len(jpeg), size)
+		_, _, err = image.DecodeConfig(bytes.NewReader(webp))
+		assert.NoError(t, err, size)
+	}
+}
+
+func TestSave_RejectsHugeImages(t *testing.T) {
+	store := storage.Filesystem{Root: t.TempDir()}
+
+	// Claim to be enormous without actually being so, which is all it takes to get a decoder
+	// to try and allocate the lot
+	original := testPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(original[16:], 100_000)
+	binary.BigEndian.PutUint32(original[20:], 100_000)
+	binary.BigEndian.PutUint32(original[29:], crc32.ChecksumIEEE(original[12:29]))
+
+	_, err := Save(store, original)
+	assert.ErrorContains(t, err, "too large")
+	keys, err := store.List("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, WebP, Negotiate("image/avif,image/webp,image/apng,*/*;q=0.8"))
+	assert.Equal(t, WebP, Negotiate("image/webp;q=0.5, image/jpeg"))
+	assert.Equal(t, JPEG, Negotiate("image/webp;q=0, image/jpeg"))
+	assert.Equal(t, JPEG, Negotiate("*/*"))
+	assert.Equal(t, JPEG, Negotiate(""))
+}
+
+func TestParseSize(t *testing.T) {
+	size, err := ParseSize("")
+	assert.NoError(t, err)
+	assert.Equal(t, Large, size)
+
+	size, err = ParseSize("Small")
+	assert.NoError(t, err)
+	assert.Equal(t, Small, size)
+
+	_, err = ParseSize("gigantic")
+	assert.Error(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	from := storage.Filesystem{Root: t.TempDir()}
+	to := storage.Filesystem{Root: t.TempDir()}
+
+	digest, err := Save(from, testPNG(t, 100, 100))
+	require.NoError(t, err)
+	require.NoError(t, from.Put("plex.track.123.jpeg", []byte("legacy")))
+	require.NoError(t, from.Put("gunslinger.db", []byte("not a cover")))
+
+	summary, err := Migrate(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, len(Sizes)*len(Formats)+1, summary.Copied)
+	assert.Equal(t, 0, summary.Skipped)
+
+	content, err := Load(to, digest, Small, WebP)
+	require.NoError(t, err)
+	assert.NotEmpty(t, content)
+	legacy, err := to.Get("plex.track.123.jpeg")
+	require.NoError(t, err)
+	assert.Equal(t, "legacy", string(legacy))
+	_, err = to.Get("gunslinger.db")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Running it again has nothing left to do
+	summary, err = Migrate(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, 0, summary.Copied)
+	assert.Equal(t, len(Sizes)*len(Formats)+1, summary.Skipped)
+}
@@ -0,0 +1,82 @@
+package covers
+
+import (
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/marcus-crane/gunslinger/storage"
+)
+
+type MigrateSummary struct {
+	Copied  int
+	Skipped int
+}
+
+// Migrate copies every cover, processed or legacy, from one backend to another. Anything already
+// at the destination is left alone so it's safe to run again if it gets interrupted part way.
+func Migrate(from, to storage.Backend) (MigrateSummary, error) {
+	var summary MigrateSummary
+
+	keys, err := from.List("")
+	if err != nil {
+		return summary, err
+	}
+
+	// The marker for a complete processed cover goes last so an interrupted copy is picked back up
+	var markers []string
+	for _, key := range keys {
+		if !IsCoverKey(key) {
+			continue
+		}
+		if strings.HasSuffix(key, "/"+string(Original)+"."+string(JPEG)) {
+			markers = append(markers, key)
+			continue
+		}
+		if err := copyObject(from, to, key, &summary); err != nil {
+			return summary, err
+		}
+	}
+	for _, key := range markers {
+		if err := copyObject(from, to, key, &summary); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+func copyObject(from, to storage.Backend, key string, summary *MigrateSummary) error {
+	exists, err := to.Exists(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		summary.Skipped++
+		return nil
+	}
+	content, err := from.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := to.Put(key, content); err != nil {
+		return err
+	}
+	slog.With(slog.String("key", key)).Debug("Copied cover")
+	summary.Copied++
+	return nil
+}
+
+// IsCoverKey picks out covers from anything else that might be sitting in the storage dir, like the database
+func IsCoverKey(key string) bool {
+	if digest, rest, found := strings.Cut(strings.TrimPrefix(key, "covers/"), "/"); found && strings.HasPrefix(key, "covers/") {
+		return validDigest(digest) && !strings.Contains(rest, "/")
+	}
+	if strings.Contains(key, "/") {
+		return false
+	}
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpeg", ".jpg", ".png", ".webp", ".gif":
+		return true
+	}
+	return false
+}
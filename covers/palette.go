@@ -0,0 +1,199 @@
+package covers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/buckket/go-blurhash"
+
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+const (
+	// Covers are shrunk before analysis as there's no need to look at every single pixel
+	paletteSampleBound = 64
+	blurHashBound      = 32
+	blurHashXComponent = 4
+	blurHashYComponent = 3
+	// WCAG AA for normal sized text
+	minimumContrast = 4.5
+)
+
+// swatchTarget describes what sort of colour we're hunting for, loosely based on Android's Palette API
+type swatchTarget struct {
+	minSaturation, targetSaturation, maxSaturation float64
+	minLightness, targetLightness, maxLightness    float64
+}
+
+var (
+	vibrantTarget = swatchTarget{0.35, 1, 1, 0.3, 0.5, 0.7}
+	mutedTarget   = swatchTarget{0, 0.3, 0.4, 0.3, 0.5, 0.7}
+	darkTarget    = swatchTarget{0, 0.5, 1, 0, 0.26, 0.45}
+	lightTarget   = swatchTarget{0, 0.5, 1, 0.55, 0.74, 1}
+)
+
+type swatch struct {
+	r, g, b    float64
+	population int
+	s, l       float64
+}
+
+// Analyse works out a palette and a BlurHash placeholder for a cover so clients have
+// something to paint while the real image loads
+func Analyse(original []byte) (models.Palette, string, error) {
+	src, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return models.Palette{}, "", fmt.Errorf("failed to decode cover: %w", err)
+	}
+	hash, err := blurhash.Encode(blurHashXComponent, blurHashYComponent, resize(src, blurHashBound))
+	if err != nil {
+		return models.Palette{}, "", err
+	}
+	return extractPalette(resize(src, paletteSampleBound)), hash, nil
+}
+
+func extractPalette(img image.Image) models.Palette {
+	swatches := quantise(img)
+	if len(swatches) == 0 {
+		return models.Palette{}
+	}
+
+	background := swatches[0]
+	maxPopulation := 0
+	for _, s := range swatches {
+		if s.population > maxPopulation {
+			maxPopulation = s.population
+			background = s
+		}
+	}
+
+	used := map[int]bool{}
+	palette := models.Palette{
+		Vibrant:    pick(swatches, vibrantTarget, maxPopulation, used),
+		Muted:      pick(swatches, mutedTarget, maxPopulation, used),
+		Dark:       pick(swatches, darkTarget, maxPopulation, used),
+		Light:      pick(swatches, lightTarget, maxPopulation, used),
+		Background: background.hex(),
+	}
+	palette.Foreground = foregroundFor(background, palette.Light, palette.Dark)
+	return palette
+}
+
+// quantise buckets pixels into a coarser colour space so similar shades are counted together
+func quantise(img image.Image) []swatch {
+	type bucket struct {
+		r, g, b, count int
+	}
+	buckets := map[int]*bucket{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			// Mostly see-through pixels aren't really part of the artwork
+			if a < 0x8000 {
+				continue
+			}
+			r, g, b = r>>8, g>>8, b>>8
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			if buckets[key] == nil {
+				buckets[key] = &bucket{}
+			}
+			buckets[key].r += int(r)
+			buckets[key].g += int(g)
+			buckets[key].b += int(b)
+			buckets[key].count++
+		}
+	}
+
+	swatches := make([]swatch, 0, len(buckets))
+	for _, b := range buckets {
+		s := swatch{
+			r:          float64(b.r) / float64(b.count),
+			g:          float64(b.g) / float64(b.count),
+			b:          float64(b.b) / float64(b.count),
+			population: b.count,
+		}
+		s.s, s.l = saturationLightness(s.r, s.g, s.b)
+		swatches = append(swatches, s)
+	}
+	return swatches
+}
+
+func pick(swatches []swatch, target swatchTarget, maxPopulation int, used map[int]bool) string {
+	best, bestScore := -1, math.Inf(-1)
+	for i, s := range swatches {
+		if used[i] || s.s < target.minSaturation || s.s > target.maxSaturation || s.l < target.minLightness || s.l > target.maxLightness {
+			continue
+		}
+		score := 0.24*(1-math.Abs(s.s-target.targetSaturation)) +
+			0.52*(1-math.Abs(s.l-target.targetLightness)) +
+			0.24*(float64(s.population)/float64(maxPopulation))
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best == -1 {
+		return ""
+	}
+	used[best] = true
+	return swatches[best].hex()
+}
+
+// foregroundFor picks something readable on top of the background, preferring colours from
+// the cover itself and falling back to plain white or black
+func foregroundFor(background swatch, candidates ...string) string {
+	bg := relativeLuminance(background.r, background.g, background.b)
+	best, bestContrast := "", 0.0
+	for _, candidate := range candidates {
+		var r, g, b uint8
+		if _, err := fmt.Sscanf(candidate, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			continue
+		}
+		if contrast := contrastRatio(bg, relativeLuminance(float64(r), float64(g), float64(b))); contrast > bestContrast {
+			best, bestContrast = candidate, contrast
+		}
+	}
+	if bestContrast >= minimumContrast {
+		return best
+	}
+	if contrastRatio(bg, 1) >= contrastRatio(bg, 0) {
+		return "#ffffff"
+	}
+	return "#000000"
+}
+
+func (s swatch) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round(s.r)), uint8(math.Round(s.g)), uint8(math.Round(s.b)))
+}
+
+// saturationLightness gives the S and L from HSL, which is all we need to classify a swatch
+func saturationLightness(r, g, b float64) (float64, float64) {
+	r, g, b = r/255, g/255, b/255
+	maxC, minC := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l := (maxC + minC) / 2
+	if maxC == minC {
+		return 0, l
+	}
+	return (maxC - minC) / (1 - math.Abs(2*l-1)), l
+}
+
+// See https://www.w3.org/TR/WCAG21/#dfn-relative-luminance
+func relativeLuminance(r, g, b float64) float64 {
+	channel := func(c float64) float64 {
+		c /= 255
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(r) + 0.7152*channel(g) + 0.0722*channel(b)
+}
+
+func contrastRatio(a, b float64) float64 {
+	if a < b {
+		a, b = b, a
+	}
+	return (a + 0.05) / (b + 0.05)
+}
@@ -0,0 +1,57 @@
+package covers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+func TestAnalyse(t *testing.T) {
+	// Mostly navy with a strip of bright red down the side
+	img := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 200; y++ {
+			c := color.RGBA{16, 24, 64, 255}
+			if x >= 150 {
+				c = color.RGBA{224, 32, 32, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	palette, hash, err := Analyse(buf.Bytes())
+	require.NoError(t, err)
+	assert.NotEmpty(t, hash)
+	assert.Equal(t, "#101840", palette.Background)
+	assert.Equal(t, "#e02020", palette.Vibrant)
+	assert.Equal(t, "#101840", palette.Dark)
+
+	var r, g, b uint8
+	_, err = fmt.Sscanf(palette.Foreground, "#%02x%02x%02x", &r, &g, &b)
+	require.NoError(t, err)
+	background := relativeLuminance(16, 24, 64)
+	assert.GreaterOrEqual(t, contrastRatio(background, relativeLuminance(float64(r), float64(g), float64(b))), minimumContrast)
+
+	// Palettes survive a trip through the database and an empty one is stored as nothing at all
+	stored, err := palette.Value()
+	require.NoError(t, err)
+	var scanned models.Palette
+	require.NoError(t, scanned.Scan(stored))
+	assert.Equal(t, palette, scanned)
+	empty, err := models.Palette{}.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "", empty)
+
+	_, _, err = Analyse([]byte("not an image"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+package covers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/marcus-crane/gunslinger/storage"
+)
+
+var (
+	ErrMissing = errors.New("cover is missing")
+	ErrCorrupt = errors.New("cover is corrupt")
+)
+
+// Verify makes sure every variant of a processed cover is present and can still be decoded
+func Verify(store storage.Backend, digest string) error {
+	for _, key := range Keys(digest) {
+		if err := VerifyObject(store, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyObject checks a single stored image, which is how legacy covers get checked
+func VerifyObject(store storage.Backend, key string) error {
+	content, err := store.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("%w: %s", ErrMissing, key)
+	}
+	if err != nil {
+		return err
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupt, key, err)
+	}
+	return nil
+}
+
+// Remove deletes every variant of a processed cover, marker first so a partial removal
+// never looks like a complete cover
+func Remove(store storage.Backend, digest string) error {
+	keys := Keys(digest)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := store.Delete(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
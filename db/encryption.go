@@ -0,0 +1,116 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks a token value as encrypted. Anything without it is a plaintext token from
+// before encryption was turned on.
+const sealedPrefix = "enc:v1:"
+
+var ErrUnknownKey = errors.New("token was encrypted with a key that isn't in the keyring")
+
+// Keyring encrypts tokens with AES-GCM. Keys are given as a comma separated list of id:key pairs
+// where each key is 32 bytes of base64 ie; `openssl rand -base64 32`. The first key is used for
+// anything new while the rest are kept so tokens sealed before a rotation can still be read.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeyring returns nil without an error when no keys are configured
+func ParseKeyring(spec string) (*Keyring, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	keyring := &Keyring{aeads: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid token key %q, expected id:base64key", entry)
+		}
+		if _, exists := keyring.aeads[id]; exists {
+			return nil, fmt.Errorf("token key %s is listed more than once", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("token key %s is not valid base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("token key %s must be 32 bytes but was %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if keyring.primary == "" {
+			keyring.primary = id
+		}
+		keyring.aeads[id] = aead
+	}
+	return keyring, nil
+}
+
+// Seal encrypts a token with the primary key. The token's ID is bound in as additional data so
+// a sealed value can't be copied onto another row and still be read.
+func (k *Keyring) Seal(id, plaintext string) (string, error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(id))
+	return sealedPrefix + k.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a sealed token, passing plaintext ones through untouched so tokens stored before
+// encryption was set up keep working until they're encrypted
+func (k *Keyring) Open(id, stored string) (string, error) {
+	keyID, payload, sealed := parseSealed(stored)
+	if !sealed {
+		return stored, nil
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return "", fmt.Errorf("token %s is not a validly sealed value", id)
+	}
+	plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token %s: %w", id, err)
+	}
+	return string(plaintext), nil
+}
+
+// Current reports whether a stored value is already sealed with the primary key
+func (k *Keyring) Current(stored string) bool {
+	keyID, _, sealed := parseSealed(stored)
+	return sealed && keyID == k.primary
+}
+
+func IsSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+func parseSealed(stored string) (keyID, payload string, ok bool) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return "", "", false
+	}
+	keyID, payload, _ = strings.Cut(rest, ":")
+	return keyID, payload, true
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+)
+
+func newKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func mustKeyring(t *testing.T, spec string) *Keyring {
+	keyring, err := ParseKeyring(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestParseKeyring(t *testing.T) {
+	t.Parallel()
+
+	if keyring, err := ParseKeyring(""); keyring != nil || err != nil {
+		t.Errorf("expected no keyring without keys, got %v, %v", keyring, err)
+	}
+	invalid := []string{
+		"nokey",
+		"1:not base64!",
+		"1:" + base64.StdEncoding.EncodeToString([]byte("too short")),
+		newKey(t, "1") + "," + newKey(t, "1"),
+	}
+	for _, spec := range invalid {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestKeyring_SealAndOpen(t *testing.T) {
+	t.Parallel()
+
+	old := newKey(t, "1")
+	keyring := mustKeyring(t, old)
+
+	sealed, err := keyring.Seal("spotify:accesstoken", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "hunter2") || !IsSealed(sealed) {
+		t.Fatalf("token was not sealed: %s", sealed)
+	}
+	got, err := keyring.Open("spotify:accesstoken", sealed)
+	if err != nil || got != "hunter2" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// A sealed value only belongs to the row it was written for
+	if _, err := keyring.Open("trakt:accesstoken", sealed); err == nil {
+		t.Error("expected a token moved to another ID to fail to open")
+	}
+
+	// Plaintext from before encryption passes through
+	if got, _ := keyring.Open("spotify:accesstoken", "plain"); got != "plain" {
+		t.Errorf("expected plaintext to pass through, got %q", got)
+	}
+
+	// After a rotation the old key can still read what it sealed
+	rotated := mustKeyring(t, newKey(t, "2")+","+old)
+	if got, err := rotated.Open("spotify:accesstoken", sealed); err != nil || got != "hunter2" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if rotated.Current(sealed) {
+		t.Error("expected a value sealed with an old key to not be current")
+	}
+
+	// Dropping the old key entirely leaves its tokens unreadable
+	if _, err := mustKeyring(t, newKey(t, "3")).Open("spotify:accesstoken", sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestSqliteStore_EncryptTokens(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.Open(t)
+
+	// Tokens saved before any keys were configured
+	plain := &SqliteStore{DB: db}
+	if err := plain.UpsertToken("spotify:accesstoken", "access"); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.UpsertToken("spotify:refreshtoken", "refresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := newKey(t, "1")
+	store := &SqliteStore{DB: db, Keyring: mustKeyring(t, old)}
+	if got := store.GetTokenByID("spotify:accesstoken"); got != "access" {
+		t.Errorf("expected plaintext tokens to still be readable, got %q", got)
+	}
+	if rewritten, err := store.EncryptTokens(); err != nil || rewritten != 2 {
+		t.Fatalf("expected 2 tokens to be encrypted, got %d, %v", rewritten, err)
+	}
+	var stored string
+	if err := db.Get(&stored, "SELECT value FROM tokens WHERE id = ?", "spotify:refreshtoken"); err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(stored) {
+		t.Errorf("expected token to be sealed, got %q", stored)
+	}
+	if got := plain.GetTokenByID("spotify:refreshtoken"); got != "" {
+		t.Errorf("expected nothing without keys, got %q", got)
+	}
+
+	// Rotating rewrites everything under the new key and running again has nothing left to do
+	rotated := &SqliteStore{DB: db, Keyring: mustKeyring(t, newKey(t, "2")+","+old)}
+	if rewritten, err := rotated.EncryptTokens(); err != nil || rewritten != 2 {
+		t.Fatalf("expected 2 tokens to be rotated, got %d, %v", rewritten, err)
+	}
+	if rewritten, _ := rotated.EncryptTokens(); rewritten != 0 {
+		t.Errorf("expected nothing left to rotate, got %d", rewritten)
+	}
+	if got := rotated.GetTokenByID("spotify:refreshtoken"); got != "refresh" {
+		t.Errorf("got %q", got)
+	}
+
+	// Listing tokens tells you about them without giving their values away
+	if err := rotated.UpsertTokenMetadata("spotify:accesstoken", 1000, 3600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := rotated.ListTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || !tokens[0].Encrypted || !tokens[1].Encrypted {
+		t.Fatalf("expected 2 encrypted tokens, got %+v", tokens)
+	}
+	if tokens[0].ExpiresAt == nil || !tokens[0].ExpiresAt.Equal(time.Unix(4600, 0)) {
+		t.Errorf("expected the access token to expire at 4600, got %v", tokens[0].ExpiresAt)
+	}
+	if tokens[1].ExpiresAt != nil {
+		t.Errorf("expected no expiry for the refresh token, got %v", tokens[1].ExpiresAt)
+	}
+}
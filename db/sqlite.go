@@ -2,6 +2,8 @@ package db
 
 import (
 	"embed"
+	"log/slog"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pressly/goose/v3"
@@ -13,6 +15,8 @@ import (
 
 type SqliteStore struct {
 	DB *sqlx.DB
+	// Keyring encrypts OAuth tokens at rest. Without one, tokens are stored as plaintext like they used to be.
+	Keyring *Keyring
 }
 
 func NewSqliteStore(dsn string) (Store, error) {
@@ -87,7 +91,19 @@ func (s *SqliteStore) GetTokenByID(id string) string {
 	if err != nil {
 		return ""
 	}
-	return t.Value
+	if s.Keyring == nil {
+		if IsSealed(t.Value) {
+			slog.Error("Token is encrypted but no token keys are configured", slog.String("id", id))
+			return ""
+		}
+		return t.Value
+	}
+	value, err := s.Keyring.Open(id, t.Value)
+	if err != nil {
+		slog.Error("Failed to decrypt token", slog.String("id", id), slog.String("error", err.Error()))
+		return ""
+	}
+	return value
 }
 
 func (s *SqliteStore) GetTokenMetadataByID(id string) models.TokenMetadata {
@@ -100,6 +116,13 @@ func (s *SqliteStore) GetTokenMetadataByID(id string) models.TokenMetadata {
 }
 
 func (s *SqliteStore) UpsertToken(id, value string) error {
+	if s.Keyring != nil {
+		sealed, err := s.Keyring.Seal(id, value)
+		if err != nil {
+			return err
+		}
+		value = sealed
+	}
 	query := `
 	INSERT INTO tokens (id, value)
 	VALUES (?, ?)
@@ -111,6 +134,76 @@ func (s *SqliteStore) UpsertToken(id, value string) error {
 	return err
 }
 
+// EncryptTokens seals any token that is still plaintext, or was sealed with a key other than
+// the primary one, so rotating keys is a matter of putting a new key first and restarting.
+// It returns how many tokens were rewritten.
+func (s *SqliteStore) EncryptTokens() (int, error) {
+	if s.Keyring == nil {
+		return 0, nil
+	}
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	tokens := []models.Token{}
+	if err := tx.Select(&tokens, "SELECT id, value FROM tokens"); err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, token := range tokens {
+		if s.Keyring.Current(token.Value) {
+			continue
+		}
+		plaintext, err := s.Keyring.Open(token.ID, token.Value)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := s.Keyring.Seal(token.ID, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE tokens SET value = ? WHERE id = ?", sealed, token.ID); err != nil {
+			return 0, err
+		}
+		rewritten++
+	}
+	return rewritten, tx.Commit()
+}
+
+// TokenInfo describes a stored token without giving away its value
+type TokenInfo struct {
+	ID        string
+	Encrypted bool
+	CreatedAt *time.Time
+	ExpiresAt *time.Time
+}
+
+func (s *SqliteStore) ListTokens() ([]TokenInfo, error) {
+	rows := []struct {
+		models.Token
+		CreatedAt int64 `db:"createdat"`
+		ExpiresIn int64 `db:"expiresin"`
+	}{}
+	err := s.DB.Select(&rows, `
+	  SELECT t.id, t.value, COALESCE(m.createdat, 0) AS createdat, COALESCE(m.expiresin, 0) AS expiresin
+	  FROM tokens t LEFT JOIN tokenmetadata m ON m.id = t.id
+	  ORDER BY t.id`)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]TokenInfo, len(rows))
+	for i, row := range rows {
+		tokens[i] = TokenInfo{ID: row.ID, Encrypted: IsSealed(row.Value)}
+		if row.CreatedAt != 0 {
+			createdAt := time.Unix(row.CreatedAt, 0)
+			expiresAt := createdAt.Add(time.Duration(row.ExpiresIn) * time.Second)
+			tokens[i].CreatedAt, tokens[i].ExpiresAt = &createdAt, &expiresAt
+		}
+	}
+	return tokens, nil
+}
+
 func (s *SqliteStore) UpsertTokenMetadata(id string, createdat, expiresin int64) error {
 	query := `
 	INSERT INTO tokenmetadata (id, createdat, expiresin)
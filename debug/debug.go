@@ -1,19 +1,28 @@
 package debug
 
 import (
+	"fmt"
 	"html/template"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/auth"
 	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/export"
+	"github.com/marcus-crane/gunslinger/health"
 	"github.com/marcus-crane/gunslinger/playback"
 )
 
 const (
 	spotifyAccessTokenID = "spotify:accesstoken"
 	traktAccessTokenID   = "trakt:accesstoken"
+	// The full history is available as an export so the page only needs enough to glance at
+	recentAuditEntries = 25
 )
 
 type IntegrationStatus struct {
@@ -26,43 +35,166 @@ type IntegrationStatus struct {
 }
 
 type DebugPageData struct {
-	Integrations  []IntegrationStatus
-	PlaybackState []playback.FullPlaybackEntry
-	Token         string
-	Status        string
+	Integrations   []IntegrationStatus
+	Jobs           []health.Job
+	PlaybackState  []playback.FullPlaybackEntry
+	CoverReport    *playback.CoverReport
+	APIKeys        []auth.Key
+	Scopes         []auth.Scope
+	AuditLog       []audit.Entry
+	NewKey         string
+	KeyError       string
+	Status         string
 	StatusProvider string
 }
 
 type Handler struct {
-	cfg         config.Config
-	ps          *playback.PlaybackSystem
-	store       db.Store
-	tmpl        *template.Template
-	oauthStates *oauthStateStore
+	cfg        config.Config
+	ps         *playback.PlaybackSystem
+	store      db.Store
+	authorizer *auth.Authorizer
+	keys       *auth.Store
+	auditLog   *audit.Log
+	tracker    *health.Tracker
+	tmpl       *template.Template
 }
 
-func NewHandler(cfg config.Config, ps *playback.PlaybackSystem, store db.Store) *Handler {
+func NewHandler(cfg config.Config, ps *playback.PlaybackSystem, store db.Store, authorizer *auth.Authorizer, keys *auth.Store, auditLog *audit.Log, tracker *health.Tracker) *Handler {
 	tmpl := template.Must(template.New("debug").Parse(pageTmpl))
-	return &Handler{cfg: cfg, ps: ps, store: store, tmpl: tmpl, oauthStates: newOAuthStateStore()}
+	return &Handler{cfg: cfg, ps: ps, store: store, authorizer: authorizer, keys: keys, auditLog: auditLog, tracker: tracker, tmpl: tmpl}
 }
 
-func (h *Handler) authorized(r *http.Request) bool {
-	token := h.cfg.Gunslinger.SuperSecretToken
-	return token != "" && r.URL.Query().Get("token") == token
+// authorized lets in anyone already signed in to the debug page. Anyone presenting an admin
+// secret is let in too and signed in, so the secret never has to go in a link or redirect.
+func (h *Handler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if existing, ok := sessions.lookup(cookie.Value); ok {
+			audit.Actor(r.Context(), existing.actor)
+			return true
+		}
+	}
+	principal, err := h.authorizer.Authorize(r, auth.ScopeAdmin)
+	if err != nil {
+		return false
+	}
+	id, expires := sessions.create(principal.Name())
+	setSessionCookie(w, r, id, expires)
+	return true
 }
 
+// ServeDebugPage shows the page to anyone signed in and asks everyone else for the secret
 func (h *Handler) ServeDebugPage(w http.ResponseWriter, r *http.Request) {
-	if !h.authorized(r) {
+	if !h.authorized(w, r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, signInPage)
+		return
+	}
+	// Whoever signed in with a form or an old ?token= link is sent back without it so the secret
+	// doesn't linger in their history
+	query := r.URL.Query()
+	if r.Method == http.MethodPost || query.Has("token") {
+		query.Del("token")
+		target := "/debug"
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+
+	data := h.buildPageData(query.Get("status"), query.Get("provider"))
+	h.render(w, data)
+}
+
+// ServeAuditExport downloads the whole audit log for whoever is signed in to the debug page
+func (h *Handler) ServeAuditExport(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	w.Header().Set("Content-Type", export.CSV.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "gunslinger-audit-"+time.Now().Format(time.DateOnly)+".csv"))
+	if err := h.auditLog.Write(export.CSV, time.Time{}, w); err != nil {
+		slog.Error("Failed to export audit log", slog.String("error", err.Error()))
+	}
+}
 
-	data := h.buildPageData(r.URL.Query().Get("token"), r.URL.Query().Get("status"), r.URL.Query().Get("provider"))
+// ServeKeys creates and revokes API keys. A new key is shown straight away rather than
+// redirecting so that it never ends up in a URL.
+func (h *Handler) ServeKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(w, r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data := h.buildPageData("", "")
+	switch r.FormValue("action") {
+	case "create":
+		scopes, err := auth.ParseScopes(strings.Join(r.Form["scope"], ","))
+		if err != nil {
+			data.KeyError = err.Error()
+			break
+		}
+		key, secret, err := h.keys.Create(r.FormValue("name"), scopes)
+		if err != nil {
+			data.KeyError = err.Error()
+			break
+		}
+		slog.Info("Created API key via debug page", slog.String("name", key.Name), slog.String("scopes", key.Scopes.String()))
+		audit.Note(r.Context(), "created key %d %q with %s", key.ID, key.Name, key.Scopes)
+		data.NewKey = secret
+	case "revoke":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err == nil {
+			err = h.keys.Revoke(id)
+		}
+		if err != nil {
+			data.KeyError = err.Error()
+			break
+		}
+		slog.Info("Revoked API key via debug page", slog.Int64("id", id))
+		audit.Note(r.Context(), "revoked key %d", id)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	// Reload so the list reflects whatever just happened
+	data.APIKeys = h.listKeys()
+	h.render(w, data)
+}
+
+func (h *Handler) render(w http.ResponseWriter, data DebugPageData) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	h.tmpl.Execute(w, data)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.tmpl.Execute(w, data); err != nil {
+		slog.Error("Failed to render debug page", slog.String("error", err.Error()))
+	}
+}
+
+func (h *Handler) listKeys() []auth.Key {
+	keys, err := h.keys.List()
+	if err != nil {
+		slog.Error("Failed to list API keys", slog.String("error", err.Error()))
+	}
+	return keys
+}
+
+func (h *Handler) recentAudit() []audit.Entry {
+	entries, err := h.auditLog.Recent(recentAuditEntries)
+	if err != nil {
+		slog.Error("Failed to load audit log", slog.String("error", err.Error()))
+	}
+	return entries
 }
 
-func (h *Handler) buildPageData(token, status, statusProvider string) DebugPageData {
+func (h *Handler) buildPageData(status, statusProvider string) DebugPageData {
 	cfg := h.cfg
 
 	integrations := []IntegrationStatus{
@@ -76,8 +208,12 @@ func (h *Handler) buildPageData(token, status, statusProvider string) DebugPageD
 
 	return DebugPageData{
 		Integrations:   integrations,
-		PlaybackState:  h.ps.State,
-		Token:          token,
+		Jobs:           h.tracker.Jobs(),
+		PlaybackState:  h.ps.Active(),
+		CoverReport:    h.ps.LastCoverReport(),
+		APIKeys:        h.listKeys(),
+		AuditLog:       h.recentAudit(),
+		Scopes:         auth.AllScopes,
 		Status:         status,
 		StatusProvider: statusProvider,
 	}
@@ -98,6 +234,28 @@ func (h *Handler) oauthStatus(name string, configured bool, tokenID string) Inte
 	return s
 }
 
+const signInPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Gunslinger Debug</title>
+<style>
+  body { font-family: monospace; max-width: 900px; margin: 2rem auto; padding: 0 1rem; }
+  h1 { font-size: 1.4rem; }
+</style>
+</head>
+<body>
+<h1>Gunslinger Debug</h1>
+<form method="POST" action="/debug">
+  <p>
+    <input type="password" name="token" placeholder="Secret token" required autofocus>
+    <button type="submit">Sign in</button>
+  </p>
+</form>
+</body>
+</html>`
+
 const pageTmpl = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -165,7 +323,6 @@ const pageTmpl = `<!DOCTYPE html>
         {{if and .HasOAuth .Configured}}
         <form method="POST" action="/oauth/reauth" style="margin:0">
           <input type="hidden" name="provider" value="{{.ProviderKey}}">
-          <input type="hidden" name="token" value="{{$.Token}}">
           <button type="submit" class="reauth">Reauth</button>
         </form>
         {{end}}
@@ -175,6 +332,38 @@ const pageTmpl = `<!DOCTYPE html>
   </tbody>
 </table>
 
+<h2>Background Jobs</h2>
+{{if .Jobs}}
+<table>
+  <thead>
+    <tr>
+      <th>Job</th>
+      <th>Every</th>
+      <th>Status</th>
+      <th>Last Run</th>
+      <th>Last Success</th>
+      <th>Failures</th>
+      <th>Last Error</th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .Jobs}}
+    <tr>
+      <td>{{.Name}}</td>
+      <td>{{.Interval}}</td>
+      <td>{{if eq .Status "ok"}}<span class="ok">ok</span>{{else if eq .Status "pending"}}<span class="dim">pending</span>{{else}}<span class="bad">{{.Status}}</span>{{end}}</td>
+      <td>{{if .LastRun}}{{.LastRun.Format "2006-01-02 15:04:05 MST"}}{{else}}<span class="dim">never</span>{{end}}</td>
+      <td>{{if .LastSuccess}}{{.LastSuccess.Format "2006-01-02 15:04:05 MST"}}{{else}}<span class="dim">never</span>{{end}}</td>
+      <td{{if .ConsecutiveFailures}} class="warn"{{end}}>{{.ConsecutiveFailures}}</td>
+      <td>{{if .LastError}}{{.LastError}}{{if .LastErrorAt}} <span class="dim">({{.LastErrorAt.Format "2006-01-02 15:04 MST"}})</span>{{end}}{{end}}</td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+{{else}}
+<p class="dim">No background jobs are scheduled.</p>
+{{end}}
+
 <h2>Current Playback</h2>
 {{if .PlaybackState}}
 <table>
@@ -205,5 +394,122 @@ const pageTmpl = `<!DOCTYPE html>
 <p class="dim">Nothing currently playing.</p>
 {{end}}
 
+<h2>Cover Integrity</h2>
+{{with .CoverReport}}
+<p>
+  Last checked {{.FinishedAt.Format "2006-01-02 15:04 MST"}}:
+  {{.Checked}} checked, {{.Missing}} missing, {{.Corrupt}} corrupt,
+  <span class="ok">{{.Refetched}} refetched</span>, {{.Analysed}} analysed, {{.OrphansRemoved}} orphans removed
+</p>
+{{if .Error}}<div class="banner bad">{{.Error}}</div>{{end}}
+{{if .Unrecoverable}}
+<table>
+  <thead>
+    <tr>
+      <th>Media ID</th>
+      <th>Title</th>
+      <th>Problem</th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .Unrecoverable}}
+    <tr>
+      <td>{{.MediaID}}</td>
+      <td>{{.Title}}</td>
+      <td class="bad">{{.Problem}}</td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+{{end}}
+{{else}}
+<p class="dim">The cover check hasn't run since startup.</p>
+{{end}}
+
+<h2>API Keys</h2>
+{{if .NewKey}}
+<div class="banner ok">New key created. Copy it now as it won't be shown again: <code>{{.NewKey}}</code></div>
+{{end}}
+{{if .KeyError}}<div class="banner bad">{{.KeyError}}</div>{{end}}
+{{if .APIKeys}}
+<table>
+  <thead>
+    <tr>
+      <th>Name</th>
+      <th>Key</th>
+      <th>Scopes</th>
+      <th>Created</th>
+      <th>Last Used</th>
+      <th></th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .APIKeys}}
+    <tr{{if .Revoked}} class="dim"{{end}}>
+      <td>{{.Name}}</td>
+      <td>{{.Prefix}}_…</td>
+      <td>{{.Scopes}}</td>
+      <td>{{.CreatedAt.Format "2006-01-02 15:04 MST"}}</td>
+      <td>{{if .LastUsedAt}}{{.LastUsedAt.Format "2006-01-02 15:04 MST"}}{{else}}<span class="dim">never</span>{{end}}</td>
+      <td>
+        {{if .Revoked}}
+        revoked {{.RevokedAt.Format "2006-01-02"}}
+        {{else}}
+        <form method="POST" action="/debug/keys" style="margin:0">
+          <input type="hidden" name="action" value="revoke">
+          <input type="hidden" name="id" value="{{.ID}}">
+          <button type="submit" class="reauth">Revoke</button>
+        </form>
+        {{end}}
+      </td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+{{else}}
+<p class="dim">No API keys have been created yet.</p>
+{{end}}
+<form method="POST" action="/debug/keys">
+  <input type="hidden" name="action" value="create">
+  <p>
+    <input type="text" name="name" placeholder="Key name" required>
+    {{range .Scopes}}
+    <label><input type="checkbox" name="scope" value="{{.}}"> {{.}}</label>
+    {{end}}
+    <button type="submit" class="reauth">Create</button>
+  </p>
+</form>
+
+<h2>Audit Log</h2>
+{{if .AuditLog}}
+<table>
+  <thead>
+    <tr>
+      <th>When</th>
+      <th>Who</th>
+      <th>Action</th>
+      <th>Detail</th>
+      <th>Status</th>
+      <th>From</th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .AuditLog}}
+    <tr>
+      <td>{{.OccurredAt.Format "2006-01-02 15:04 MST"}}</td>
+      <td>{{.Actor}}</td>
+      <td>{{.Action}}</td>
+      <td>{{.Detail}}</td>
+      <td{{if ge .Status 400}} class="bad"{{end}}>{{.Status}}</td>
+      <td>{{.ClientIP}}</td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+<p><a href="/debug/audit">Export as CSV</a></p>
+{{else}}
+<p class="dim">Nothing has been recorded yet.</p>
+{{end}}
+
 </body>
 </html>`
@@ -0,0 +1,126 @@
+package debug
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/health"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+const secret = "super-secret"
+
+func newTestHandler(t *testing.T) (*Handler, *auth.Store) {
+	db := testdb.Open(t)
+	keys := auth.NewStore(db)
+	h := NewHandler(config.Config{}, playback.NewPlaybackSystem(db), nil, auth.NewAuthorizer(keys, secret), keys, audit.NewLog(db), health.NewTracker())
+	return h, keys
+}
+
+func sessionFrom(t *testing.T, res *http.Response) *http.Cookie {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	require.Fail(t, "no session cookie was set")
+	return nil
+}
+
+func TestServeDebugPage_SignsInWithoutLeakingSecret(t *testing.T) {
+	h, _ := newTestHandler(t)
+	require.NoError(t, h.auditLog.Record(audit.Entry{OccurredAt: time.Now(), Actor: "legacy token", Action: "debug.view"}))
+
+	w := httptest.NewRecorder()
+	h.ServeDebugPage(w, httptest.NewRequest(http.MethodGet, "/debug", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="POST" action="/debug">`)
+
+	// Signing in swaps the secret for a cookie and sends us back to a clean URL
+	r := httptest.NewRequest(http.MethodPost, "/debug", strings.NewReader(url.Values{"token": {secret}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeDebugPage(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/debug", w.Header().Get("Location"))
+	cookie := sessionFrom(t, w.Result())
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	r = httptest.NewRequest(http.MethodGet, "/debug?status=ok&provider=trakt", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	h.ServeDebugPage(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Successfully reauthorized trakt")
+	assert.NotContains(t, w.Body.String(), secret)
+	assert.NotContains(t, w.Body.String(), `name="token"`)
+	assert.Contains(t, w.Body.String(), `href="/debug/audit"`)
+
+	// Old links with the secret in them still work but don't stay in the address bar
+	w = httptest.NewRecorder()
+	h.ServeDebugPage(w, httptest.NewRequest(http.MethodGet, "/debug?token="+secret+"&status=ok&provider=trakt", nil))
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/debug?provider=trakt&status=ok", w.Header().Get("Location"))
+
+	// Made up sessions get nowhere
+	r = httptest.NewRequest(http.MethodGet, "/debug", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "made-up"})
+	w = httptest.NewRecorder()
+	h.ServeDebugPage(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestServeReauth_SignsInHeaderSessions(t *testing.T) {
+	h, keys := newTestHandler(t)
+	_, adminKey, err := keys.Create("admin", auth.Scopes{auth.ScopeAdmin})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/oauth/reauth", strings.NewReader(url.Values{"provider": {"trakt"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+adminKey)
+	w := httptest.NewRecorder()
+	h.ServeReauth(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.NotContains(t, w.Header().Get("Location"), adminKey)
+
+	// Coming back from the provider lands on the page without needing the header again
+	r = httptest.NewRequest(http.MethodGet, "/debug?status=ok&provider=trakt", nil)
+	r.AddCookie(sessionFrom(t, w.Result()))
+	w = httptest.NewRecorder()
+	h.ServeDebugPage(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestServeOAuthCallback_SurvivesRebuild(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/oauth/reauth", strings.NewReader(url.Values{"provider": {"trakt"}, "token": {secret}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeReauth(w, r)
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	state := location.Query().Get("state")
+	require.NotEmpty(t, state)
+
+	// Routes are rebuilt whenever config is reloaded or the lease changes hands, which shouldn't
+	// forget about a reauth that's halfway through
+	rebuilt, _ := newTestHandler(t)
+	w = httptest.NewRecorder()
+	rebuilt.ServeOAuthCallback(w, httptest.NewRequest(http.MethodGet, "/oauth/trakt/callback?state="+state, nil))
+	assert.NotContains(t, w.Body.String(), "Invalid or expired state")
+	assert.Contains(t, w.Body.String(), "Missing code")
+}
@@ -8,6 +8,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/db"
 	"github.com/marcus-crane/gunslinger/shared"
 	"github.com/marcus-crane/gunslinger/spotify"
 	"github.com/marcus-crane/gunslinger/trakt"
@@ -15,7 +18,6 @@ import (
 
 type pendingOAuth struct {
 	provider  string
-	token     string // debug auth token for redirect back
 	createdAt time.Time
 }
 
@@ -24,11 +26,11 @@ type oauthStateStore struct {
 	states map[string]pendingOAuth
 }
 
-func newOAuthStateStore() *oauthStateStore {
-	return &oauthStateStore{states: make(map[string]pendingOAuth)}
-}
+// Like sessions, these outlive the handler being rebuilt on a reload or a change of leader so
+// that a reauth in progress can still finish
+var oauthStates = &oauthStateStore{states: make(map[string]pendingOAuth)}
 
-func (s *oauthStateStore) add(state, provider, token string) {
+func (s *oauthStateStore) add(state, provider string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// Clean up expired entries while we're here
@@ -39,7 +41,6 @@ func (s *oauthStateStore) add(state, provider, token string) {
 	}
 	s.states[state] = pendingOAuth{
 		provider:  provider,
-		token:     token,
 		createdAt: time.Now(),
 	}
 }
@@ -58,49 +59,104 @@ func (s *oauthStateStore) consume(state string) (pendingOAuth, bool) {
 	return p, true
 }
 
+// OAuthProviders are the sources that need someone to sign in with them every so often
+var OAuthProviders = []string{"spotify", "trakt"}
+
+// AuthURL is where to send someone to sign in with a provider. The state is whatever should
+// come back to us in the callback.
+func AuthURL(cfg config.Config, provider, state string) (string, error) {
+	switch provider {
+	case "spotify":
+		return fmt.Sprintf("%s?response_type=code&client_id=%s&scope=%s&redirect_uri=%s&state=%s",
+			"https://accounts.spotify.com/authorize",
+			cfg.Spotify.ClientId,
+			url.QueryEscape("streaming"),
+			url.QueryEscape(cfg.Spotify.RedirectUri),
+			url.QueryEscape(state),
+		), nil
+	case "trakt":
+		return fmt.Sprintf("%s?response_type=code&client_id=%s&redirect_uri=%s&state=%s",
+			"https://api.trakt.tv/oauth/authorize",
+			cfg.Trakt.ClientId,
+			url.QueryEscape(cfg.Trakt.RedirectUri),
+			url.QueryEscape(state),
+		), nil
+	}
+	return "", fmt.Errorf("unknown provider %q, expected one of %v", provider, OAuthProviders)
+}
+
+// CompleteOAuth trades the code a provider handed back for tokens and saves them
+func CompleteOAuth(cfg config.Config, store db.Store, provider, code string) error {
+	var token *shared.TokenResponse
+	var err error
+	var accessTokenID, refreshTokenID string
+
+	switch provider {
+	case "spotify":
+		token, err = spotify.ExchangeCodeForToken(cfg, code)
+		accessTokenID = "spotify:accesstoken"
+		refreshTokenID = "spotify:refreshtoken"
+	case "trakt":
+		token, err = trakt.ExchangeCodeForToken(cfg, code)
+		accessTokenID = "trakt:accesstoken"
+		refreshTokenID = "trakt:refreshtoken"
+	default:
+		return fmt.Errorf("unknown provider %q, expected one of %v", provider, OAuthProviders)
+	}
+	if err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("%s didn't hand back an access token", provider)
+	}
+
+	if err := store.UpsertToken(accessTokenID, token.AccessToken); err != nil {
+		return fmt.Errorf("failed to save access token: %w", err)
+	}
+	if err := store.UpsertToken(refreshTokenID, token.RefreshToken); err != nil {
+		return fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
+	createdAt := token.CreatedAt
+	if createdAt == 0 {
+		createdAt = time.Now().Unix()
+	}
+	if err := store.UpsertTokenMetadata(accessTokenID, createdAt, token.ExpiresIn); err != nil {
+		return fmt.Errorf("failed to save token metadata: %w", err)
+	}
+	return nil
+}
+
 func (h *Handler) ServeReauth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	token := r.FormValue("token")
-	if token == "" || token != h.cfg.Gunslinger.SuperSecretToken {
+	// This also signs in anyone using a header so they're still signed in when they come back
+	if !h.authorized(w, r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	provider := r.FormValue("provider")
 
-	var authURL string
-	switch provider {
-	case "spotify":
-		authURL = fmt.Sprintf("%s?response_type=code&client_id=%s&scope=%s&redirect_uri=%s&state=",
-			"https://accounts.spotify.com/authorize",
-			h.cfg.Spotify.ClientId,
-			url.QueryEscape("streaming"),
-			url.QueryEscape(h.cfg.Spotify.RedirectUri),
-		)
-	case "trakt":
-		authURL = fmt.Sprintf("%s?response_type=code&client_id=%s&redirect_uri=%s&state=",
-			"https://api.trakt.tv/oauth/authorize",
-			h.cfg.Trakt.ClientId,
-			url.QueryEscape(h.cfg.Trakt.RedirectUri),
-		)
-	default:
+	state := shared.GenerateRandomString(16)
+	authURL, err := AuthURL(h.cfg, provider, state)
+	if err != nil {
 		http.Error(w, "Unknown provider", http.StatusBadRequest)
 		return
 	}
 
-	state := shared.GenerateRandomString(16)
-	h.oauthStates.add(state, provider, token)
+	audit.Note(r.Context(), "started reauthorizing %s", provider)
+	oauthStates.add(state, provider)
 
-	http.Redirect(w, r, authURL+state, http.StatusFound)
+	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 func (h *Handler) ServeOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	state := r.URL.Query().Get("state")
-	pending, ok := h.oauthStates.consume(state)
+	pending, ok := oauthStates.consume(state)
 	if !ok {
 		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
 		return
@@ -112,51 +168,18 @@ func (h *Handler) ServeOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var token *shared.TokenResponse
-	var err error
-	var accessTokenID, refreshTokenID string
-
-	switch pending.provider {
-	case "spotify":
-		token, err = spotify.ExchangeCodeForToken(h.cfg, code)
-		accessTokenID = "spotify:accesstoken"
-		refreshTokenID = "spotify:refreshtoken"
-	case "trakt":
-		token, err = trakt.ExchangeCodeForToken(h.cfg, code)
-		accessTokenID = "trakt:accesstoken"
-		refreshTokenID = "trakt:refreshtoken"
-	}
-
-	if err != nil {
+	if err := CompleteOAuth(h.cfg, h.store, pending.provider, code); err != nil {
 		slog.Error("Failed to exchange code for token",
 			slog.String("provider", pending.provider),
 			slog.String("error", err.Error()))
-		redirectURL := fmt.Sprintf("/debug?token=%s&status=error&provider=%s",
-			url.QueryEscape(pending.token), pending.provider)
-		http.Redirect(w, r, redirectURL, http.StatusFound)
+		audit.Note(r.Context(), "failed to reauthorize %s", pending.provider)
+		http.Redirect(w, r, "/debug?status=error&provider="+url.QueryEscape(pending.provider), http.StatusFound)
 		return
 	}
 
-	if err := h.store.UpsertToken(accessTokenID, token.AccessToken); err != nil {
-		slog.Error("Failed to save access token", slog.String("error", err.Error()))
-	}
-	if err := h.store.UpsertToken(refreshTokenID, token.RefreshToken); err != nil {
-		slog.Error("Failed to save refresh token", slog.String("error", err.Error()))
-	}
-
-	createdAt := token.CreatedAt
-	if createdAt == 0 {
-		createdAt = time.Now().Unix()
-	}
-	if err := h.store.UpsertTokenMetadata(accessTokenID, createdAt, token.ExpiresIn); err != nil {
-		slog.Error("Failed to save token metadata", slog.String("error", err.Error()))
-	}
-
 	slog.Info("Successfully reauthorized via debug page",
 		slog.String("provider", pending.provider))
+	audit.Note(r.Context(), "reauthorized %s", pending.provider)
 
-	redirectURL := fmt.Sprintf("/debug?token=%s&status=ok&provider=%s",
-		url.QueryEscape(pending.token), pending.provider)
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	http.Redirect(w, r, "/debug?status=ok&provider="+url.QueryEscape(pending.provider), http.StatusFound)
 }
-
@@ -0,0 +1,72 @@
+package debug
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "gunslinger_debug"
+	// Long enough to get through a reauth but short enough that a forgotten tab doesn't matter
+	sessionTTL = time.Hour
+)
+
+type session struct {
+	actor   string
+	expires time.Time
+}
+
+// sessionStore remembers who signed in to the debug page so the secret only has to be sent
+// once, in a header or a form, instead of riding along in every link and redirect
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// Handlers are rebuilt whenever config is reloaded so sessions live out here to survive that
+var sessions = &sessionStore{sessions: map[string]session{}}
+
+func (s *sessionStore) create(actor string) (string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Clean up expired sessions while we're here
+	for id, existing := range s.sessions {
+		if time.Now().After(existing.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	id := hex.EncodeToString(raw)
+	expires := time.Now().Add(sessionTTL)
+	s.sessions[id] = session{actor: actor, expires: expires}
+	return id, expires
+}
+
+func (s *sessionStore) lookup(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.sessions[id]
+	if !ok || time.Now().After(existing.expires) {
+		delete(s.sessions, id)
+		return session{}, false
+	}
+	return existing, true
+}
+
+// setSessionCookie signs someone in. Lax keeps the cookie off form posts from other sites while
+// still sending it when a provider redirects back to us after reauthorizing.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+
+	"github.com/marcus-crane/gunslinger/config"
+	gdb "github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/storage"
+	"github.com/marcus-crane/gunslinger/users"
+)
+
+// Tokens expiring sooner than this are worth a heads up even though they usually refresh themselves
+const tokenExpiryWarning = 7 * 24 * time.Hour
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+	checkSkip checkStatus = "skip"
+)
+
+type check struct {
+	status checkStatus
+	name   string
+	detail string
+}
+
+// runDoctor checks that everything is set up properly, exiting with an error if anything is
+// broken enough to stop us from working ie; gunslinger doctor
+func runDoctor(cfg config.Config, args []string) {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gunslinger doctor")
+		os.Exit(2)
+	}
+
+	// We don't migrate here as the doctor shouldn't change anything it's looking at
+	db := connectDatabase(cfg)
+	defer db.Close()
+
+	database := checkDatabase(db)
+	checks := []check{database, checkStorage(cfg)}
+	if database.status == checkOK {
+		checks = append(checks, checkTokens(cfg, db)...)
+		checks = append(checks, checkSources(cfg, db)...)
+	} else {
+		// Tokens and accounts live in tables that may not exist yet
+		checks = append(checks, check{checkSkip, "tokens and sources", "skipped until the database is sorted out"})
+	}
+
+	failed := false
+	for _, c := range checks {
+		fmt.Printf("%-6s %s: %s\n", "["+c.status+"]", c.name, c.detail)
+		failed = failed || c.status == checkFail
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func checkDatabase(db *sqlx.DB) check {
+	var result string
+	if err := db.Get(&result, "PRAGMA quick_check"); err != nil {
+		return check{checkFail, "database", err.Error()}
+	}
+	if result != "ok" {
+		return check{checkFail, "database", "quick check found problems: " + result}
+	}
+	current, err := goose.GetDBVersion(db.DB)
+	if err != nil {
+		return check{checkFail, "database", "failed to read the schema version: " + err.Error()}
+	}
+	all, err := goose.CollectMigrations(".", 0, goose.MaxVersion)
+	if err != nil {
+		return check{checkFail, "database", err.Error()}
+	}
+	latest, err := all.Last()
+	if err != nil {
+		return check{checkFail, "database", err.Error()}
+	}
+	if current < latest.Version {
+		return check{checkWarn, "database", fmt.Sprintf("at version %d of %d, run gunslinger migrate up or start the server to catch up", current, latest.Version)}
+	}
+	return check{checkOK, "database", fmt.Sprintf("quick check passed, at version %d", current)}
+}
+
+// checkStorage writes a file and reads it back as that's the only way to be sure with S3
+func checkStorage(cfg config.Config) check {
+	backend, err := storage.New(cfg)
+	if err != nil {
+		return check{checkFail, "storage", err.Error()}
+	}
+	key := "doctor-" + time.Now().Format("20060102150405") + ".txt"
+	content := []byte("gunslinger doctor was here")
+	if err := backend.Put(key, content); err != nil {
+		return check{checkFail, "storage", "failed to write: " + err.Error()}
+	}
+	defer backend.Delete(key)
+	got, err := backend.Get(key)
+	if err != nil {
+		return check{checkFail, "storage", "failed to read back: " + err.Error()}
+	}
+	if !bytes.Equal(got, content) {
+		return check{checkFail, "storage", "read back something other than what was written"}
+	}
+	name := cfg.Storage.Backend
+	if name == "" {
+		name = storage.FilesystemBackend + " at " + cfg.Gunslinger.StorageDir
+	}
+	return check{checkOK, "storage", name + " is readable and writable"}
+}
+
+func checkTokens(cfg config.Config, db *sqlx.DB) []check {
+	keyring, err := gdb.ParseKeyring(cfg.Gunslinger.TokenKeys)
+	if err != nil {
+		return []check{{checkFail, "token encryption", err.Error()}}
+	}
+	store := gdb.SqliteStore{DB: db, Keyring: keyring}
+	tokens, err := store.ListTokens()
+	if err != nil {
+		return []check{{checkFail, "tokens", err.Error()}}
+	}
+
+	checks := []check{}
+	plaintext, sealed := 0, 0
+	for _, token := range tokens {
+		if token.Encrypted {
+			sealed++
+		} else {
+			plaintext++
+		}
+	}
+	switch {
+	case keyring == nil && sealed > 0:
+		checks = append(checks, check{checkFail, "token encryption", fmt.Sprintf("%d tokens are encrypted but TOKEN_ENCRYPTION_KEYS isn't set", sealed)})
+	case keyring == nil:
+		checks = append(checks, check{checkWarn, "token encryption", "TOKEN_ENCRYPTION_KEYS isn't set so tokens are stored as plaintext"})
+	case plaintext > 0:
+		checks = append(checks, check{checkWarn, "token encryption", fmt.Sprintf("%d tokens will be encrypted next time the server starts", plaintext)})
+	default:
+		checks = append(checks, check{checkOK, "token encryption", fmt.Sprintf("all %d tokens are encrypted", sealed)})
+	}
+
+	for _, token := range tokens {
+		if token.ExpiresAt == nil {
+			continue
+		}
+		provider, _, _ := strings.Cut(token.ID, ":")
+		name := "token " + token.ID
+		switch until := time.Until(*token.ExpiresAt); {
+		case keyring != nil && store.GetTokenByID(token.ID) == "":
+			checks = append(checks, check{checkFail, name, "can't be decrypted with the configured keys, run gunslinger reauth " + provider})
+		case until < 0:
+			checks = append(checks, check{checkWarn, name, fmt.Sprintf("expired %s, it should refresh itself but if not run gunslinger reauth %s", token.ExpiresAt.Format("2006-01-02 15:04"), provider)})
+		case until < tokenExpiryWarning:
+			checks = append(checks, check{checkWarn, name, "expires " + token.ExpiresAt.Format("2006-01-02 15:04")})
+		default:
+			checks = append(checks, check{checkOK, name, "expires " + token.ExpiresAt.Format("2006-01-02 15:04")})
+		}
+	}
+	return checks
+}
+
+// checkSources makes sure each source has what it needs to be polled
+func checkSources(cfg config.Config, db *sqlx.DB) []check {
+	keyring, _ := gdb.ParseKeyring(cfg.Gunslinger.TokenKeys)
+	userStore := users.NewStore(db, keyring)
+	store := gdb.SqliteStore{DB: db, Keyring: keyring}
+
+	sources := []struct {
+		name     string
+		source   config.SourceConfig
+		interval time.Duration
+		missing  []string
+		accounts string
+	}{
+		{"anilist", cfg.Sources.Anilist, time.Second * 15, missingSettings("ANILIST_TOKEN", cfg.Anilist.Token), users.Anilist},
+		{"plex", cfg.Sources.Plex, time.Second, missingSettings("PLEX_URL", cfg.Plex.URL, "PLEX_TOKEN", cfg.Plex.Token), users.Plex},
+		{"retroachievements", cfg.Sources.RetroAchievements, time.Minute, missingSettings("RETROACHIEVEMENTS_USERNAME", cfg.RetroAchievements.Username, "RETROACHIEVEMENTS_TOKEN", cfg.RetroAchievements.Token), ""},
+		{"spotify", cfg.Sources.Spotify, 0, missingSettings("SPOTIFY_CLIENT_ID", cfg.Spotify.ClientId, "SPOTIFY_CLIENT_SECRET", cfg.Spotify.ClientSecret, "SPOTIFY_REDIRECT_URI", cfg.Spotify.RedirectUri, "a token from gunslinger reauth spotify", store.GetTokenByID("spotify:accesstoken")), ""},
+		{"steam", cfg.Sources.Steam, time.Second * 15, missingSettings("STEAM_TOKEN", cfg.Steam.Token), users.Steam},
+		{"trakt", cfg.Sources.Trakt, time.Second * 15, missingSettings("TRAKT_CLIENT_ID", cfg.Trakt.ClientId, "TRAKT_CLIENT_SECRET", cfg.Trakt.ClientSecret, "a token from gunslinger reauth trakt", store.GetTokenByID("trakt:accesstoken")), users.Trakt},
+	}
+
+	checks := []check{}
+	for _, s := range sources {
+		name := "source " + s.name
+		if !s.source.IsEnabled() {
+			checks = append(checks, check{checkSkip, name, "disabled in the config file"})
+			continue
+		}
+		if len(s.missing) > 0 {
+			checks = append(checks, check{checkWarn, name, "enabled but missing " + strings.Join(s.missing, ", ")})
+			continue
+		}
+		detail := "configured"
+		if s.interval > 0 {
+			detail = "polling every " + s.source.Every(s.interval).String()
+		}
+		if s.accounts != "" {
+			accounts, err := userStore.Accounts(cfg, s.accounts)
+			if err != nil {
+				checks = append(checks, check{checkFail, name, "failed to load accounts: " + err.Error()})
+				continue
+			}
+			if len(accounts) == 0 {
+				checks = append(checks, check{checkWarn, name, "configured but nobody has an account, see gunslinger users set-source"})
+				continue
+			}
+			if len(accounts) == 1 {
+				detail += " for 1 account"
+			} else {
+				detail += fmt.Sprintf(" for %d accounts", len(accounts))
+			}
+		}
+		if !cfg.Gunslinger.BackgroundJobsEnabled && s.name != "spotify" {
+			checks = append(checks, check{checkWarn, name, detail + " once BACKGROUND_JOBS_ENABLED is turned on"})
+			continue
+		}
+		checks = append(checks, check{checkOK, name, detail})
+	}
+	return checks
+}
+
+// missingSettings takes pairs of names and values, returning the names of any that are empty
+func missingSettings(pairs ...string) []string {
+	missing := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			missing = append(missing, pairs[i])
+		}
+	}
+	return missing
+}
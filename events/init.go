@@ -1,6 +1,14 @@
 package events
 
-import "github.com/r3labs/sse/v2"
+import (
+	"strconv"
+	"time"
+
+	"github.com/r3labs/sse/v2"
+)
+
+// Publishing only queues an event so we give the last one this long to go out before hanging up
+const drainGrace = 250 * time.Millisecond
 
 var (
 	Server         *sse.Server
@@ -29,3 +37,19 @@ func countSession(streamID string, sub *sse.Subscriber) {
 func sessionClosed(streamID string, sub *sse.Subscriber) {
 	ActiveSessions -= 1
 }
+
+// Drain tells everyone subscribed that we're going away and then disconnects them. Retry tells
+// browsers how long to hold off before reconnecting so the next instance has time to start.
+// The event is named so clients only listening for plain messages won't trip over it.
+func Drain(retry time.Duration) {
+	if Server == nil {
+		return
+	}
+	Server.Publish("playback", &sse.Event{
+		Event: []byte("shutdown"),
+		Data:  []byte(`{"reason":"shutdown"}`),
+		Retry: []byte(strconv.FormatInt(retry.Milliseconds(), 10)),
+	})
+	time.Sleep(drainGrace)
+	Server.Close()
+}
@@ -0,0 +1,208 @@
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
+	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/storage"
+)
+
+type Format string
+
+const (
+	CSV       Format = "csv"
+	JSONLines Format = "jsonl"
+	Bundle    Format = "zip"
+)
+
+// ParseFormat accepts a user provided format name, defaulting to CSV when none is given
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case "", CSV:
+		return CSV, nil
+	case JSONLines, "json":
+		return JSONLines, nil
+	case Bundle, "sqlite":
+		return Bundle, nil
+	}
+	return "", fmt.Errorf("unknown export format %q, expected one of csv, jsonl, zip", name)
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case JSONLines:
+		return "application/x-ndjson"
+	case Bundle:
+		return "application/zip"
+	}
+	return "text/csv"
+}
+
+func (f Format) Filename() string {
+	return fmt.Sprintf("gunslinger-%s.%s", time.Now().Format("2006-01-02"), f)
+}
+
+// Write streams every playback entry matching the filter to w in the requested format
+func Write(cfg config.Config, ps *playback.PlaybackSystem, format Format, filter playback.HistoryFilter, w io.Writer) error {
+	switch format {
+	case CSV:
+		return WriteCSV(ps, filter, w)
+	case JSONLines:
+		return WriteJSONLines(ps, filter, w)
+	case Bundle:
+		return WriteBundle(cfg, ps, filter, w)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+var csvHeader = []string{
+	"playback_id", "media_id", "title", "subtitle", "category", "source", "status",
+	"created_at", "updated_at", "state_changed_at", "elapsed_ms", "duration_ms", "image", "dominant_colours",
+	"blurhash",
+}
+
+func WriteCSV(ps *playback.PlaybackSystem, filter playback.HistoryFilter, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+	err := ps.EachHistoryEntry(filter, func(entry playback.FullPlaybackEntry) error {
+		return writer.Write([]string{
+			strconv.Itoa(entry.PlaybackID),
+			entry.ID,
+			entry.Title,
+			entry.Subtitle,
+			entry.Category,
+			entry.Source,
+			string(entry.Status),
+			entry.CreatedAt.Format(time.RFC3339),
+			entry.UpdatedAt.Format(time.RFC3339),
+			entry.StateChangedAt.Format(time.RFC3339),
+			strconv.Itoa(entry.Elapsed),
+			strconv.Itoa(entry.Duration),
+			entry.Image,
+			strings.Join(entry.DominantColours, " "),
+			entry.BlurHash,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func WriteJSONLines(ps *playback.PlaybackSystem, filter playback.HistoryFilter, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return ps.EachHistoryEntry(filter, func(entry playback.FullPlaybackEntry) error {
+		return encoder.Encode(entry)
+	})
+}
+
+// WriteBundle produces a zip containing a snapshot of the database, with credentials stripped
+// and anything outside the filter pruned, alongside every cover that the snapshot refers to
+func WriteBundle(cfg config.Config, ps *playback.PlaybackSystem, filter playback.HistoryFilter, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "gunslinger-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshotPath := filepath.Join(dir, "gunslinger.db")
+	if err := ps.Snapshot(snapshotPath, filter); err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	if err := addFile(archive, "gunslinger.db", snapshotPath); err != nil {
+		return err
+	}
+
+	// Plenty of items share artwork so each processed cover only goes in once
+	store := ps.CoverStorage(cfg)
+	digests := map[string]struct{}{}
+	err = ps.EachMediaItem(filter, func(item playback.MediaItem) error {
+		var keys []string
+		if digest, ok := covers.DigestFromURL(item.Image); ok {
+			if _, seen := digests[digest]; seen {
+				return nil
+			}
+			digests[digest] = struct{}{}
+			keys = covers.Keys(digest)
+		} else if strings.HasPrefix(item.Image, "/static/") {
+			// Legacy covers sit at the top level of storage
+			keys = append(keys, path.Base(item.Image))
+		}
+		for _, key := range keys {
+			content, err := store.Get(key)
+			if errors.Is(err, storage.ErrNotFound) {
+				// A missing cover shouldn't spoil the rest of the export
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			name := key
+			if !strings.HasPrefix(name, "covers/") {
+				name = "covers/" + name
+			}
+			if err := addBytes(archive, name, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func addBytes(archive *zip.Writer, name string, content []byte) error {
+	dest, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = dest.Write(content)
+	return err
+}
+
+func addFile(archive *zip.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	dest, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, file)
+	return err
+}
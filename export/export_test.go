@@ -0,0 +1,166 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+// seed records a couple of plays along with every kind of secret an export must leave behind
+func seed(t *testing.T) (config.Config, *playback.PlaybackSystem) {
+	db := testdb.Open(t)
+
+	var cfg config.Config
+	cfg.Gunslinger.StorageDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.Gunslinger.StorageDir, "legacy.jpeg"), []byte("a cover"), 0o644))
+
+	ps := playback.NewPlaybackSystem(db)
+	day := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	plays := []playback.HistoricalPlayback{
+		{MediaItem: playback.MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(playback.Track), Source: string(playback.LastFM), Duration: 180000, Image: "/static/legacy.jpeg"}, PlayedAt: day},
+		{MediaItem: playback.MediaItem{Title: "a movie", Subtitle: "1995", Category: string(playback.Movie), Source: string(playback.Plex), Duration: 5400000}, PlayedAt: day.AddDate(0, 0, 1)},
+	}
+	for _, play := range plays {
+		_, err := ps.BackfillPlayback(play)
+		require.NoError(t, err)
+	}
+
+	for _, statement := range []string{
+		`INSERT INTO tokens (id, value) VALUES ('spotify:accesstoken', 'spotify-secret')`,
+		`INSERT INTO api_keys (name, prefix, key_hash, scopes, created_at) VALUES ('widget', 'gs_abc', 'api-key-hash', 'admin', CURRENT_TIMESTAMP)`,
+		`INSERT INTO audit_log (occurred_at, actor, action, method, path, status, client_ip) VALUES (CURRENT_TIMESTAMP, 'legacy token', 'debug.view', 'GET', '/debug', 200, '203.0.113.7')`,
+		`INSERT INTO user_sources (user_id, source, identity, credential) VALUES (1, 'steam', '111', 'steam-secret')`,
+	} {
+		_, err := db.Exec(statement)
+		require.NoError(t, err)
+	}
+	return cfg, ps
+}
+
+func TestParseFormat(t *testing.T) {
+	tests := map[string]Format{
+		"":       CSV,
+		"csv":    CSV,
+		"CSV":    CSV,
+		"json":   JSONLines,
+		"jsonl":  JSONLines,
+		"zip":    Bundle,
+		"sqlite": Bundle,
+	}
+	for name, want := range tests {
+		got, err := ParseFormat(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+	_, err := ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestWrite_CSV(t *testing.T) {
+	cfg, ps := seed(t)
+
+	var out bytes.Buffer
+	require.NoError(t, Write(cfg, ps, CSV, playback.HistoryFilter{}, &out))
+	records, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, csvHeader, records[0])
+
+	titles := map[string][]string{}
+	for _, record := range records[1:] {
+		require.Len(t, record, len(csvHeader))
+		titles[record[2]] = record
+	}
+	song := titles["a good song"]
+	require.NotNil(t, song)
+	assert.Equal(t, "some artist", song[3])
+	assert.Equal(t, string(playback.Track), song[4])
+	assert.Equal(t, string(playback.LastFM), song[5])
+	assert.Equal(t, "180000", song[11])
+	assert.Contains(t, titles, "a movie")
+
+	// Filters narrow things down the same way they do for history
+	out.Reset()
+	require.NoError(t, Write(cfg, ps, CSV, playback.HistoryFilter{Source: string(playback.Plex)}, &out))
+	records, err = csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "a movie", records[1][2])
+}
+
+func TestWrite_JSONLines(t *testing.T) {
+	cfg, ps := seed(t)
+
+	var out bytes.Buffer
+	require.NoError(t, Write(cfg, ps, JSONLines, playback.HistoryFilter{}, &out))
+
+	var titles []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var entry playback.FullPlaybackEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		titles = append(titles, entry.Title)
+	}
+	require.NoError(t, scanner.Err())
+	assert.ElementsMatch(t, []string{"a good song", "a movie"}, titles)
+}
+
+func TestWrite_BundleHasNoSecrets(t *testing.T) {
+	cfg, ps := seed(t)
+
+	var out bytes.Buffer
+	require.NoError(t, Write(cfg, ps, Bundle, playback.HistoryFilter{}, &out))
+	archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	require.NoError(t, err)
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		require.NoError(t, err)
+		files[file.Name], err = io.ReadAll(reader)
+		require.NoError(t, err)
+		reader.Close()
+	}
+	assert.Equal(t, []byte("a cover"), files["covers/legacy.jpeg"])
+	snapshot := files["gunslinger.db"]
+	require.NotEmpty(t, snapshot)
+
+	// Nothing secret should survive anywhere in the file, not even in free pages
+	for _, secret := range []string{"spotify-secret", "api-key-hash", "steam-secret", "203.0.113.7"} {
+		assert.NotContains(t, string(snapshot), secret)
+	}
+
+	path := filepath.Join(t.TempDir(), "gunslinger.db")
+	require.NoError(t, os.WriteFile(path, snapshot, 0o600))
+	db, err := sqlx.Connect("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, table := range []string{"tokens", "tokenmetadata", "api_keys", "audit_log"} {
+		var rows int
+		require.NoError(t, db.Get(&rows, `SELECT COUNT(*) FROM `+table))
+		assert.Zero(t, rows, table)
+	}
+	var credentials []string
+	require.NoError(t, db.Select(&credentials, `SELECT credential FROM user_sources`))
+	assert.Equal(t, []string{""}, credentials)
+
+	var items int
+	require.NoError(t, db.Get(&items, `SELECT COUNT(*) FROM media_items`))
+	assert.Equal(t, 2, items)
+}
@@ -0,0 +1,206 @@
+package health
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	// A job that fails this many times in a row is failing, rather than having a bad moment
+	failureThreshold = 3
+	// A job is stale if it hasn't succeeded in this many of its intervals
+	staleIntervals = 3
+	// but we give quick jobs at least this long so a slow upstream doesn't flap us
+	minimumStaleAfter = 5 * time.Minute
+)
+
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusPending Status = "pending"
+	StatusFailing Status = "failing"
+	StatusStale   Status = "stale"
+)
+
+// Job is how a scheduled job has been getting on
+type Job struct {
+	Name                string     `json:"name"`
+	Interval            string     `json:"interval"`
+	Status              Status     `json:"status"`
+	LastRun             *time.Time `json:"last_run"`
+	LastSuccess         *time.Time `json:"last_success"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// Healthy is false once a job is failing or stale. Jobs that haven't finished a run yet get the
+// benefit of the doubt.
+func (j Job) Healthy() bool {
+	return j.Status == StatusOK || j.Status == StatusPending
+}
+
+type job struct {
+	interval            time.Duration
+	registered          time.Time
+	lastRun             time.Time
+	lastSuccess         time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	consecutiveFailures int
+}
+
+// Tracker keeps track of every scheduled job. It outlives any one scheduler so history isn't
+// lost when jobs are rescheduled on a config reload.
+type Tracker struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	now  func() time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{jobs: map[string]*job{}, now: time.Now}
+}
+
+// Register starts tracking a job, keeping whatever we already know if it was tracked before
+func (t *Tracker) Register(name string, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if existing, ok := t.jobs[name]; ok {
+		existing.interval = interval
+		return
+	}
+	t.jobs[name] = &job{interval: interval, registered: t.now()}
+}
+
+// Retain forgets any job not in names, for when a source is turned off or an account removed
+func (t *Tracker) Retain(names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.jobs {
+		if !slices.Contains(names, name) {
+			delete(t.jobs, name)
+		}
+	}
+}
+
+// Started records that a job has kicked off a run
+func (t *Tracker) Started(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if j, ok := t.jobs[name]; ok {
+		j.lastRun = t.now()
+	}
+}
+
+// Finished records how a run went
+func (t *Tracker) Finished(name string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[name]
+	if !ok {
+		return
+	}
+	if err == nil {
+		j.lastSuccess = t.now()
+		j.consecutiveFailures = 0
+		return
+	}
+	j.lastError = err.Error()
+	j.lastErrorAt = t.now()
+	j.consecutiveFailures++
+}
+
+// Jobs returns every tracked job sorted by name
+func (t *Tracker) Jobs() []Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	jobs := make([]Job, 0, len(t.jobs))
+	for name, j := range t.jobs {
+		jobs = append(jobs, Job{
+			Name:                name,
+			Interval:            j.interval.String(),
+			Status:              j.status(now),
+			LastRun:             timeOrNil(j.lastRun),
+			LastSuccess:         timeOrNil(j.lastSuccess),
+			LastError:           j.lastError,
+			LastErrorAt:         timeOrNil(j.lastErrorAt),
+			ConsecutiveFailures: j.consecutiveFailures,
+		})
+	}
+	slices.SortFunc(jobs, func(a, b Job) int { return strings.Compare(a.Name, b.Name) })
+	return jobs
+}
+
+// Unhealthy returns the jobs that are failing or stale
+func (t *Tracker) Unhealthy() []Job {
+	unhealthy := []Job{}
+	for _, j := range t.Jobs() {
+		if !j.Healthy() {
+			unhealthy = append(unhealthy, j)
+		}
+	}
+	return unhealthy
+}
+
+// Listeners hooks a gocron job up to the tracker, logging any errors along the way since the
+// jobs themselves just return them. If there's a gate, runs are skipped without a trace while
+// it returns an error.
+func (t *Tracker) Listeners(gate func() error) gocron.JobOption {
+	return gocron.WithEventListeners(
+		gocron.BeforeJobRunsSkipIfBeforeFuncErrors(func(_ uuid.UUID, name string) error {
+			if gate != nil {
+				if err := gate(); err != nil {
+					return err
+				}
+			}
+			t.Started(name)
+			return nil
+		}),
+		gocron.AfterJobRuns(func(_ uuid.UUID, name string) {
+			t.Finished(name, nil)
+		}),
+		gocron.AfterJobRunsWithError(func(_ uuid.UUID, name string, err error) {
+			slog.Error("Background job failed", slog.String("job", name), slog.String("error", err.Error()))
+			t.Finished(name, err)
+		}),
+		gocron.AfterJobRunsWithPanic(func(_ uuid.UUID, name string, recovered any) {
+			slog.Error("Background job panicked", slog.String("job", name), slog.Any("panic", recovered))
+			t.Finished(name, fmt.Errorf("panicked: %v", recovered))
+		}),
+	)
+}
+
+func (j *job) status(now time.Time) Status {
+	if j.consecutiveFailures >= failureThreshold {
+		return StatusFailing
+	}
+	staleAfter := max(j.interval*staleIntervals, minimumStaleAfter)
+	if j.lastSuccess.IsZero() {
+		// Anything that's been around long enough should have managed a run by now
+		if now.Sub(j.registered) > staleAfter {
+			return StatusStale
+		}
+		return StatusPending
+	}
+	if now.Sub(j.lastSuccess) > staleAfter {
+		return StatusStale
+	}
+	return StatusOK
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,100 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTracker() (*Tracker, *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := NewTracker()
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestTracker_RecordsRuns(t *testing.T) {
+	tracker, now := newTestTracker()
+	tracker.Register("steam (marcus)", 15*time.Second)
+
+	jobs := tracker.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, StatusPending, jobs[0].Status)
+	assert.Nil(t, jobs[0].LastRun)
+
+	tracker.Started("steam (marcus)")
+	tracker.Finished("steam (marcus)", nil)
+	*now = now.Add(time.Minute)
+	tracker.Started("steam (marcus)")
+	tracker.Finished("steam (marcus)", errors.New("steam is down"))
+
+	job := tracker.Jobs()[0]
+	assert.Equal(t, StatusOK, job.Status)
+	assert.Equal(t, *now, *job.LastRun)
+	assert.Equal(t, now.Add(-time.Minute), *job.LastSuccess)
+	assert.Equal(t, "steam is down", job.LastError)
+	assert.Equal(t, 1, job.ConsecutiveFailures)
+	assert.True(t, job.Healthy())
+}
+
+func TestTracker_FailingAfterRepeatedErrors(t *testing.T) {
+	tracker, _ := newTestTracker()
+	tracker.Register("plex", time.Second)
+
+	for range failureThreshold {
+		tracker.Finished("plex", errors.New("connection refused"))
+	}
+	assert.Equal(t, StatusFailing, tracker.Jobs()[0].Status)
+	assert.Len(t, tracker.Unhealthy(), 1)
+
+	// One good run is all it takes to recover
+	tracker.Finished("plex", nil)
+	assert.Equal(t, StatusOK, tracker.Jobs()[0].Status)
+	assert.Equal(t, 0, tracker.Jobs()[0].ConsecutiveFailures)
+	assert.Empty(t, tracker.Unhealthy())
+}
+
+func TestTracker_Stale(t *testing.T) {
+	tracker, now := newTestTracker()
+	tracker.Register("covers", 24*time.Hour)
+	tracker.Register("plex", time.Second)
+	tracker.Finished("plex", nil)
+
+	// Quick jobs get a few minutes of leeway before we worry
+	*now = now.Add(time.Minute)
+	assert.Empty(t, tracker.Unhealthy())
+
+	*now = now.Add(5 * time.Minute)
+	unhealthy := tracker.Unhealthy()
+	require.Len(t, unhealthy, 1)
+	assert.Equal(t, "plex", unhealthy[0].Name)
+	assert.Equal(t, StatusStale, unhealthy[0].Status)
+
+	// Having never succeeded, covers is stale once three runs should have happened
+	*now = now.Add(72 * time.Hour)
+	assert.Len(t, tracker.Unhealthy(), 2)
+}
+
+func TestTracker_RegisterKeepsHistory(t *testing.T) {
+	tracker, _ := newTestTracker()
+	tracker.Register("plex", time.Second)
+	tracker.Register("steam (marcus)", 15*time.Second)
+	tracker.Finished("plex", errors.New("oops"))
+
+	// Rescheduling after a reload registers everything again
+	tracker.Register("plex", 5*time.Second)
+	tracker.Retain([]string{"plex"})
+
+	jobs := tracker.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "plex", jobs[0].Name)
+	assert.Equal(t, "5s", jobs[0].Interval)
+	assert.Equal(t, 1, jobs[0].ConsecutiveFailures)
+
+	// Runs of jobs we no longer know about are ignored
+	tracker.Finished("steam (marcus)", nil)
+	assert.Len(t, tracker.Jobs(), 1)
+}
@@ -0,0 +1,156 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+type Format string
+
+const (
+	LastFMCSV    Format = "lastfm-csv"
+	LastFMJSON   Format = "lastfm-json"
+	Letterboxd   Format = "letterboxd"
+	ListenBrainz Format = "listenbrainz"
+	TraktHistory Format = "trakt"
+)
+
+var parsers = map[Format]func(r io.Reader) ([]record, error){
+	LastFMCSV:    parseLastFMCSV,
+	LastFMJSON:   parseLastFMJSON,
+	Letterboxd:   parseLetterboxd,
+	ListenBrainz: parseListenBrainz,
+	TraktHistory: parseTraktHistory,
+}
+
+// Movie and TV exports are a few hundred items at most and look pretty bare without
+// posters so we always go looking for artwork, unlike with scrobbles
+var coversByDefault = map[Format]bool{
+	Letterboxd:   true,
+	TraktHistory: true,
+}
+
+type Options struct {
+	// FetchCovers downloads artwork for any records that reference it. This is off by default
+	// for music as a few years of scrobbles can easily turn into thousands of image requests.
+	FetchCovers bool
+}
+
+// record is a single historical play parsed out of an export, along with a way
+// to find artwork for it if the export gives us enough to go on
+type record struct {
+	playback.HistoricalPlayback
+	Cover func(cfg config.Config) (string, error)
+	// Err is set when a row couldn't be parsed so it can be counted without losing the rest
+	Err error
+}
+
+func coverURL(url string) func(cfg config.Config) (string, error) {
+	if url == "" {
+		return nil
+	}
+	return func(cfg config.Config) (string, error) {
+		return url, nil
+	}
+}
+
+func Formats() []string {
+	var formats []string
+	for format := range parsers {
+		formats = append(formats, string(format))
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func ParseFormat(format string) (Format, error) {
+	f := Format(strings.ToLower(format))
+	if _, ok := parsers[f]; !ok {
+		return "", fmt.Errorf("unsupported import format %q, expected one of %s", format, strings.Join(Formats(), ", "))
+	}
+	return f, nil
+}
+
+// Import reads an export file in the given format and backfills every play inside of it
+func Import(cfg config.Config, ps *playback.PlaybackSystem, format Format, r io.Reader, opts Options) (playback.BackfillSummary, error) {
+	var summary playback.BackfillSummary
+
+	parse, ok := parsers[format]
+	if !ok {
+		return summary, fmt.Errorf("unsupported import format %q", format)
+	}
+
+	records, err := parse(r)
+	if err != nil {
+		return summary, fmt.Errorf("failed to parse %s export: %w", format, err)
+	}
+
+	fetchCovers := opts.FetchCovers || coversByDefault[format]
+
+	for _, rec := range records {
+		if rec.Err != nil {
+			slog.Warn("Skipping malformed entry", slog.String("format", string(format)), slog.String("error", rec.Err.Error()))
+			summary.Malformed += 1
+			continue
+		}
+		if fetchCovers && rec.Cover != nil {
+			resolveCover(cfg, ps, &rec)
+		}
+		outcome, err := ps.BackfillPlayback(rec.HistoricalPlayback)
+		if err != nil {
+			return summary, err
+		}
+		summary.Add(outcome)
+	}
+
+	slog.Info("Finished importing history",
+		slog.String("format", string(format)),
+		slog.Int("inserted", summary.Inserted),
+		slog.Int("skipped", summary.Skipped),
+		slog.Int("merged", summary.Merged),
+		slog.Int("malformed", summary.Malformed),
+	)
+
+	return summary, nil
+}
+
+func resolveCover(cfg config.Config, ps *playback.PlaybackSystem, rec *record) {
+	update := playback.Update{MediaItem: rec.MediaItem}
+	hash := playback.GenerateMediaID(&update)
+
+	// Looking up artwork can cost an API call so don't bother for things we already know about
+	if existing, err := ps.GetMediaItemByID(hash); err == nil {
+		rec.MediaItem.Image = existing.Image
+		rec.MediaItem.DominantColours = existing.DominantColours
+		rec.MediaItem.Palette = existing.Palette
+		rec.MediaItem.BlurHash = existing.BlurHash
+		return
+	}
+
+	imageUrl, err := rec.Cover(cfg)
+	if err != nil {
+		slog.Debug("Failed to find artwork for imported item",
+			slog.String("error", err.Error()),
+			slog.String("title", rec.MediaItem.Title),
+		)
+		return
+	}
+	if imageUrl == "" {
+		return
+	}
+	cover, err := ps.ResolveCover(cfg, hash, imageUrl)
+	if err != nil {
+		slog.Debug("Failed to resolve cover for imported item",
+			slog.String("error", err.Error()),
+			slog.String("title", rec.MediaItem.Title),
+		)
+		return
+	}
+	cover.ApplyTo(&rec.MediaItem)
+}
@@ -0,0 +1,181 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+func TestParseLastFMCSV(t *testing.T) {
+	headerless := "Radiohead,OK Computer,Airbag,01 Jun 2020 12:00\nBjörk,Homogenic,Jóga,\"02 Jun 2020, 08:30\"\n"
+	records, err := parseLastFMCSV(strings.NewReader(headerless))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "Airbag", records[0].MediaItem.Title)
+	assert.Equal(t, "Radiohead", records[0].MediaItem.Subtitle)
+	assert.Equal(t, string(playback.Track), records[0].MediaItem.Category)
+	assert.Equal(t, string(playback.LastFM), records[0].MediaItem.Source)
+	assert.True(t, records[0].PlayedAt.Equal(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(t, "Jóga", records[1].MediaItem.Title)
+
+	headed := "uts,utc_time,artist,artist_mbid,album,album_mbid,track,track_mbid\n1590969600,\"01 Jun 2020, 00:00\",Radiohead,,OK Computer,,Airbag,\n"
+	records, err = parseLastFMCSV(strings.NewReader(headed))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "Airbag", records[0].MediaItem.Title)
+	assert.Equal(t, int64(1590969600), records[0].PlayedAt.Unix())
+
+	records, err = parseLastFMCSV(strings.NewReader("Radiohead,OK Computer,Airbag,yesterday\n" + headerless))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.ErrorContains(t, records[0].Err, "row 1")
+	assert.NoError(t, records[1].Err)
+}
+
+func TestParseLastFMJSON(t *testing.T) {
+	export := `[{"track": [
+	  {"name": "Airbag", "artist": {"#text": "Radiohead"}, "@attr": {"nowplaying": "true"}},
+	  {"name": "Airbag", "artist": {"#text": "Radiohead"}, "date": {"uts": "1590969600"},
+	   "image": [{"size": "small", "#text": "https://lastfm.example/s.jpg"}, {"size": "extralarge", "#text": "https://lastfm.example/xl.jpg"}]}
+	]}]`
+	records, err := parseLastFMJSON(strings.NewReader(export))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "Radiohead", records[0].MediaItem.Subtitle)
+	cover, err := records[0].Cover(config.Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://lastfm.example/xl.jpg", cover)
+
+	single := `{"recenttracks": {"track": [{"name": "Jóga", "artist": {"#text": "Björk"}, "date": {"uts": "1590969600"}}]}}`
+	records, err = parseLastFMJSON(strings.NewReader(single))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "Jóga", records[0].MediaItem.Title)
+}
+
+func TestParseListenBrainz(t *testing.T) {
+	listen := `{"listened_at": 1590969600, "track_metadata": {"artist_name": "Radiohead", "track_name": "Airbag", "additional_info": {"duration_ms": 284000, "release_mbid": "abc"}}}`
+
+	for name, export := range map[string]string{
+		"array":      "[" + listen + "," + listen + "]",
+		"json lines": listen + "\n" + listen + "\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			records, err := parseListenBrainz(strings.NewReader(export))
+			require.NoError(t, err)
+			require.Len(t, records, 2)
+			assert.Equal(t, "Airbag", records[0].MediaItem.Title)
+			assert.Equal(t, "Radiohead", records[0].MediaItem.Subtitle)
+			assert.Equal(t, string(playback.ListenBrainz), records[0].MediaItem.Source)
+			assert.Equal(t, 284000, records[0].MediaItem.Duration)
+			assert.Equal(t, 284*time.Second, records[0].Elapsed)
+			cover, err := records[0].Cover(config.Config{})
+			assert.NoError(t, err)
+			assert.Equal(t, "https://coverartarchive.org/release/abc/front-500", cover)
+		})
+	}
+
+	records, err := parseListenBrainz(strings.NewReader(listen + "\n{\"listened_at\": 15909\n\n" + listen + "\n"))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.ErrorContains(t, records[1].Err, "line 2")
+	assert.NoError(t, records[2].Err)
+
+	records, err = parseListenBrainz(strings.NewReader("[" + `{"listened_at": "yesterday"},` + listen + "]"))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.ErrorContains(t, records[0].Err, "listen 1")
+	assert.NoError(t, records[1].Err)
+}
+
+func TestParseTraktHistory(t *testing.T) {
+	export := `[
+	  {"id": 1, "watched_at": "2020-06-01T14:00:00.000Z", "action": "watch", "type": "movie",
+	   "movie": {"title": "Heat", "year": 1995, "runtime": 170, "ids": {"tmdb": 949}}},
+	  {"id": 2, "watched_at": "2020-06-02T20:45:00.000Z", "action": "scrobble", "type": "episode",
+	   "episode": {"season": 1, "number": 3, "title": "Pilot", "runtime": 45},
+	   "show": {"title": "Some Show", "year": 2019, "ids": {"tmdb": 123}}}
+	]`
+	records, err := parseTraktHistory(strings.NewReader(export))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	assert.Equal(t, "Heat", records[0].MediaItem.Title)
+	assert.Equal(t, "1995", records[0].MediaItem.Subtitle)
+	assert.Equal(t, string(playback.Movie), records[0].MediaItem.Category)
+	assert.Equal(t, string(playback.Trakt), records[0].MediaItem.Source)
+	assert.Equal(t, 170*time.Minute, records[0].Elapsed)
+	assert.True(t, records[0].PlayedAt.Equal(time.Date(2020, 6, 1, 11, 10, 0, 0, time.UTC)))
+
+	assert.Equal(t, "01x03 Pilot", records[1].MediaItem.Title)
+	assert.Equal(t, "Some Show", records[1].MediaItem.Subtitle)
+	assert.Equal(t, string(playback.Episode), records[1].MediaItem.Category)
+
+	// Without a TMDB token, we don't go looking for artwork
+	cover, err := records[0].Cover(config.Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", cover)
+
+	records, err = parseTraktHistory(strings.NewReader(`[
+	  {"id": 3, "watched_at": "last tuesday", "action": "watch", "type": "movie", "movie": {"title": "Thief", "year": 1981}},
+	  {"id": 4, "watched_at": "2020-06-03T20:00:00.000Z", "action": "watch", "type": "movie", "movie": {"title": "Heat", "year": 1995}}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.ErrorContains(t, records[0].Err, "entry 1")
+	assert.NoError(t, records[1].Err)
+}
+
+func TestParseLetterboxd(t *testing.T) {
+	export := "Date,Name,Year,Letterboxd URI,Rating,Rewatch,Tags,Watched Date\n" +
+		"2020-06-03,Heat,1995,https://boxd.it/abc,4.5,,,2020-06-01\n" +
+		"2020-06-04,Thief,1981,https://boxd.it/def,4,Yes,,\n"
+	records, err := parseLetterboxd(strings.NewReader(export))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "Heat", records[0].MediaItem.Title)
+	assert.Equal(t, "1995", records[0].MediaItem.Subtitle)
+	assert.Equal(t, string(playback.Letterboxd), records[0].MediaItem.Source)
+	assert.True(t, records[0].PlayedAt.Equal(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)))
+	// Falls back to the logged date when no watched date is present
+	assert.True(t, records[1].PlayedAt.Equal(time.Date(2020, 6, 4, 0, 0, 0, 0, time.UTC)))
+
+	records, err = parseLetterboxd(strings.NewReader(export + "someday,Collateral,2004,https://boxd.it/ghi,4,,,\n"))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.ErrorContains(t, records[2].Err, "row 4")
+
+	_, err = parseLetterboxd(strings.NewReader("Date,Title\n2020-06-03,Heat\n"))
+	assert.Error(t, err)
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("LastFM-CSV")
+	assert.NoError(t, err)
+	assert.Equal(t, LastFMCSV, f)
+
+	_, err = ParseFormat("itunes")
+	assert.Error(t, err)
+}
+
+func TestImport_CountsMalformedRows(t *testing.T) {
+	db := testdb.Open(t)
+	ps := playback.NewPlaybackSystem(db)
+
+	export := "Radiohead,OK Computer,Airbag,01 Jun 2020 12:00\nRadiohead,OK Computer,Paranoid Android,yesterday\nBjörk,Homogenic,Jóga,\"02 Jun 2020, 08:30\"\n"
+	summary, err := Import(config.Config{}, ps, LastFMCSV, strings.NewReader(export), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, playback.BackfillSummary{Inserted: 2, Malformed: 1}, summary)
+
+	// The good rows are already there the second time around and the bad one is still bad
+	summary, err = Import(config.Config{}, ps, LastFMCSV, strings.NewReader(export), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, playback.BackfillSummary{Skipped: 2, Malformed: 1}, summary)
+}
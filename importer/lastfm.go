@@ -0,0 +1,191 @@
+package importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+// Last.fm has no official export so these are the layouts produced by the
+// popular third party exporters that we've had to deal with
+var lastfmTimeLayouts = []string{
+	"02 Jan 2006 15:04",
+	"02 Jan 2006, 15:04",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+}
+
+type lastfmPage struct {
+	Track []lastfmTrack `json:"track"`
+}
+
+type lastfmTrack struct {
+	Name   string        `json:"name"`
+	Artist lastfmText    `json:"artist"`
+	Image  []lastfmImage `json:"image"`
+	Date   *lastfmDate   `json:"date"`
+}
+
+type lastfmText struct {
+	Text string `json:"#text"`
+}
+
+type lastfmImage struct {
+	Size string `json:"size"`
+	Text string `json:"#text"`
+}
+
+type lastfmDate struct {
+	UTS string `json:"uts"`
+}
+
+// parseLastFMCSV handles both the headerless artist,album,track,date layout and
+// the headed layout that includes a unix timestamp column. Rows with a timestamp we
+// can't read are handed back with an error so Import can count them.
+func parseLastFMCSV(r io.Reader) ([]record, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{"artist": 0, "track": 2, "date": 3}
+	if header := lowerAll(rows[0]); slices.Contains(header, "artist") {
+		columns = map[string]int{}
+		for i, name := range header {
+			switch name {
+			case "name", "title", "track":
+				columns["track"] = i
+			case "uts", "timestamp":
+				columns["uts"] = i
+			case "utc_time", "date":
+				columns["date"] = i
+			case "artist":
+				columns["artist"] = i
+			}
+		}
+		rows = rows[1:]
+	}
+
+	var records []record
+	for line, row := range rows {
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		var playedAt time.Time
+		if uts := field("uts"); uts != "" {
+			playedAt, err = parseUnix(uts)
+		} else {
+			playedAt, err = parseTime(field("date"), lastfmTimeLayouts)
+		}
+		if err != nil {
+			// Exporters occasionally write out junk rows and one of those shouldn't cost us years of scrobbles
+			records = append(records, record{Err: fmt.Errorf("row %d: %w", line+1, err)})
+			continue
+		}
+
+		records = append(records, track(playback.LastFM, field("track"), field("artist"), playedAt, 0, ""))
+	}
+	return records, nil
+}
+
+// parseLastFMJSON accepts raw user.getRecentTracks responses, either a list of pages
+// as saved by most backup tools or a single recenttracks response
+func parseLastFMJSON(r io.Reader) ([]record, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []lastfmPage
+	if err := json.Unmarshal(body, &pages); err != nil {
+		var single struct {
+			RecentTracks lastfmPage `json:"recenttracks"`
+		}
+		if err := json.Unmarshal(body, &single); err != nil {
+			return nil, err
+		}
+		pages = []lastfmPage{single.RecentTracks}
+	}
+
+	var records []record
+	for _, page := range pages {
+		for _, t := range page.Track {
+			// The currently playing track has no date and will show up in a later export
+			if t.Date == nil {
+				continue
+			}
+			playedAt, err := parseUnix(t.Date.UTS)
+			if err != nil {
+				return nil, err
+			}
+			var cover string
+			for _, image := range t.Image {
+				if image.Size == "extralarge" {
+					cover = image.Text
+				}
+			}
+			records = append(records, track(playback.LastFM, t.Name, t.Artist.Text, playedAt, 0, cover))
+		}
+	}
+	return records, nil
+}
+
+func track(source playback.Source, title, artist string, playedAt time.Time, duration time.Duration, cover string) record {
+	return record{
+		HistoricalPlayback: playback.HistoricalPlayback{
+			MediaItem: playback.MediaItem{
+				Title:    title,
+				Subtitle: artist,
+				Category: string(playback.Track),
+				Duration: int(duration.Milliseconds()),
+				Source:   string(source),
+			},
+			PlayedAt: playedAt,
+			Elapsed:  duration,
+		},
+		Cover: coverURL(cover),
+	}
+}
+
+func parseUnix(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unix timestamp %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+func parseTime(value string, layouts []string) (time.Time, error) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", value)
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(strings.TrimSpace(v))
+	}
+	return lowered
+}
@@ -0,0 +1,89 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/trakt"
+)
+
+// parseLetterboxd reads diary.csv from a Letterboxd data export. The diary only has
+// a date for each watch so everything is recorded as being watched at midnight UTC, which
+// BackfillPlayback knows to match against the same film from anywhere else that day.
+func parseLetterboxd(r io.Reader) ([]record, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range lowerAll(rows[0]) {
+		columns[name] = i
+	}
+	for _, required := range []string{"name", "year"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %q column, is this a diary.csv export?", required)
+		}
+	}
+
+	var records []record
+	for line, row := range rows[1:] {
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		// Watched Date is when the film was actually seen while Date is when it was logged
+		watched := field("watched date")
+		if watched == "" {
+			watched = field("date")
+		}
+		watchedAt, err := time.Parse("2006-01-02", watched)
+		if err != nil {
+			records = append(records, record{Err: fmt.Errorf("row %d: invalid date %q", line+2, watched)})
+			continue
+		}
+
+		title := field("name")
+		year, _ := strconv.Atoi(field("year"))
+
+		rec := record{Cover: letterboxdCover(title, year)}
+		rec.MediaItem = playback.MediaItem{
+			Title:    title,
+			Subtitle: field("year"),
+			Category: string(playback.Movie),
+			Source:   string(playback.Letterboxd),
+		}
+		rec.PlayedAt = watchedAt
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func letterboxdCover(title string, year int) func(cfg config.Config) (string, error) {
+	return func(cfg config.Config) (string, error) {
+		if cfg.Trakt.TMDBToken == "" {
+			return "", nil
+		}
+		tmdbID, err := trakt.SearchMovieOnTMDB(cfg.Trakt.TMDBToken, title, year)
+		if err != nil {
+			return "", err
+		}
+		return trakt.GetMovieArtFromTMDB(cfg.Trakt.TMDBToken, tmdbID)
+	}
+}
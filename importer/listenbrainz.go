@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+const (
+	coverArtArchiveEndpoint = "https://coverartarchive.org/release/%s/front-500"
+)
+
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                     `json:"artist_name"`
+	TrackName      string                     `json:"track_name"`
+	AdditionalInfo listenBrainzAdditionalInfo `json:"additional_info"`
+	MBIDMapping    *listenBrainzMBIDMapping   `json:"mbid_mapping"`
+}
+
+type listenBrainzAdditionalInfo struct {
+	DurationMs  int    `json:"duration_ms"`
+	Duration    int    `json:"duration"` // seconds, older submissions only send this
+	ReleaseMBID string `json:"release_mbid"`
+}
+
+type listenBrainzMBIDMapping struct {
+	ReleaseMBID string `json:"release_mbid"`
+}
+
+// parseListenBrainz reads the listens from a ListenBrainz user export. Older exports are
+// a single JSON array while newer ones are JSON lines so we sniff the first byte to decide.
+func parseListenBrainz(r io.Reader) ([]record, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == ' ' || b[0] == '\n' || b[0] == '\r' || b[0] == '\t' {
+			br.ReadByte()
+			continue
+		}
+		if b[0] == '[' {
+			return parseListenBrainzArray(br)
+		}
+		return parseListenBrainzLines(br)
+	}
+}
+
+func parseListenBrainzArray(r io.Reader) ([]record, error) {
+	dec := json.NewDecoder(r)
+	// Consume the opening bracket so we can stream through the array
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var records []record
+	for i := 1; dec.More(); i++ {
+		var listen listenBrainzListen
+		if err := dec.Decode(&listen); err != nil {
+			// A value of the wrong type still gets read past but there's no finding our way
+			// back into the array after broken JSON
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("listen %d: %w", i, err)
+			}
+			records = append(records, record{Err: fmt.Errorf("listen %d: %w", i, err)})
+			continue
+		}
+		if rec, ok := listenBrainzRecord(listen); ok {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// parseListenBrainzLines goes line by line so that one mangled listen doesn't stop us
+// from reading the rest of the file
+func parseListenBrainzLines(r io.Reader) ([]record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var records []record
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var listen listenBrainzListen
+		if err := json.Unmarshal(scanner.Bytes(), &listen); err != nil {
+			records = append(records, record{Err: fmt.Errorf("line %d: %w", line, err)})
+			continue
+		}
+		if rec, ok := listenBrainzRecord(listen); ok {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func listenBrainzRecord(listen listenBrainzListen) (record, bool) {
+	if listen.ListenedAt == 0 {
+		return record{}, false
+	}
+
+	meta := listen.TrackMetadata
+	duration := time.Duration(meta.AdditionalInfo.DurationMs) * time.Millisecond
+	if duration == 0 {
+		duration = time.Duration(meta.AdditionalInfo.Duration) * time.Second
+	}
+
+	releaseMBID := meta.AdditionalInfo.ReleaseMBID
+	if releaseMBID == "" && meta.MBIDMapping != nil {
+		releaseMBID = meta.MBIDMapping.ReleaseMBID
+	}
+	var cover string
+	if releaseMBID != "" {
+		cover = fmt.Sprintf(coverArtArchiveEndpoint, releaseMBID)
+	}
+
+	return track(playback.ListenBrainz, meta.TrackName, meta.ArtistName, time.Unix(listen.ListenedAt, 0), duration, cover), true
+}
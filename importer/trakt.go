@@ -0,0 +1,61 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/trakt"
+)
+
+// traktHistoryItem is a single entry from /users/{id}/history which is also
+// what the Trakt data export produces as watched-history.json
+type traktHistoryItem struct {
+	trakt.NowPlayingResponse
+	WatchedAt string `json:"watched_at"`
+}
+
+func parseTraktHistory(r io.Reader) ([]record, error) {
+	var history []traktHistoryItem
+	if err := json.NewDecoder(r).Decode(&history); err != nil {
+		return nil, err
+	}
+
+	var records []record
+	for i, item := range history {
+		if item.Type != "movie" && item.Type != "episode" {
+			continue
+		}
+		watchedAt, err := time.Parse(time.RFC3339, item.WatchedAt)
+		if err != nil {
+			records = append(records, record{Err: fmt.Errorf("entry %d: invalid watched_at %q: %w", i+1, item.WatchedAt, err)})
+			continue
+		}
+
+		runtime := item.Movie.Runtime
+		if item.Type == "episode" {
+			runtime = item.Episode.Runtime
+		}
+		duration := time.Duration(runtime) * time.Minute
+
+		rec := record{Cover: traktCover(item.NowPlayingResponse)}
+		rec.MediaItem = item.MediaItem()
+		rec.MediaItem.Duration = int(duration.Milliseconds())
+		// Trakt records when something was marked as watched, which is usually once it finished
+		rec.PlayedAt = watchedAt.Add(-duration)
+		rec.Elapsed = duration
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func traktCover(item trakt.NowPlayingResponse) func(cfg config.Config) (string, error) {
+	return func(cfg config.Config) (string, error) {
+		if cfg.Trakt.TMDBToken == "" {
+			return "", nil
+		}
+		return trakt.GetArtFromTMDB(cfg.Trakt.TMDBToken, item)
+	}
+}
@@ -0,0 +1,31 @@
+// Package testdb hands tests a freshly migrated database to play with
+package testdb
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/marcus-crane/gunslinger/migrations"
+)
+
+// Open returns an in-memory database with every migration applied which is closed for us
+// once the test is done
+func Open(t testing.TB) *sqlx.DB {
+	t.Helper()
+
+	db, err := sqlx.Connect("sqlite", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// Every connection to :memory: gets its own database so we stick to just the one
+	db.SetMaxOpenConns(1)
+
+	goose.SetBaseFS(migrations.GetMigrations())
+	require.NoError(t, goose.SetDialect("sqlite3"))
+	require.NoError(t, goose.Up(db.DB, "."))
+	return db
+}
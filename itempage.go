@@ -0,0 +1,77 @@
+package main
+
+import (
+	"html/template"
+	"time"
+)
+
+// itemPageTmpl renders a single media item so there's something nice to link to from feeds
+var itemPageTmpl = template.Must(template.New("item").Funcs(template.FuncMap{
+	"duration": func(ms int) string {
+		return (time.Duration(ms) * time.Millisecond).Round(time.Second).String()
+	},
+	"date": func(t time.Time) string {
+		return t.Format("2 Jan 2006 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}{{if .Subtitle}} · {{.Subtitle}}{{end}}</title>
+<meta property="og:title" content="{{.Title}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">{{end}}
+<style>
+  body { font-family: monospace; max-width: 900px; margin: 2rem auto; padding: 0 1rem; }
+  h1 { font-size: 1.4rem; margin-bottom: 0; }
+  h2 { font-size: 1.1rem; margin-top: 2rem; }
+  .header { display: flex; gap: 1.5rem; align-items: flex-start; }
+  .header img { width: 200px; border-radius: 4px; }
+  table { border-collapse: collapse; width: 100%; }
+  th, td { text-align: left; padding: 0.4rem 0.8rem; border: 1px solid #ccc; }
+  th { background: #f4f4f4; }
+  .dim { color: #999; }
+</style>
+</head>
+<body>
+<div class="header">
+  {{if .Image}}<img src="{{.Image}}" alt="Cover art for {{.Title}}"{{if .Palette.Background}} style="background: {{.Palette.Background}}"{{else if .DominantColours}} style="background: {{index .DominantColours 0}}"{{end}}>{{end}}
+  <div>
+    <h1>{{.Title}}</h1>
+    <p>{{.Subtitle}}</p>
+    <p class="dim">{{.Category}} via {{.Source}}</p>
+    <ul>
+      <li>Played {{.PlayCount}} time{{if ne .PlayCount 1}}s{{end}}, finished {{.CompletionCount}}</li>
+      <li>Total time spent: {{duration .TotalElapsed}}</li>
+      {{if .FirstPlayedAt}}<li>First played: {{date .FirstPlayedAt}}</li>{{end}}
+      {{if .LastPlayedAt}}<li>Last played: {{date .LastPlayedAt}}</li>{{end}}
+    </ul>
+  </div>
+</div>
+
+<h2>Plays</h2>
+{{if .Plays}}
+<table>
+  <thead>
+    <tr>
+      <th>Started</th>
+      <th>Elapsed</th>
+      <th>Status</th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .Plays}}
+    <tr>
+      <td>{{date .CreatedAt}}</td>
+      <td>{{duration .Elapsed}}</td>
+      <td>{{if .IsActive}}{{.Status}} now{{else if .Completed}}finished{{else}}{{.Status}}{{end}}</td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+{{else}}
+<p class="dim">Never played</p>
+{{end}}
+</body>
+</html>
+`))
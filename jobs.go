@@ -1,65 +1,162 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/marcus-crane/gunslinger/anilist"
+	"github.com/marcus-crane/gunslinger/audit"
 	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/health"
 	"github.com/marcus-crane/gunslinger/playback"
 	"github.com/marcus-crane/gunslinger/plex"
+	"github.com/marcus-crane/gunslinger/poll"
 	"github.com/marcus-crane/gunslinger/retroachievements"
-	"github.com/marcus-crane/gunslinger/spotify"
 	"github.com/marcus-crane/gunslinger/steam"
 	"github.com/marcus-crane/gunslinger/trakt"
+	"github.com/marcus-crane/gunslinger/users"
 )
 
-func SetupInBackground(cfg config.Config, ps *playback.PlaybackSystem, store db.Store) (gocron.Scheduler, error) {
-	s, err := gocron.NewScheduler(gocron.WithLocation(time.UTC))
+// SetupInBackground schedules polling for every source except Spotify, which is long running
+// and looked after separately, see Reloader. Each job reports how it went to the tracker.
+func SetupInBackground(cfg config.Config, ps *playback.PlaybackSystem, store db.Store, userStore *users.Store, auditLog *audit.Log, tracker *health.Tracker) (gocron.Scheduler, error) {
+	// Jobs only get a moment to finish up when we're stopped so that shutting down fits inside
+	// fly's kill_timeout. Anything still going is abandoned.
+	s, err := gocron.NewScheduler(gocron.WithLocation(time.UTC), gocron.WithStopTimeout(2*time.Second))
 	if err != nil {
 		return nil, err
 	}
 
+	// Accounts are read once here so anyone added later is picked up on the next reload
+	accounts := map[string][]users.Account{}
+	for _, source := range users.Sources {
+		if accounts[source], err = userStore.Accounts(cfg, source); err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{}
+	// schedule runs a job every interval, or on those ticks the gate allows if there is one
+	schedule := func(name string, every time.Duration, gate func() error, task gocron.Task, options ...gocron.JobOption) error {
+		tracker.Register(name, every)
+		names = append(names, name)
+		_, err := s.NewJob(gocron.DurationJob(every), task, append(options, gocron.WithName(name), tracker.Listeners(gate))...)
+		return err
+	}
+
 	client := http.Client{Timeout: 10 * time.Second}
+	// polled schedules a source that backs off while failing, waits out any rate limits and, if it
+	// can tell, slows down while nothing is playing. Only requests made with the client it's
+	// handed count towards rate limits.
+	polled := func(name string, every time.Duration, playing func() bool, run func(client http.Client) error, options ...gocron.JobOption) error {
+		p := poll.New(name, every, playing)
+		polledClient := p.Client(client)
+		task := gocron.NewTask(func() error { return p.Done(run(polledClient)) })
+		return schedule(name, every, p.Due, task, options...)
+	}
+	playing := func(source playback.Source, userID int64) func() bool {
+		return func() bool { return ps.IsPlaying(string(source), userID) }
+	}
 
-	go spotify.SetupSpotifyPoller(cfg, ps, store)
+	sources := cfg.Sources
+	var errs []error
 
-	s.NewJob(
-		gocron.DurationJob(time.Minute),
-		gocron.NewTask(retroachievements.GetCurrentlyPlaying, cfg, ps, client),
-	)
+	if sources.RetroAchievements.IsEnabled() {
+		errs = append(errs, polled("retroachievements",
+			sources.RetroAchievements.Every(time.Minute),
+			playing(playback.RetroAchievements, 0),
+			func(client http.Client) error { return retroachievements.GetCurrentlyPlaying(cfg, ps, client) },
+		))
+	}
 
-	s.NewJob(
-		gocron.DurationJob(time.Second),
-		gocron.NewTask(plex.GetCurrentlyPlaying, cfg, ps, client),
-		gocron.WithSingletonMode(gocron.LimitModeReschedule),
-	)
+	if sources.Plex.IsEnabled() {
+		// One request to the server covers everyone watching on it
+		errs = append(errs, polled("plex",
+			sources.Plex.Every(time.Second),
+			playing(playback.Plex, 0),
+			func(client http.Client) error { return plex.GetCurrentlyPlaying(cfg, ps, client, accounts[users.Plex]) },
+			gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		))
 
-	s.NewJob(
-		gocron.DurationJob(time.Second*15),
-		gocron.NewTask(anilist.GetRecentlyReadManga, cfg, ps, client), // Rate limit: 90 req/sec
-	)
+		for _, account := range accounts[users.Plex] {
+			// Catches anything watched while we weren't around to see the live session
+			errs = append(errs, schedule(jobName("plex backfill", account),
+				sources.Plex.BackfillEvery(time.Hour),
+				nil,
+				gocron.NewTask(plex.BackfillRecentHistory, cfg, ps, client, account),
+				gocron.WithSingletonMode(gocron.LimitModeReschedule),
+			))
+		}
+	}
 
-	s.NewJob(
-		gocron.DurationJob(time.Second*15),
-		gocron.NewTask(steam.GetCurrentlyPlaying, cfg, ps, client),
-	)
+	if sources.Anilist.IsEnabled() {
+		for _, account := range accounts[users.Anilist] {
+			// Reading is only ever recorded after the fact so there's no playing to speed up for.
+			// AniList allows 90 requests a minute and tells us when we get close.
+			errs = append(errs, polled(jobName("anilist", account),
+				sources.Anilist.Every(time.Second*15),
+				nil,
+				func(client http.Client) error { return anilist.GetRecentlyReadManga(cfg, ps, client, account) },
+			))
+		}
+	}
 
-	s.NewJob(
-		gocron.DurationJob(time.Second*15),
-		gocron.NewTask(trakt.GetCurrentlyPlaying, cfg, ps, client, store),
-		gocron.WithSingletonMode(gocron.LimitModeReschedule), // Make sure we block while waiting for a token on startup instead of closing the server with a new job
-	)
+	if sources.Steam.IsEnabled() {
+		for _, account := range accounts[users.Steam] {
+			errs = append(errs, polled(jobName("steam", account),
+				sources.Steam.Every(time.Second*15),
+				playing(playback.Steam, account.UserID),
+				func(client http.Client) error { return steam.GetCurrentlyPlaying(cfg, ps, client, account) },
+			))
+		}
+	}
 
-	s.NewJob(
-		gocron.DurationJob(time.Hour*6),
-		gocron.NewTask(trakt.CheckForTokenRefresh, cfg, store),
-	)
+	if sources.Trakt.IsEnabled() {
+		for _, account := range accounts[users.Trakt] {
+			errs = append(errs, polled(jobName("trakt", account),
+				sources.Trakt.Every(time.Second*15),
+				playing(playback.Trakt, account.UserID),
+				func(client http.Client) error { return trakt.GetCurrentlyPlaying(cfg, ps, client, store, account) },
+				gocron.WithSingletonMode(gocron.LimitModeReschedule), // Make sure we block while waiting for a token on startup instead of closing the server with a new job
+			))
+		}
+
+		errs = append(errs, schedule("trakt token refresh",
+			time.Hour*6,
+			nil,
+			gocron.NewTask(trakt.CheckForTokenRefresh, cfg, store),
+		))
+	}
+
+	errs = append(errs, schedule("covers",
+		time.Hour*24,
+		nil,
+		gocron.NewTask(ps.CheckCovers, cfg),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+	))
+
+	errs = append(errs, schedule("audit retention",
+		time.Hour*24,
+		nil,
+		gocron.NewTask(func() error { return auditLog.Prune(time.Now().Add(-audit.Retention)) }),
+	))
+
+	if err := errors.Join(errs...); err != nil {
+		s.Shutdown()
+		return nil, err
+	}
+	tracker.Retain(names)
 
 	// If we're redeployed, we'll populate the latest state
 	ps.RefreshCurrentPlayback()
 
 	return s, nil
 }
+
+// jobName tells apart the jobs for each person polling the same source
+func jobName(source string, account users.Account) string {
+	return source + " (" + account.UserName + ")"
+}
@@ -0,0 +1,140 @@
+package lease
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Lease is a lock kept in the database so that only one instance sharing it does a job at a
+// time. It has to be renewed before it expires, otherwise anyone else can take it over, so an
+// instance that dies without letting go only holds things up for a little while.
+type Lease struct {
+	db     *sqlx.DB
+	name   string
+	holder string
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	held    bool
+	expires time.Time
+}
+
+func New(db *sqlx.DB, name, holder string, ttl time.Duration) *Lease {
+	return &Lease{db: db, name: name, holder: holder, ttl: ttl, now: time.Now}
+}
+
+// Holder makes up a name for this instance that's readable in the database but still unique
+// across restarts ie; gunslinger-1234-9f86d081
+func Holder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Held reports whether we had the lease last we checked
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// TryAcquire takes the lease if it's free or expired, or renews it if it's already ours
+func (l *Lease) TryAcquire(ctx context.Context) (bool, error) {
+	now := l.now()
+	expires := now.Add(l.ttl)
+	result, err := l.db.ExecContext(ctx, `
+	  INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+	  ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+	  WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		l.name, l.holder, expires.UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = affected > 0
+	if l.held {
+		l.expires = expires
+	}
+	return l.held, nil
+}
+
+// Vacant reports whether nobody holds the lease right now
+func (l *Lease) Vacant(ctx context.Context) (bool, error) {
+	var holders int
+	err := l.db.GetContext(ctx, &holders, `SELECT COUNT(*) FROM leases WHERE name = ? AND expires_at >= ?`, l.name, l.now().UnixMilli())
+	return holders == 0, err
+}
+
+// Release gives up the lease, if it's ours, so someone else can take over straight away
+func (l *Lease) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = false
+	_, err := l.db.ExecContext(ctx, `DELETE FROM leases WHERE name = ? AND holder = ?`, l.name, l.holder)
+	return err
+}
+
+// Run tries for the lease for as long as ctx lasts, renewing it well before it expires. We only
+// try while want says we should, otherwise we let it go. onChange hears about every time we
+// gain or lose the lease, starting with the first attempt.
+func (l *Lease) Run(ctx context.Context, want func() bool, onChange func(held bool)) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		was := l.Held()
+		held := l.check(ctx, want)
+		if held != was {
+			slog.Info("Lease changed hands", slog.String("lease", l.name), slog.String("holder", l.holder), slog.Bool("held", held))
+		}
+		if held != was || first {
+			onChange(held)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Lease) check(ctx context.Context, want func() bool) bool {
+	if !want() {
+		if l.Held() {
+			if err := l.Release(ctx); err != nil {
+				slog.Error("Failed to release lease", slog.String("lease", l.name), slog.String("error", err.Error()))
+			}
+		}
+		return false
+	}
+	held, err := l.TryAcquire(ctx)
+	if err == nil {
+		return held
+	}
+	// A busy database shouldn't cost us the lease while what we have is still good
+	slog.Error("Failed to renew lease", slog.String("lease", l.name), slog.String("error", err.Error()))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = l.held && l.now().Before(l.expires)
+	return l.held
+}
@@ -0,0 +1,160 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+)
+
+// newTestLeases gives two instances contending for the same lease on a clock we control
+func newTestLeases(t *testing.T) (*Lease, *Lease, *time.Time) {
+	db := testdb.Open(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	a := New(db, "jobs", "a", 30*time.Second)
+	b := New(db, "jobs", "b", 30*time.Second)
+	a.now, b.now = clock, clock
+	return a, b, &now
+}
+
+func TestLease_OnlyOneHolder(t *testing.T) {
+	a, b, now := newTestLeases(t)
+	ctx := context.Background()
+
+	held, err := a.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, held)
+	held, err = b.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.False(t, held)
+
+	// Renewing keeps it ours well past the original expiry
+	for range 5 {
+		*now = now.Add(20 * time.Second)
+		held, err = a.TryAcquire(ctx)
+		require.NoError(t, err)
+		assert.True(t, held)
+		held, err = b.TryAcquire(ctx)
+		require.NoError(t, err)
+		assert.False(t, held)
+	}
+}
+
+func TestLease_TakenOverOnceExpired(t *testing.T) {
+	a, b, now := newTestLeases(t)
+	ctx := context.Background()
+
+	_, err := a.TryAcquire(ctx)
+	require.NoError(t, err)
+
+	*now = now.Add(30 * time.Second)
+	held, err := b.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.False(t, held, "the lease is still good right up until it expires")
+
+	*now = now.Add(time.Millisecond)
+	held, err = b.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	// The old holder finds out next time it tries to renew
+	held, err = a.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.False(t, held)
+	assert.False(t, a.Held())
+}
+
+func TestLease_ReleaseAndVacant(t *testing.T) {
+	a, b, now := newTestLeases(t)
+	ctx := context.Background()
+
+	vacant, err := a.Vacant(ctx)
+	require.NoError(t, err)
+	assert.True(t, vacant)
+
+	_, err = a.TryAcquire(ctx)
+	require.NoError(t, err)
+	vacant, err = b.Vacant(ctx)
+	require.NoError(t, err)
+	assert.False(t, vacant)
+
+	// Releasing someone else's lease does nothing
+	require.NoError(t, b.Release(ctx))
+	vacant, err = b.Vacant(ctx)
+	require.NoError(t, err)
+	assert.False(t, vacant)
+
+	require.NoError(t, a.Release(ctx))
+	assert.False(t, a.Held())
+	vacant, err = b.Vacant(ctx)
+	require.NoError(t, err)
+	assert.True(t, vacant)
+	held, err := b.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, held)
+
+	// An expired lease counts as vacant even if it's still sitting there
+	*now = now.Add(time.Minute)
+	vacant, err = a.Vacant(ctx)
+	require.NoError(t, err)
+	assert.True(t, vacant)
+}
+
+func TestLease_CheckLetsGoWhenUnwanted(t *testing.T) {
+	a, b, _ := newTestLeases(t)
+	ctx := context.Background()
+	want := true
+
+	assert.True(t, a.check(ctx, func() bool { return want }))
+	want = false
+	assert.False(t, a.check(ctx, func() bool { return want }))
+
+	held, err := b.TryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, held)
+}
+
+func TestLease_CheckKeepsLeaseThroughErrors(t *testing.T) {
+	a, _, now := newTestLeases(t)
+	ctx := context.Background()
+	always := func() bool { return true }
+
+	require.True(t, a.check(ctx, always))
+	require.NoError(t, a.db.Close())
+
+	// We can't renew but what we have hasn't expired yet
+	*now = now.Add(20 * time.Second)
+	assert.True(t, a.check(ctx, always))
+	*now = now.Add(20 * time.Second)
+	assert.False(t, a.check(ctx, always))
+}
+
+func TestLease_RunReportsChanges(t *testing.T) {
+	a, b, _ := newTestLeases(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := b.TryAcquire(ctx)
+	require.NoError(t, err)
+
+	changes := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx, func() bool { return true }, func(held bool) { changes <- held })
+	}()
+
+	select {
+	case held := <-changes:
+		assert.False(t, held, "we hear about the first check even though nothing changed")
+	case <-time.After(time.Second):
+		require.Fail(t, "never heard about the first check")
+	}
+	cancel()
+	<-done
+}
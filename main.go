@@ -1,25 +1,113 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	glc "github.com/golobby/config/v3"
 	"github.com/golobby/config/v3/pkg/feeder"
 	"github.com/jmoiron/sqlx"
 	"github.com/pressly/goose/v3"
 
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/auth"
 	"github.com/marcus-crane/gunslinger/config"
 	gdb "github.com/marcus-crane/gunslinger/db"
 	"github.com/marcus-crane/gunslinger/events"
+	"github.com/marcus-crane/gunslinger/lease"
 	"github.com/marcus-crane/gunslinger/migrations"
 	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/storage"
+	"github.com/marcus-crane/gunslinger/users"
 )
 
 func main() {
+	cfg := loadConfig()
+
+	logLevel := cfg.GetLogLevel()
+	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(h))
+	slog.With(slog.String("log_level", logLevel.Level().String())).Debug("Initialised logger")
+
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "serve":
+		serve(cfg)
+	case "migrate":
+		runMigrate(cfg, os.Args[2:])
+	case "import":
+		runImport(cfg, os.Args[2:])
+	case "backfill":
+		runBackfill(cfg, os.Args[2:])
+	case "export":
+		runExport(cfg, os.Args[2:])
+	case "migrate-covers":
+		runMigrateCovers(cfg, os.Args[2:])
+	case "keys":
+		runKeys(cfg, os.Args[2:])
+	case "users":
+		runUsers(cfg, os.Args[2:])
+	case "reauth":
+		runReauth(cfg, os.Args[2:])
+	case "tokens":
+		runTokens(cfg, os.Args[2:])
+	case "doctor":
+		runDoctor(cfg, os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+const usage = `Usage: gunslinger <command> [arguments]
+
+Commands:
+  serve           run the server, which is what happens without a command
+  migrate         apply, roll back or check on database migrations
+  import          backfill history from an export file
+  export          write out history as CSV, JSON lines or a zip bundle
+  backfill        pull watch history from an upstream source
+  migrate-covers  move covers between storage backends
+  keys            manage API keys
+  users           manage who is followed
+  reauth          sign in with Spotify or Trakt again
+  tokens          see which OAuth tokens are stored and when they expire
+  doctor          check that everything is set up properly
+`
+
+func loadConfig() config.Config {
+	cfg, err := readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%s\n", err)
+		os.Exit(1)
+	}
+	return cfg
+}
+
+// readConfig layers the environment over the config file. It's also used for reloading so it
+// hands back errors rather than exiting. Reloading only picks up changes to the file and .env as
+// the process environment is fixed once we've started.
+func readConfig() (config.Config, error) {
 	cfg := config.Config{}
 
+	// The config file is optional and sits underneath the environment, so anything set there wins
+	if path := config.FindFile(); path != "" {
+		if err := config.LoadFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
 	envFeeder := feeder.Env{}
 	feeders := []glc.Feeder{envFeeder}
 
@@ -35,14 +123,28 @@ func main() {
 		Feed()
 
 	if err != nil {
-		panic(err)
+		return cfg, err
 	}
 
-	logLevel := cfg.GetLogLevel()
-	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
-	slog.SetDefault(slog.New(h))
-	slog.With(slog.String("log_level", logLevel.Level().String())).Debug("Initialised logger")
+	return cfg, cfg.Validate()
+}
+
+// openDatabase connects to our database and makes sure it's fully migrated
+// before anything else gets a chance to touch it
+func openDatabase(cfg config.Config) *sqlx.DB {
+	db := connectDatabase(cfg)
+
+	if err := goose.Up(db.DB, "."); err != nil {
+		slog.Error("Failed to create connection to DB", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	return db
+}
 
+// connectDatabase connects without migrating, which is only really useful for looking after
+// migrations themselves
+func connectDatabase(cfg config.Config) *sqlx.DB {
 	db, err := sqlx.Connect("sqlite", cfg.Gunslinger.DbPath)
 	if err != nil {
 		slog.Error("Failed to create connection to DB", slog.String("error", err.Error()))
@@ -57,9 +159,6 @@ func main() {
 	db.Exec("PRAGMA journal_size_limit = 27103364")
 	db.Exec("PRAGMA cache_size = 2000")
 
-	ps := playback.NewPlaybackSystem(db)
-	store := gdb.SqliteStore{DB: db}
-
 	goose.SetBaseFS(migrations.GetMigrations())
 
 	if err := goose.SetDialect(string(goose.DialectSQLite3)); err != nil {
@@ -67,33 +166,114 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := goose.Up(db.DB, "."); err != nil {
-		slog.Error("Failed to create connection to DB", slog.String("error", err.Error()))
+	return db
+}
+
+// newPlaybackSystem sets up playback along with wherever covers have been configured to live
+func newPlaybackSystem(cfg config.Config, db *sqlx.DB) *playback.PlaybackSystem {
+	ps := playback.NewPlaybackSystem(db)
+	coverStorage, err := storage.New(cfg)
+	if err != nil {
+		slog.Error("Failed to set up cover storage", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	ps.SetCoverStorage(coverStorage)
+	rules, err := playback.NewSourceRules(cfg.Sources)
+	if err != nil {
+		slog.Error("Invalid source rules", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+	ps.SetSourceRules(rules)
+	return ps
+}
 
-	jobScheduler, err := SetupInBackground(cfg, ps, &store)
+// newStore sets up token storage, encrypting any tokens that aren't yet sealed with our current key
+func newStore(cfg config.Config, db *sqlx.DB) gdb.SqliteStore {
+	keyring, err := gdb.ParseKeyring(cfg.Gunslinger.TokenKeys)
+	if err != nil {
+		slog.Error("Failed to load token encryption keys", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	store := gdb.SqliteStore{DB: db, Keyring: keyring}
+	if keyring == nil {
+		slog.Warn("No token encryption keys are configured so OAuth tokens are stored as plaintext")
+		return store
+	}
+	rewritten, err := store.EncryptTokens()
 	if err != nil {
-		slog.Error("Failed to start up scheduler", slog.String("error", err.Error()))
+		slog.Error("Failed to encrypt stored tokens", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+	if rewritten > 0 {
+		slog.Info("Encrypted stored tokens with the current key", slog.Int("count", rewritten))
+	}
+	return store
+}
 
-	if cfg.Gunslinger.BackgroundJobsEnabled {
-		jobScheduler.Start()
-		slog.Debug("Background jobs have started up in the background.")
-	} else {
-		slog.Debug("Background jobs are disabled.")
+// newUserStore shares the token keys so that per-user credentials are sealed the same way
+func newUserStore(db *sqlx.DB, keyring *gdb.Keyring) *users.Store {
+	userStore := users.NewStore(db, keyring)
+	rewritten, err := userStore.EncryptCredentials()
+	if err != nil {
+		slog.Error("Failed to encrypt stored user credentials", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if rewritten > 0 {
+		slog.Info("Encrypted stored user credentials with the current key", slog.Int("count", rewritten))
 	}
+	return userStore
+}
+
+func serve(cfg config.Config) {
+	db := openDatabase(cfg)
+
+	ps := newPlaybackSystem(cfg, db)
+	store := newStore(cfg, db)
+	userStore := newUserStore(db, store.Keyring)
 
 	events.Init()
 
-	router := RegisterRoutes(http.NewServeMux(), cfg, ps, &store)
+	leader := lease.New(db, "background-jobs", lease.Holder(), leaseTTL)
+	reloader := NewReloader(cfg, ps, &store, auth.NewStore(db), audit.NewLog(db), userStore, leader)
+	if err := reloader.Start(); err != nil {
+		slog.Error("Failed to start up", slog.String("error", err.Error()))
+		_ = reloader.Stop(context.Background())
+		os.Exit(1)
+	}
+	reloader.ReloadOnSignal()
+
+	// fly sends SIGINT (see kill_signal) but SIGTERM is what most everything else uses
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	// Only one instance sharing the database polls, the rest take over if it goes quiet
+	leading := make(chan struct{})
+	go func() {
+		defer close(leading)
+		leader.Run(ctx, reloader.WantsLead, reloader.SetLeader)
+	}()
+
+	server := &http.Server{Addr: ":8080", Handler: reloader}
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
 	slog.Info("Gunslinger is running at http://localhost:8080")
 
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	select {
+	case err := <-served:
 		slog.Error("Failed while serving", slog.String("error", err.Error()))
-		_ = jobScheduler.Shutdown()
+		_ = reloader.Stop(context.Background())
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	// Another signal from here on kills us straight away
+	stop()
+	<-leading
+
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdown(shutdownCtx, server, reloader, leader, ps, db); err != nil {
+		slog.Error("Failed to shut down cleanly", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 }
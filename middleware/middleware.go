@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/apierror"
+	"github.com/marcus-crane/gunslinger/auth"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h so that requests pass through each middleware in the order given
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// RequestID tags every request with an ID, reusing one from a proxy in front of us if it's sane
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(apierror.RequestIDHeader)
+		if id == "" || len(id) > 64 || strings.ContainsFunc(id, func(c rune) bool { return c < '!' || c > '~' }) {
+			id = newRequestID()
+		}
+		w.Header().Set(apierror.RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Logger records each request once it's done. Successful ones are only of interest when
+// debugging as clients poll us constantly.
+func Logger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelDebug
+		switch {
+		case recorder.Status() >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case recorder.Status() >= http.StatusBadRequest:
+			level = slog.LevelInfo
+		}
+		slog.Log(r.Context(), level, "Handled request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.Status()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("request_id", w.Header().Get(apierror.RequestIDHeader)),
+		)
+	})
+}
+
+// Recover stops a panicking handler from taking the whole server down with it
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &StatusRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			slog.Error("Recovered from panic while handling request",
+				slog.String("path", r.URL.Path),
+				slog.Any("panic", recovered),
+				slog.String("stack", string(debug.Stack())),
+			)
+			// If the handler got as far as responding there's nothing sensible left to send
+			if !recorder.wroteHeader {
+				apierror.Write(w, r, apierror.Internal("Something went wrong handling your request", fmt.Errorf("panic: %v", recovered)))
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Methods turns away anything other than the given methods. HEAD is allowed wherever GET is.
+func Methods(methods ...string) Middleware {
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Browsers checking CORS are dealt with before we ever see them
+			if !slices.Contains(methods, r.Method) {
+				w.Header().Set("Allow", allow)
+				apierror.Write(w, r, apierror.MethodNotAllowed())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope only lets through requests with credentials for scope, making whoever they
+// belong to available further down via auth.PrincipalFrom
+func RequireScope(authorizer *auth.Authorizer, scope auth.Scope) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authorizer.Authorize(r, scope)
+			switch {
+			case err == nil:
+				next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+			case errors.Is(err, auth.ErrInsufficientScope):
+				apierror.Write(w, r, apierror.Forbidden(fmt.Sprintf("Your API key needs the %s scope to use this endpoint", scope)))
+			case errors.Is(err, auth.ErrMissingCredentials), errors.Is(err, auth.ErrInvalidKey):
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gunslinger"`)
+				apierror.Write(w, r, apierror.Unauthorized("Your request was not authorized"))
+			default:
+				apierror.Write(w, r, apierror.Internal("Something went wrong trying to authorize your request", err))
+			}
+		})
+	}
+}
+
+// RequireWritable turns away requests that write to the database unless writable says we're the
+// instance allowed to, leaving everyone else to serve reads
+func RequireWritable(writable func() bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !writable() {
+				w.Header().Set("Retry-After", "10")
+				apierror.Write(w, r, apierror.Unavailable("This instance is read only at the moment, try again shortly"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StatusRecorder remembers the status code so it can be logged, or audited, once the handler is done
+type StatusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *StatusRecorder) Status() int {
+	if !s.wroteHeader {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// Flush is needed for the event stream which checks for it directly
+func (s *StatusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
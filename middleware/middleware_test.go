@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/apierror"
+)
+
+type envelope struct {
+	Error struct {
+		Status    int    `json:"status"`
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	} `json:"error"`
+}
+
+func serve(t *testing.T, h http.Handler, r *http.Request) (*httptest.ResponseRecorder, envelope) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var body envelope
+	if w.Header().Get("Content-Type") == "application/json" {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	}
+	return w, body
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), tag("first"), tag("second"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestErrorsAreEnveloped(t *testing.T) {
+	h := Chain(apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("ETag", `"v1"`)
+		return apierror.NotFound("No item exists with that ID")
+	}), RequestID, Logger, Recover, Methods(http.MethodGet))
+
+	w, body := serve(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+	assert.Equal(t, "not_found", body.Error.Code)
+	assert.Equal(t, "No item exists with that ID", body.Error.Message)
+	assert.NotEmpty(t, body.Error.RequestID)
+	assert.Equal(t, body.Error.RequestID, w.Header().Get(apierror.RequestIDHeader))
+
+	// HEAD comes along with GET for free but nothing else does
+	w, _ = serve(t, h, httptest.NewRequest(http.MethodHead, "/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, body = serve(t, h, httptest.NewRequest(http.MethodDelete, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+	assert.Equal(t, "method_not_allowed", body.Error.Code)
+
+	// Proxies in front of us can hand over their own request ID
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(apierror.RequestIDHeader, "from-the-proxy")
+	_, body = serve(t, h, r)
+	assert.Equal(t, "from-the-proxy", body.Error.RequestID)
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oh no")
+	}), RequestID, Logger, Recover)
+
+	w, body := serve(t, h, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "internal_error", body.Error.Code)
+	assert.NotContains(t, body.Error.Message, "oh no")
+}
+
+func TestRequireWritable(t *testing.T) {
+	writable := false
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), RequireWritable(func() bool { return writable }))
+
+	w, body := serve(t, h, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "unavailable", body.Error.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	writable = true
+	w, _ = serve(t, h, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
@@ -0,0 +1,44 @@
+-- +goose Up
+-- +goose StatementBegin
+-- media_items is keyed by a text ID so its rowids aren't stable across a VACUUM. Rather than
+-- pointing FTS at them as external content, we keep our own copy of the text keyed by ID.
+CREATE VIRTUAL TABLE media_search USING fts5(
+    id UNINDEXED,
+    title,
+    subtitle,
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER media_search_insert AFTER INSERT ON media_items BEGIN
+    INSERT INTO media_search (id, title, subtitle) VALUES (new.id, new.title, new.subtitle);
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER media_search_update AFTER UPDATE OF id, title, subtitle ON media_items BEGIN
+    DELETE FROM media_search WHERE id = old.id;
+    INSERT INTO media_search (id, title, subtitle) VALUES (new.id, new.title, new.subtitle);
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER media_search_delete AFTER DELETE ON media_items BEGIN
+    DELETE FROM media_search WHERE id = old.id;
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+INSERT INTO media_search (id, title, subtitle) SELECT id, title, subtitle FROM media_items;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER media_search_delete;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER media_search_update;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER media_search_insert;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE media_search;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Where each cover originally came from so it can be fetched again if it goes missing
+CREATE TABLE cover_sources (
+    media_id TEXT PRIMARY KEY,
+    url TEXT NOT NULL,
+    digest TEXT NOT NULL,
+    fetched_at DATETIME NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE cover_sources;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE media_items ADD COLUMN palette TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE media_items ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE media_items DROP COLUMN blurhash;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE media_items DROP COLUMN palette;
+-- +goose StatementEnd
@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+-- Everything recorded before there were users belongs to whoever was running the instance
+INSERT INTO users (id, name) VALUES (1, 'owner');
+
+-- Each user's identity on a source ie; their Steam ID, along with their own credentials where
+-- the source needs them. Credentials are encrypted the same way OAuth tokens are.
+CREATE TABLE user_sources (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    source TEXT NOT NULL,
+    identity TEXT NOT NULL,
+    credential TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (user_id, source)
+);
+
+-- SQLite won't add a column with a foreign key and a default so the link to users is by convention
+ALTER TABLE playback_entries ADD COLUMN user_id INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX playback_entries_user_active ON playback_entries (user_id, is_active);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX playback_entries_user_active;
+ALTER TABLE playback_entries DROP COLUMN user_id;
+DROP TABLE user_sources;
+DROP TABLE users;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Whoever holds a lease is the only one allowed to do its job ie; poll sources, until it
+-- expires. Times are unix milliseconds so that they can be compared without any parsing.
+CREATE TABLE leases (
+    name TEXT PRIMARY KEY,
+    holder TEXT NOT NULL,
+    expires_at INTEGER NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE leases;
+-- +goose StatementEnd
@@ -0,0 +1,60 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A single row counting changes to anything that shows up in what's playing or the history.
+-- It's kept up to date by triggers so that writes from any process, like another instance or
+-- an import run from the command line, are noticed by everyone sharing the database. Starting
+-- from the current time means a fresh database never hands out a version that a client has
+-- seen from an old one.
+CREATE TABLE playback_version (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    version INTEGER NOT NULL
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+INSERT INTO playback_version (id, version) VALUES (1, CAST(strftime('%s', 'now') AS INTEGER) * 1000);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER playback_version_entry_insert AFTER INSERT ON playback_entries BEGIN
+    UPDATE playback_version SET version = version + 1;
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER playback_version_entry_update AFTER UPDATE ON playback_entries BEGIN
+    UPDATE playback_version SET version = version + 1;
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER playback_version_entry_delete AFTER DELETE ON playback_entries BEGIN
+    UPDATE playback_version SET version = version + 1;
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER playback_version_item_update AFTER UPDATE ON media_items BEGIN
+    UPDATE playback_version SET version = version + 1;
+END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER playback_version_item_delete AFTER DELETE ON media_items BEGIN
+    UPDATE playback_version SET version = version + 1;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER playback_version_item_delete;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER playback_version_item_update;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER playback_version_entry_delete;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER playback_version_entry_update;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER playback_version_entry_insert;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE playback_version;
+-- +goose StatementEnd
@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -33,6 +34,43 @@ func (s *SerializableColours) Scan(src interface{}) error {
 	return nil
 }
 
+// Palette holds named swatches pulled out of a cover along with a foreground colour that stays
+// readable when drawn on top of the background colour. Stored in the database as JSON.
+type Palette struct {
+	Vibrant    string `json:"vibrant"`
+	Muted      string `json:"muted"`
+	Dark       string `json:"dark"`
+	Light      string `json:"light"`
+	Background string `json:"background"`
+	Foreground string `json:"foreground"`
+}
+
+func (p Palette) Value() (driver.Value, error) {
+	if p == (Palette{}) {
+		return "", nil
+	}
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+func (p *Palette) Scan(src interface{}) error {
+	var raw []byte
+	switch v := src.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	case nil:
+	default:
+		return errors.New("incompatible type for Palette")
+	}
+	*p = Palette{}
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, p)
+}
+
 type ResponseMediaItem struct {
 	OccuredAt       string              `json:"occurred_at"`
 	Title           string              `json:"title"`
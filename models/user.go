@@ -0,0 +1,5 @@
+package models
+
+// OwnerUserID is the user created alongside the users table. Anything recorded before there
+// were users belongs to them, as does anything a source can't attribute to someone else.
+const OwnerUserID int64 = 1
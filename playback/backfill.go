@@ -0,0 +1,164 @@
+package playback
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+// How far either side of a historical play we look for an existing entry of the same media
+// before treating it as a new play. Scrobblers and live pollers rarely agree on an exact
+// timestamp (one records the start, another the end) so this is padded by the item duration.
+const backfillMergeSlack = 5 * time.Minute
+
+// Some sources only know which day something was watched on, so their plays are recorded at
+// midnight UTC and matched against plays from elsewhere on that day, whatever the timezone.
+var dateOnlySources = []string{string(Letterboxd)}
+
+const (
+	// Midnight UTC is up to 14 hours after a day starts (UTC+14)
+	dayStartsBefore = 14 * time.Hour
+	// and up to 36 hours before it ends (UTC-12)
+	dayEndsAfter = 36 * time.Hour
+)
+
+// HistoricalPlayback describes a play that happened in the past such as a scrobble from an
+// export file or a session pulled from an upstream history endpoint. Unlike an Update, it never
+// touches live state and is always recorded as a completed, inactive PlaybackEntry.
+type HistoricalPlayback struct {
+	MediaItem MediaItem
+	PlayedAt  time.Time
+	Elapsed   time.Duration
+	UserID    int64 // the owner when not set
+}
+
+type BackfillOutcome int
+
+const (
+	// BackfillInserted means a new PlaybackEntry was created
+	BackfillInserted BackfillOutcome = iota
+	// BackfillSkipped means this exact play has already been recorded ie; a file imported twice
+	BackfillSkipped
+	// BackfillMerged means the same media was already recorded around the same time, usually by
+	// another source, so we treat it as the same play rather than doubling up
+	BackfillMerged
+)
+
+// BackfillSummary tallies the outcomes of a batch of historical plays so importers can
+// report back what they actually did
+type BackfillSummary struct {
+	Inserted int `json:"inserted"`
+	Skipped  int `json:"skipped"`
+	Merged   int `json:"merged"`
+	// Malformed counts entries in an export that we couldn't make sense of
+	Malformed int `json:"malformed"`
+}
+
+func (s *BackfillSummary) Add(outcome BackfillOutcome) {
+	switch outcome {
+	case BackfillInserted:
+		s.Inserted += 1
+	case BackfillSkipped:
+		s.Skipped += 1
+	case BackfillMerged:
+		s.Merged += 1
+	}
+}
+
+// BackfillPlayback records a historical play. It is idempotent so callers are free to feed in
+// the same history more than once and only plays we haven't seen before will be inserted.
+func (ps *PlaybackSystem) BackfillPlayback(h HistoricalPlayback) (BackfillOutcome, error) {
+	update := Update{MediaItem: h.MediaItem}
+	h.MediaItem.ID = GenerateMediaID(&update)
+	if h.UserID == 0 {
+		h.UserID = models.OwnerUserID
+	}
+
+	if !ps.rule(h.MediaItem.Source).Allows(h.MediaItem) {
+		return BackfillSkipped, nil
+	}
+
+	if h.PlayedAt.IsZero() {
+		return BackfillSkipped, fmt.Errorf("historical playback for %s has no timestamp", h.MediaItem.ID)
+	}
+
+	// We store timestamps the same way live updates do so that they sort alongside each other
+	playedAt := h.PlayedAt.Local()
+	finishedAt := playedAt.Add(h.Elapsed)
+
+	tx, err := ps.db.Beginx()
+	if err != nil {
+		return BackfillSkipped, err
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.Get(&count, `
+	  SELECT COUNT(*) FROM playback_entries
+	  WHERE media_id = ? AND user_id = ? AND created_at BETWEEN ? AND ?`,
+		h.MediaItem.ID, h.UserID, playedAt.Add(-time.Second), playedAt.Add(time.Second))
+	if err != nil {
+		return BackfillSkipped, err
+	}
+	if count > 0 {
+		return BackfillSkipped, nil
+	}
+
+	window := time.Duration(h.MediaItem.Duration)*time.Millisecond + backfillMergeSlack
+	// Plays from date only sources sit at midnight UTC on their day so when only one side of a
+	// match is date only, we look across the whole of that day in any timezone
+	dateOnlyFrom, dateOnlyTo := playedAt.Add(-window), playedAt.Add(window)
+	otherFrom, otherTo := dateOnlyFrom, dateOnlyTo
+	if slices.Contains(dateOnlySources, h.MediaItem.Source) {
+		otherFrom, otherTo = playedAt.Add(-dayStartsBefore-window), playedAt.Add(dayEndsAfter+window)
+	} else {
+		dateOnlyFrom, dateOnlyTo = playedAt.Add(-dayEndsAfter-window), playedAt.Add(dayStartsBefore+window)
+	}
+	args := []any{strings.ToLower(h.MediaItem.Title), strings.ToLower(h.MediaItem.Subtitle), h.MediaItem.Category, h.UserID}
+	for _, source := range dateOnlySources {
+		args = append(args, source)
+	}
+	args = append(args, dateOnlyFrom, dateOnlyTo, otherFrom, otherTo)
+	err = tx.Get(&count, `
+	  SELECT COUNT(*)
+	  FROM playback_entries p
+	  JOIN media_items m ON m.id = p.media_id
+	  WHERE lower(m.title) = ? AND lower(m.subtitle) = ? AND m.category = ? AND p.user_id = ?
+	  AND CASE WHEN p.source IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(dateOnlySources)), ", ")+`)
+	    THEN p.created_at BETWEEN ? AND ?
+	    ELSE p.created_at BETWEEN ? AND ?
+	  END`, args...)
+	if err != nil {
+		return BackfillSkipped, err
+	}
+	if count > 0 {
+		return BackfillMerged, nil
+	}
+
+	_, err = tx.NamedExec(`
+	  INSERT INTO media_items
+	  (id, title, subtitle, category, duration, source, image, dominant_colours, palette, blurhash)
+	  VALUES (:id, :title, :subtitle, :category, :duration, :source, :image, :dominant_colours, :palette, :blurhash)
+	  ON CONFLICT (id) DO NOTHING`,
+		h.MediaItem)
+	if err != nil {
+		return BackfillSkipped, fmt.Errorf("failed to insert historical item: %+v", err)
+	}
+
+	_, err = tx.Exec(`
+	  INSERT INTO playback_entries
+	  (media_id, category, created_at, elapsed, status, is_active, updated_at, state_changed_at, source, user_id)
+	  VALUES (?, ?, ?, ?, ?, FALSE, ?, ?, ?, ?)`,
+		h.MediaItem.ID, h.MediaItem.Category, playedAt, int(h.Elapsed.Milliseconds()), StatusStopped, finishedAt, finishedAt, h.MediaItem.Source, h.UserID)
+	if err != nil {
+		return BackfillSkipped, fmt.Errorf("failed to insert historical playback entry: %+v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return BackfillSkipped, err
+	}
+	return BackfillInserted, nil
+}
@@ -0,0 +1,139 @@
+package playback
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryFilter narrows down which playback entries are returned when reading back history.
+// Zero values are ignored so an empty filter matches everything.
+type HistoryFilter struct {
+	From     time.Time // inclusive, compared against when playback started
+	To       time.Time // exclusive
+	Source   string
+	Category string
+	Status   Status
+	Query    string // case insensitive match against title and subtitle
+	UserID   int64  // only ever set by us, never from a query parameter
+}
+
+// ParseHistoryFilter builds a filter from query parameters ie; ?from=2024-01-01&to=2024-01-31&source=plex
+// Dates may be plain days or full RFC3339 timestamps. A plain day for "to" includes that whole day.
+func ParseHistoryFilter(q url.Values) (HistoryFilter, error) {
+	filter := HistoryFilter{
+		Source:   q.Get("source"),
+		Category: q.Get("category"),
+		Status:   Status(q.Get("status")),
+		Query:    strings.TrimSpace(q.Get("q")),
+	}
+	switch filter.Status {
+	case "", StatusPlaying, StatusPaused, StatusStopped:
+	default:
+		return filter, fmt.Errorf("invalid status %q, expected playing, paused or stopped", filter.Status)
+	}
+	if from := q.Get("from"); from != "" {
+		t, _, err := parseFilterTime(from)
+		if err != nil {
+			return filter, err
+		}
+		filter.From = t
+	}
+	if to := q.Get("to"); to != "" {
+		t, dateOnly, err := parseFilterTime(to)
+		if err != nil {
+			return filter, err
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		filter.To = t
+	}
+	return filter, nil
+}
+
+func parseFilterTime(value string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Local(), false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC3339", value)
+}
+
+func (f HistoryFilter) IsEmpty() bool {
+	return f == HistoryFilter{}
+}
+
+// where renders the filter as SQL conditions against media_items m and playback_entries p
+func (f HistoryFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "p.created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "p.created_at < ?")
+		args = append(args, f.To)
+	}
+	if f.Source != "" {
+		conditions = append(conditions, "m.source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Category != "" {
+		conditions = append(conditions, "m.category = ?")
+		args = append(args, f.Category)
+	}
+	if f.Status != "" {
+		conditions = append(conditions, "p.status = ?")
+		args = append(args, f.Status)
+	}
+	if f.UserID != 0 {
+		conditions = append(conditions, "p.user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.Query != "" {
+		// Escape LIKE wildcards so a search for "100%" means exactly that
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Query) + "%"
+		conditions = append(conditions, `(m.title LIKE ? ESCAPE '\' OR m.subtitle LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// HistoryCursor marks where a page of history left off. Entries are ordered by when their
+// state last changed with the playback ID breaking ties so the position is always stable.
+type HistoryCursor struct {
+	StateChangedAt time.Time
+	PlaybackID     int
+}
+
+func (c HistoryCursor) String() string {
+	raw := fmt.Sprintf("%d:%d", c.StateChangedAt.UnixNano(), c.PlaybackID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseHistoryCursor(value string) (HistoryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return HistoryCursor{}, fmt.Errorf("invalid cursor")
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return HistoryCursor{}, fmt.Errorf("invalid cursor")
+	}
+	ns, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return HistoryCursor{}, fmt.Errorf("invalid cursor")
+	}
+	playbackID, err := strconv.Atoi(id)
+	if err != nil {
+		return HistoryCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return HistoryCursor{StateChangedAt: time.Unix(0, ns).Local(), PlaybackID: playbackID}, nil
+}
@@ -0,0 +1,154 @@
+package playback
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// QueryHistory returns a page of finished playback entries matching the filter, most recent first.
+// Pass the returned cursor back in to fetch the next page. It's nil once there is nothing left.
+func (ps *PlaybackSystem) QueryHistory(filter HistoryFilter, after *HistoryCursor, limit int) ([]FullPlaybackEntry, *HistoryCursor, error) {
+	var results []FullPlaybackEntry
+
+	if limit <= 0 {
+		return results, nil, fmt.Errorf("must request at least one historical item")
+	}
+
+	where, args := filter.where()
+	if after != nil {
+		where += " AND (p.state_changed_at < ? OR (p.state_changed_at = ? AND p.id < ?))"
+		args = append(args, after.StateChangedAt, after.StateChangedAt, after.PlaybackID)
+	}
+	// We grab one extra row to find out whether there's another page without a separate count
+	args = append(args, limit+1)
+
+	err := ps.db.Select(&results, `
+	  SELECT
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at, p.user_id
+	  FROM media_items m
+	  JOIN playback_entries p ON m.id = p.media_id
+	  WHERE p.is_active = FALSE AND `+where+`
+	  ORDER BY p.state_changed_at DESC, p.id DESC
+	  LIMIT ?
+	`, args...)
+	if err != nil || len(results) <= limit {
+		return results, nil, err
+	}
+
+	results = results[:limit]
+	last := results[len(results)-1]
+	return results, &HistoryCursor{StateChangedAt: last.StateChangedAt, PlaybackID: last.PlaybackID}, nil
+}
+
+// EachHistoryEntry streams every playback entry matching the filter, oldest first, so that
+// exports of the full history don't need to hold everything in memory at once
+func (ps *PlaybackSystem) EachHistoryEntry(filter HistoryFilter, fn func(FullPlaybackEntry) error) error {
+	where, args := filter.where()
+	rows, err := ps.db.Queryx(`
+	  SELECT
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at, p.user_id
+	  FROM media_items m
+	  JOIN playback_entries p ON m.id = p.media_id
+	  WHERE `+where+`
+	  ORDER BY p.created_at ASC, p.id ASC
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry FullPlaybackEntry
+		if err := rows.StructScan(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EachMediaItem streams every media item that has at least one playback entry matching the filter
+func (ps *PlaybackSystem) EachMediaItem(filter HistoryFilter, fn func(MediaItem) error) error {
+	where, args := filter.where()
+	rows, err := ps.db.Queryx(`
+	  SELECT m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash
+	  FROM media_items m
+	  WHERE EXISTS (
+	    SELECT 1 FROM playback_entries p WHERE p.media_id = m.id AND `+where+`
+	  )
+	  ORDER BY m.id
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item MediaItem
+		if err := rows.StructScan(&item); err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Snapshot writes a consistent copy of the database to path. Credentials and the audit log are stripped out
+// and, if a filter is given, anything it doesn't match is pruned from the copy. Filtering by user also drops
+// everyone else's accounts.
+func (ps *PlaybackSystem) Snapshot(path string, filter HistoryFilter) error {
+	if _, err := ps.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+
+	snapshot, err := sqlx.Open(ps.db.DriverName(), path)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	// Only a single connection so we're always talking to the same file
+	snapshot.SetMaxOpenConns(1)
+
+	for _, table := range []string{"tokens", "tokenmetadata", "api_keys", "audit_log"} {
+		if _, err := snapshot.Exec(`DELETE FROM ` + table); err != nil {
+			return fmt.Errorf("failed to strip %s from snapshot: %w", table, err)
+		}
+	}
+	// Identities can stay but each user's own credentials, like a Steam API key, can't
+	if _, err := snapshot.Exec(`UPDATE user_sources SET credential = ''`); err != nil {
+		return fmt.Errorf("failed to strip user credentials from snapshot: %w", err)
+	}
+	if filter.UserID != 0 {
+		if _, err := snapshot.Exec(`DELETE FROM user_sources WHERE user_id != ?`, filter.UserID); err != nil {
+			return fmt.Errorf("failed to prune other users from snapshot: %w", err)
+		}
+		if _, err := snapshot.Exec(`DELETE FROM users WHERE id != ?`, filter.UserID); err != nil {
+			return fmt.Errorf("failed to prune other users from snapshot: %w", err)
+		}
+	}
+
+	if !filter.IsEmpty() {
+		where, args := filter.where()
+		if _, err := snapshot.Exec(`
+		  DELETE FROM playback_entries WHERE id NOT IN (
+		    SELECT p.id FROM playback_entries p JOIN media_items m ON m.id = p.media_id WHERE `+where+`
+		  )`, args...); err != nil {
+			return fmt.Errorf("failed to prune snapshot: %w", err)
+		}
+		if _, err := snapshot.Exec(`DELETE FROM media_items WHERE id NOT IN (SELECT media_id FROM playback_entries)`); err != nil {
+			return fmt.Errorf("failed to prune snapshot: %w", err)
+		}
+	}
+
+	// Reclaim the space from anything we pruned so nothing deleted lingers in free pages
+	_, err = snapshot.Exec(`VACUUM`)
+	return err
+}
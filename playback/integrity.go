@@ -0,0 +1,311 @@
+package playback
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
+	"github.com/marcus-crane/gunslinger/storage"
+	"github.com/marcus-crane/gunslinger/utils"
+)
+
+// secretCoverParams are query parameters that carry credentials. They're stripped before a
+// cover URL is stored and added back from config when it needs fetching again.
+var secretCoverParams = []string{"X-Plex-Token"}
+
+// orphanGracePeriod keeps anything written recently out of the orphan sweep, in case it belongs
+// to something that's still on its way into the database
+const orphanGracePeriod = time.Hour
+
+type CoverSource struct {
+	MediaID   string    `db:"media_id"`
+	URL       string    `db:"url"`
+	Digest    string    `db:"digest"`
+	FetchedAt time.Time `db:"fetched_at"`
+}
+
+type CoverProblem struct {
+	MediaID string
+	Title   string
+	Problem string
+}
+
+// CoverReport summarises a run of the cover integrity check for the debug page
+type CoverReport struct {
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	Checked        int
+	Missing        int
+	Corrupt        int
+	Refetched      int
+	Analysed       int
+	OrphansRemoved int
+	Unrecoverable  []CoverProblem
+	Error          string
+}
+
+func (ps *PlaybackSystem) recordCoverSource(mediaID, imageURL, digest string) error {
+	_, err := ps.db.Exec(`
+	  INSERT INTO cover_sources (media_id, url, digest, fetched_at) VALUES (?, ?, ?, ?)
+	  ON CONFLICT (media_id) DO UPDATE SET url = excluded.url, digest = excluded.digest, fetched_at = excluded.fetched_at
+	`, mediaID, stripCoverSecrets(imageURL), digest, time.Now())
+	return err
+}
+
+func (ps *PlaybackSystem) LastCoverReport() *CoverReport {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	return ps.coverReport
+}
+
+// CheckCovers walks every media item making sure its cover is present and intact, fetching it
+// again from upstream where we know where it came from. Once that's done, anything in storage
+// that no media item refers to is removed.
+func (ps *PlaybackSystem) CheckCovers(cfg config.Config) (CoverReport, error) {
+	report := CoverReport{StartedAt: time.Now()}
+	err := ps.checkCovers(cfg, &report)
+	report.FinishedAt = time.Now()
+	if err != nil {
+		report.Error = err.Error()
+		slog.Error("Cover integrity check failed", slog.String("error", err.Error()))
+	} else {
+		slog.Info("Finished cover integrity check",
+			slog.Int("checked", report.Checked),
+			slog.Int("refetched", report.Refetched),
+			slog.Int("analysed", report.Analysed),
+			slog.Int("unrecoverable", len(report.Unrecoverable)),
+			slog.Int("orphans_removed", report.OrphansRemoved),
+		)
+	}
+
+	ps.m.Lock()
+	ps.coverReport = &report
+	ps.m.Unlock()
+
+	return report, err
+}
+
+func (ps *PlaybackSystem) checkCovers(cfg config.Config, report *CoverReport) error {
+	store := ps.CoverStorage(cfg)
+
+	var items []MediaItem
+	if err := ps.db.Select(&items, `
+	  SELECT id, title, subtitle, category, duration, source, image, dominant_colours, palette, blurhash
+	  FROM media_items WHERE image != '' ORDER BY id`); err != nil {
+		return err
+	}
+
+	// Several items can share a processed cover so each digest is only checked once
+	verified := map[string]error{}
+	analysed := map[string]bool{}
+	for _, item := range items {
+		var problem error
+		if digest, ok := covers.DigestFromURL(item.Image); ok {
+			if _, seen := verified[digest]; !seen {
+				verified[digest] = covers.Verify(store, digest)
+			}
+			problem = verified[digest]
+		} else if strings.HasPrefix(item.Image, "/static/") {
+			problem = covers.VerifyObject(store, path.Base(item.Image))
+		} else {
+			// Not something we host so there's nothing to check
+			continue
+		}
+		report.Checked++
+		if problem == nil {
+			if digest, ok := covers.DigestFromURL(item.Image); ok && item.BlurHash == "" && !analysed[digest] {
+				analysed[digest] = true
+				// Covers saved before we worked out palettes get one now that we know they're intact
+				if err := ps.analyseCover(store, digest); err != nil {
+					slog.Warn("Failed to analyse existing cover", slog.String("media_id", item.ID), slog.String("error", err.Error()))
+				} else {
+					report.Analysed++
+				}
+			}
+			continue
+		}
+
+		switch {
+		case errors.Is(problem, covers.ErrMissing):
+			report.Missing++
+		case errors.Is(problem, covers.ErrCorrupt):
+			report.Corrupt++
+		default:
+			return problem
+		}
+
+		if err := ps.refetchCover(cfg, item); err != nil {
+			report.Unrecoverable = append(report.Unrecoverable, CoverProblem{
+				MediaID: item.ID,
+				Title:   item.Title,
+				Problem: fmt.Sprintf("%s, %s", problem, err),
+			})
+			continue
+		}
+		report.Refetched++
+		if digest, ok := covers.DigestFromURL(item.Image); ok {
+			// Anyone else sharing this cover was repointed at the fresh copy so they can skip the refetch
+			verified[digest] = nil
+			analysed[digest] = true
+		}
+	}
+
+	removed, err := ps.removeOrphanedCovers(cfg)
+	report.OrphansRemoved = removed
+	return err
+}
+
+func (ps *PlaybackSystem) refetchCover(cfg config.Config, item MediaItem) error {
+	var source CoverSource
+	if err := ps.db.Get(&source, `SELECT media_id, url, digest, fetched_at FROM cover_sources WHERE media_id = ?`, item.ID); err != nil {
+		return fmt.Errorf("no upstream was recorded for this cover")
+	}
+
+	store := ps.CoverStorage(cfg)
+	// Clear out whatever is left of the broken cover, otherwise saving it again is a no-op
+	if digest, ok := covers.DigestFromURL(item.Image); ok {
+		if err := covers.Remove(store, digest); err != nil {
+			return err
+		}
+	}
+
+	image, _, _, err := utils.ExtractImageContent(restoreCoverSecrets(cfg, source.URL))
+	if err != nil {
+		return fmt.Errorf("failed to fetch from upstream: %w", err)
+	}
+	if err := ps.recordCoverSource(item.ID, source.URL, covers.Digest(image)); err != nil {
+		return err
+	}
+	digest, err := covers.Save(store, image)
+	if err != nil {
+		return err
+	}
+
+	// Upstream may have handed back different artwork this time so the item, and anything else
+	// that was sharing its processed cover, follows along
+	palette, blurHash, err := covers.Analyse(image)
+	if err != nil {
+		slog.Warn("Failed to analyse refetched cover", slog.String("media_id", item.ID), slog.String("error", err.Error()))
+	}
+	update, args := `UPDATE media_items SET image = ?, palette = ?, blurhash = ? WHERE id = ?`, []interface{}{covers.URL(digest), palette, blurHash, item.ID}
+	if _, ok := covers.DigestFromURL(item.Image); ok {
+		update, args = `UPDATE media_items SET image = ?, palette = ?, blurhash = ? WHERE image = ?`, []interface{}{covers.URL(digest), palette, blurHash, item.Image}
+	}
+	if _, err := ps.db.Exec(update, args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// analyseCover fills in the palette and placeholder for every item sharing a processed cover
+func (ps *PlaybackSystem) analyseCover(store storage.Backend, digest string) error {
+	original, err := covers.Load(store, digest, covers.Original, covers.JPEG)
+	if err != nil {
+		return err
+	}
+	palette, blurHash, err := covers.Analyse(original)
+	if err != nil {
+		return err
+	}
+	if _, err := ps.db.Exec(`UPDATE media_items SET palette = ?, blurhash = ? WHERE image = ?`, palette, blurHash, covers.URL(digest)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeOrphanedCovers deletes covers in storage that nothing refers to anymore. Covers that
+// were just fetched but whose media item hasn't been saved yet are still in cover_sources, which
+// is written before any of the cover is. Storage is listed before we look at what's referenced
+// so that anything saved in between is never mistaken for an orphan.
+func (ps *PlaybackSystem) removeOrphanedCovers(cfg config.Config) (int, error) {
+	store := ps.CoverStorage(cfg)
+
+	keys, err := store.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := map[string]bool{}
+	var images []string
+	if err := ps.db.Select(&images, `SELECT image FROM media_items WHERE image != ''`); err != nil {
+		return 0, err
+	}
+	for _, image := range images {
+		if digest, ok := covers.DigestFromURL(image); ok {
+			referenced[digest] = true
+		} else {
+			referenced[path.Base(image)] = true
+		}
+	}
+	var digests []string
+	if err := ps.db.Select(&digests, `SELECT digest FROM cover_sources`); err != nil {
+		return 0, err
+	}
+	for _, digest := range digests {
+		referenced[digest] = true
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if !covers.IsCoverKey(key) {
+			continue
+		}
+		name := key
+		if strings.HasPrefix(key, "covers/") {
+			name = strings.Split(key, "/")[1]
+		}
+		if referenced[name] {
+			continue
+		}
+		modified, err := store.Modified(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		if time.Since(modified) < orphanGracePeriod {
+			continue
+		}
+		if err := store.Delete(key); err != nil {
+			return removed, err
+		}
+		slog.With(slog.String("key", key)).Debug("Removed orphaned cover")
+		removed++
+	}
+	return removed, nil
+}
+
+func stripCoverSecrets(imageURL string) string {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return imageURL
+	}
+	q := u.Query()
+	for _, param := range secretCoverParams {
+		q.Del(param)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// restoreCoverSecrets adds our Plex token back for covers that came from our Plex server
+func restoreCoverSecrets(cfg config.Config, imageURL string) string {
+	if cfg.Plex.URL == "" || cfg.Plex.Token == "" || !strings.HasPrefix(imageURL, cfg.Plex.URL) {
+		return imageURL
+	}
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return imageURL
+	}
+	q := u.Query()
+	q.Set("X-Plex-Token", cfg.Plex.Token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -42,6 +42,9 @@ type Source string
 
 const (
 	Anilist           Source = "anilist"
+	LastFM            Source = "lastfm"
+	Letterboxd        Source = "letterboxd"
+	ListenBrainz      Source = "listenbrainz"
 	Plex              Source = "plex"
 	RetroAchievements Source = "retroachievements"
 	Spotify           Source = "spotify"
@@ -64,6 +67,7 @@ type PlaybackEntry struct {
 	UpdatedAt      time.Time `db:"updated_at"`
 	StateChangedAt time.Time `db:"state_changed_at"`
 	Source         Source    `db:"source"`
+	UserID         int64     `db:"user_id"`
 }
 
 // MediaItem stores metadata about each piece of media that is played ie; movies, tv series, games
@@ -80,6 +84,8 @@ type MediaItem struct {
 	Source          string                     `db:"source"`
 	Image           string                     `db:"image"`
 	DominantColours models.SerializableColours `db:"dominant_colours"`
+	Palette         models.Palette             `db:"palette"`
+	BlurHash        string                     `db:"blurhash"`
 }
 
 // FullPlaybackEntry reflects a single PlaybackEntry with MediaItem metadata attached
@@ -94,6 +100,8 @@ type FullPlaybackEntry struct {
 	Source          string                     `db:"source" json:"source"`
 	Image           string                     `db:"image" json:"image"` // TODO: Construct image URL from media_id
 	DominantColours models.SerializableColours `db:"dominant_colours" json:"dominant_colours"`
+	Palette         models.Palette             `db:"palette" json:"palette"`
+	BlurHash        string                     `db:"blurhash" json:"blurhash"`
 
 	// PlaybackEntry fields
 	PlaybackID int       `db:"playback_id" json:"playback_id"`
@@ -103,12 +111,15 @@ type FullPlaybackEntry struct {
 	IsActive       bool      `db:"is_active" json:"is_active"`
 	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
 	StateChangedAt time.Time `db:"state_changed_at" json:"state_changed_at"`
+	UserID         int64     `db:"user_id" json:"-"`
 }
 
 type Update struct {
 	MediaItem MediaItem
 	Elapsed   time.Duration
 	Status    Status
+	// UserID is who the playback belongs to, falling back to the owner when it isn't set
+	UserID int64
 }
 
 func GenerateMediaID(p *Update) string {
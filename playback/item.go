@@ -0,0 +1,91 @@
+package playback
+
+import (
+	"time"
+
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+// completionThreshold is how much of an item needs to have been played before we count it as finished.
+// Credits and outros mean people rarely make it to exactly 100%.
+const completionThreshold = 0.9
+
+// ItemDetail is everything we know about a single media item and each time it was played
+type ItemDetail struct {
+	ID              string                     `db:"id" json:"id"`
+	Title           string                     `db:"title" json:"title"`
+	Subtitle        string                     `db:"subtitle" json:"subtitle"`
+	Category        string                     `db:"category" json:"category"`
+	Duration        int                        `db:"duration" json:"duration_ms"`
+	Source          string                     `db:"source" json:"source"`
+	Image           string                     `db:"image" json:"image"`
+	DominantColours models.SerializableColours `db:"dominant_colours" json:"dominant_colours"`
+	Palette         models.Palette             `db:"palette" json:"palette"`
+	BlurHash        string                     `db:"blurhash" json:"blurhash"`
+
+	PlayCount       int        `json:"play_count"`
+	CompletionCount int        `json:"completion_count"`
+	TotalElapsed    int        `json:"total_elapsed_ms"`
+	FirstPlayedAt   *time.Time `json:"first_played_at"`
+	LastPlayedAt    *time.Time `json:"last_played_at"`
+	Plays           []ItemPlay `json:"plays"`
+}
+
+type ItemPlay struct {
+	PlaybackID     int       `db:"playback_id" json:"playback_id"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	Elapsed        int       `db:"elapsed" json:"elapsed_ms"`
+	Status         Status    `db:"status" json:"status"`
+	IsActive       bool      `db:"is_active" json:"is_active"`
+	UpdatedAt      time.Time `db:"updated_at" json:"updated_at"`
+	StateChangedAt time.Time `db:"state_changed_at" json:"state_changed_at"`
+	Completed      bool      `db:"-" json:"completed"`
+}
+
+// GetItemDetail returns a media item with all of its plays, most recent first.
+// sql.ErrNoRows is returned if there is no such item.
+func (ps *PlaybackSystem) GetItemDetail(id string) (ItemDetail, error) {
+	var detail ItemDetail
+	err := ps.db.Get(&detail, `
+	  SELECT id, title, subtitle, category, duration, source, image, dominant_colours, palette, blurhash
+	  FROM media_items WHERE id = ?`, id)
+	if err != nil {
+		return detail, err
+	}
+
+	detail.Plays = []ItemPlay{}
+	err = ps.db.Select(&detail.Plays, `
+	  SELECT id as playback_id, created_at, elapsed, status, is_active, updated_at, state_changed_at
+	  FROM playback_entries
+	  WHERE media_id = ?
+	  ORDER BY created_at DESC, id DESC`, id)
+	if err != nil {
+		return detail, err
+	}
+
+	for i, play := range detail.Plays {
+		detail.Plays[i].Completed = play.completed(detail.Duration)
+		if detail.Plays[i].Completed {
+			detail.CompletionCount++
+		}
+		detail.TotalElapsed += play.Elapsed
+	}
+	detail.PlayCount = len(detail.Plays)
+	if detail.PlayCount > 0 {
+		detail.LastPlayedAt = &detail.Plays[0].CreatedAt
+		detail.FirstPlayedAt = &detail.Plays[detail.PlayCount-1].CreatedAt
+	}
+	return detail, nil
+}
+
+// completed reports whether a play made it (nearly) to the end. Some sources like games have no
+// known duration so for those, any play that has wrapped up is as complete as it's going to get.
+func (p ItemPlay) completed(duration int) bool {
+	if p.IsActive {
+		return false
+	}
+	if duration <= 0 {
+		return p.Status == StatusStopped
+	}
+	return float64(p.Elapsed) >= float64(duration)*completionThreshold
+}
@@ -0,0 +1,76 @@
+package playback
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/marcus-crane/gunslinger/config"
+)
+
+var categories = []Category{Episode, Gaming, Manga, Movie, Podcast, Track}
+
+// SourceRule is what we keep from a source and where it sits when more than one thing is playing
+type SourceRule struct {
+	Priority   int
+	Categories []string
+	Ignore     []*regexp.Regexp
+}
+
+// Allows reports whether playback of an item should be recorded at all
+func (r SourceRule) Allows(item MediaItem) bool {
+	if len(r.Categories) > 0 && !slices.Contains(r.Categories, item.Category) {
+		return false
+	}
+	for _, pattern := range r.Ignore {
+		if pattern.MatchString(item.Title) || pattern.MatchString(item.Subtitle) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSourceRules turns the filters and priorities from the config file into rules for each source
+func NewSourceRules(sources config.SourcesConfig) (map[string]SourceRule, error) {
+	rules := map[string]SourceRule{}
+	for name, source := range sources.Named() {
+		// Categories have already been checked by config.Validate
+		rule := SourceRule{Priority: source.Priority, Categories: source.Categories}
+		for _, pattern := range source.Ignore {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("sources.%s.ignore: %w", name, err)
+			}
+			rule.Ignore = append(rule.Ignore, re)
+		}
+		rules[name] = rule
+	}
+	return rules, nil
+}
+
+// SetSourceRules replaces the rules that updates are checked against
+func (ps *PlaybackSystem) SetSourceRules(rules map[string]SourceRule) {
+	ps.m.Lock()
+	ps.rules = rules
+	ps.m.Unlock()
+	ps.RefreshCurrentPlayback()
+}
+
+// Allows reports whether an item would be recorded under its source's rules
+func (ps *PlaybackSystem) Allows(item MediaItem) bool {
+	return ps.rule(item.Source).Allows(item)
+}
+
+func (ps *PlaybackSystem) rule(source string) SourceRule {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	return ps.rules[source]
+}
+
+// sortByPriority puts higher priority sources first, otherwise keeping the most recent first
+func (ps *PlaybackSystem) sortByPriority(entries []FullPlaybackEntry) {
+	slices.SortStableFunc(entries, func(a, b FullPlaybackEntry) int {
+		return cmp.Compare(ps.rules[b.Source].Priority, ps.rules[a.Source].Priority)
+	})
+}
@@ -0,0 +1,66 @@
+package playback
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+// SearchResult is a media item matching a search along with how often and how recently it was played
+type SearchResult struct {
+	ID              string                     `db:"id" json:"id"`
+	Title           string                     `db:"title" json:"title"`
+	Subtitle        string                     `db:"subtitle" json:"subtitle"`
+	Category        string                     `db:"category" json:"category"`
+	Duration        int                        `db:"duration" json:"duration_ms"`
+	Source          string                     `db:"source" json:"source"`
+	Image           string                     `db:"image" json:"image"`
+	DominantColours models.SerializableColours `db:"dominant_colours" json:"dominant_colours"`
+	Palette         models.Palette             `db:"palette" json:"palette"`
+	BlurHash        string                     `db:"blurhash" json:"blurhash"`
+	PlayCount       int                        `db:"play_count" json:"play_count"`
+	LastPlayedAt    *time.Time                 `db:"last_played_at" json:"last_played_at"`
+}
+
+// SearchMediaItems finds media items whose title or subtitle match every word in the query,
+// best matches first. Each word is treated as a prefix so "blade ru" still finds Blade Runner.
+func (ps *PlaybackSystem) SearchMediaItems(query string, limit int) ([]SearchResult, error) {
+	var results []SearchResult
+
+	if limit <= 0 {
+		return results, fmt.Errorf("must request at least one search result")
+	}
+
+	match := searchMatchExpression(query)
+	if match == "" {
+		return results, fmt.Errorf("a search query is required")
+	}
+
+	err := ps.db.Select(&results, `
+	  SELECT
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+	    (SELECT COUNT(*) FROM playback_entries WHERE media_id = m.id) AS play_count,
+	    p.created_at AS last_played_at
+	  FROM (
+	    SELECT id, rank FROM media_search WHERE media_search MATCH ? ORDER BY rank LIMIT ?
+	  ) s
+	  JOIN media_items m ON m.id = s.id
+	  LEFT JOIN playback_entries p ON p.id = (
+	    SELECT id FROM playback_entries WHERE media_id = m.id ORDER BY created_at DESC LIMIT 1
+	  )
+	  ORDER BY s.rank
+	`, match, limit)
+
+	return results, err
+}
+
+// searchMatchExpression quotes each word so user input can't be interpreted as FTS5 syntax
+func searchMatchExpression(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
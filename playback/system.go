@@ -5,21 +5,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
 	"github.com/marcus-crane/gunslinger/events"
 	"github.com/marcus-crane/gunslinger/models"
+	"github.com/marcus-crane/gunslinger/storage"
 	"github.com/marcus-crane/gunslinger/utils"
 	"github.com/r3labs/sse/v2"
 )
 
 type PlaybackSystem struct {
-	State []FullPlaybackEntry
-	db    *sqlx.DB
-	m     sync.RWMutex
+	State  []FullPlaybackEntry
+	db     *sqlx.DB
+	m      sync.RWMutex
+	covers storage.Backend
+
+	coverReport *CoverReport
+	rules       map[string]SourceRule
 }
 
 func NewPlaybackSystem(db *sqlx.DB) *PlaybackSystem {
@@ -29,10 +37,31 @@ func NewPlaybackSystem(db *sqlx.DB) *PlaybackSystem {
 	}
 }
 
+// Version changes whenever anything that shows up in what's playing or the history does, so
+// clients can be told that nothing has changed since they last asked. It's counted by triggers
+// in the database so writes from another instance or the command line are picked up too.
+func (ps *PlaybackSystem) Version() int64 {
+	var version int64
+	if err := ps.db.Get(&version, `SELECT version FROM playback_version WHERE id = 1`); err != nil {
+		slog.Error("Failed to look up playback version", slog.String("error", err.Error()))
+		// Something that never matches means clients refetch rather than getting a stale 304
+		return time.Now().UnixNano()
+	}
+	return version
+}
+
 func (ps *PlaybackSystem) UpdatePlaybackState(update Update) error {
 	// Ensure we have an ID. It's deterministic so doesn't matter
 	// if we run it a bunch of times
 	update.MediaItem.ID = GenerateMediaID(&update)
+	if update.UserID == 0 {
+		update.UserID = models.OwnerUserID
+	}
+	if !ps.rule(update.MediaItem.Source).Allows(update.MediaItem) {
+		slog.Debug("Skipping playback filtered out by source rules", slog.String("media_id", update.MediaItem.ID))
+		// Whatever was playing before has still been replaced, even if we aren't recording what by
+		return ps.deactivate(update.MediaItem.Source, update.UserID)
+	}
 
 	tx, err := ps.db.Beginx()
 	if err != nil {
@@ -62,9 +91,9 @@ func (ps *PlaybackSystem) UpdatePlaybackState(update Update) error {
 	err = tx.Get(&existingEntry, `
 	  SELECT id, media_id, elapsed, status, is_active, state_changed_at
 	  FROM playback_entries
-	  WHERE category = ? AND source = ?
+	  WHERE category = ? AND source = ? AND user_id = ?
 	  ORDER BY updated_at DESC LIMIT 1`,
-		update.MediaItem.Category, update.MediaItem.Source)
+		update.MediaItem.Category, update.MediaItem.Source, update.UserID)
 
 	if err == nil {
 		slog.Debug("Found existing entry to update",
@@ -122,8 +151,8 @@ func (ps *PlaybackSystem) UpdatePlaybackState(update Update) error {
 	// exists (ie; we've played it before) then we don't care, a no-op is perfectly fine.
 	_, err = tx.NamedExec(`
 	  INSERT INTO media_items
-	  (id, title, subtitle, category, duration, source, image, dominant_colours)
-	  VALUES (:id, :title, :subtitle, :category, :duration, :source, :image, :dominant_colours)
+	  (id, title, subtitle, category, duration, source, image, dominant_colours, palette, blurhash)
+	  VALUES (:id, :title, :subtitle, :category, :duration, :source, :image, :dominant_colours, :palette, :blurhash)
 	  ON CONFLICT (id) DO NOTHING`,
 		update.MediaItem)
 	if err != nil {
@@ -134,9 +163,9 @@ func (ps *PlaybackSystem) UpdatePlaybackState(update Update) error {
 	now := time.Now()
 	_, err = tx.Exec(`
 	  INSERT INTO playback_entries
-	  (media_id, category, created_at, elapsed, status, is_active, updated_at, state_changed_at, source)
-	  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		update.MediaItem.ID, update.MediaItem.Category, now, elapsed, update.Status, update.Status == StatusPlaying, now, now, update.MediaItem.Source)
+	  (media_id, category, created_at, elapsed, status, is_active, updated_at, state_changed_at, source, user_id)
+	  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		update.MediaItem.ID, update.MediaItem.Category, now, elapsed, update.Status, update.Status == StatusPlaying, now, now, update.MediaItem.Source, update.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to insert new playback entry: %+v", err)
 	}
@@ -159,7 +188,7 @@ func (ps *PlaybackSystem) broadcastEvent() {
 	// Just enough to ping the client to rehydrate itself
 	// 2024-07-21: Probably should send diff fragments because then the UI will need to keep track of previous state
 	// to ensure a transition between animations rather than fully re-rendering them from scratch
-	jsonState, _ := json.Marshal(ps.State)
+	jsonState, _ := json.Marshal(ps.Active())
 	events.Server.Publish("playback", &sse.Event{Data: jsonState})
 }
 
@@ -172,19 +201,71 @@ func (ps *PlaybackSystem) RefreshCurrentPlayback() error {
 	ps.m.Lock()
 	defer ps.m.Unlock()
 
+	ps.sortByPriority(entries)
 	ps.State = entries
 
 	return nil
 }
 
+// Resync reloads what's playing from the database for when another instance is the one writing
+// to it, letting everyone know if anything changed
+func (ps *PlaybackSystem) Resync() error {
+	ps.m.RLock()
+	before := ps.State
+	ps.m.RUnlock()
+	if err := ps.RefreshCurrentPlayback(); err != nil {
+		return err
+	}
+	ps.m.RLock()
+	changed := !reflect.DeepEqual(before, ps.State)
+	ps.m.RUnlock()
+	if changed {
+		ps.broadcastEvent()
+	}
+	return nil
+}
+
+// Active is a copy of ps.State that's safe to hold onto and change, as the follower swaps ps.State
+// out from underneath us and compares it with what came before
+func (ps *PlaybackSystem) Active() []FullPlaybackEntry {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	return slices.Clone(ps.State)
+}
+
+// ActiveForUser picks out what one user is playing from ps.State
+func (ps *PlaybackSystem) ActiveForUser(userID int64) []FullPlaybackEntry {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	entries := []FullPlaybackEntry{}
+	for _, entry := range ps.State {
+		if entry.UserID == userID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// IsPlaying reports whether anything from a source is active, for one user or anyone if userID is 0
+func (ps *PlaybackSystem) IsPlaying(source string, userID int64) bool {
+	ps.m.RLock()
+	defer ps.m.RUnlock()
+	for _, entry := range ps.State {
+		if entry.Source == source && (userID == 0 || entry.UserID == userID) {
+			return true
+		}
+	}
+	return false
+}
+
 // ps.State is expected to always be up to date
 func (ps *PlaybackSystem) GetActivePlayback() ([]FullPlaybackEntry, error) {
 	var results []FullPlaybackEntry
 
 	err := ps.db.Select(&results, `
 	  SELECT
-	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours,
-		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at, p.user_id
 	  FROM media_items m
 	  JOIN playback_entries p ON m.id = p.media_id
 	  WHERE p.is_active = TRUE
@@ -199,8 +280,8 @@ func (ps *PlaybackSystem) GetActivePlaybackBySource(source string) ([]FullPlayba
 
 	err := ps.db.Select(&results, `
 	  SELECT
-	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours,
-		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at, p.user_id
 	  FROM media_items m
 	  JOIN playback_entries p ON m.id = p.media_id
 	  WHERE p.is_active = TRUE AND m.source = ?
@@ -210,7 +291,17 @@ func (ps *PlaybackSystem) GetActivePlaybackBySource(source string) ([]FullPlayba
 	return results, err
 }
 
+// DeactivateBySource stops everything that's active from a source, no matter who it belongs to
 func (ps *PlaybackSystem) DeactivateBySource(source string) error {
+	return ps.deactivate(source, 0)
+}
+
+// DeactivateUserSource stops whatever is active from a source for just one user
+func (ps *PlaybackSystem) DeactivateUserSource(userID int64, source string) error {
+	return ps.deactivate(source, userID)
+}
+
+func (ps *PlaybackSystem) deactivate(source string, userID int64) error {
 	tx, err := ps.db.Beginx()
 	if err != nil {
 		return err
@@ -229,10 +320,10 @@ func (ps *PlaybackSystem) DeactivateBySource(source string) error {
 	_, err = tx.Exec(`
 		UPDATE playback_entries
 		SET is_active = FALSE, status = ?, updated_at = ?, state_changed_at = ?
-		WHERE is_active = TRUE AND media_id IN (
+		WHERE is_active = TRUE AND (? = 0 OR user_id = ?) AND media_id IN (
 			SELECT id FROM media_items WHERE source = ?
 		)
-	`, StatusStopped, now, now, source)
+	`, StatusStopped, now, now, userID, userID, source)
 
 	if err != nil {
 		return err
@@ -245,6 +336,41 @@ func (ps *PlaybackSystem) DeactivateBySource(source string) error {
 	return nil
 }
 
+// Checkpoint brings the elapsed time of anything still playing up to date, for when we're shutting
+// down. Entries are left active as whatever is playing probably still will be when we come back
+// and the pollers will sort out anything that isn't.
+func (ps *PlaybackSystem) Checkpoint() error {
+	tx, err := ps.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var entries []PlaybackEntry
+	err = tx.Select(&entries, `
+	  SELECT id, elapsed, updated_at
+	  FROM playback_entries
+	  WHERE is_active = TRUE AND status = ?`, StatusPlaying)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		elapsed := entry.Elapsed + int(now.Sub(entry.UpdatedAt).Milliseconds())
+		if _, err := tx.Exec(`UPDATE playback_entries SET elapsed = ?, updated_at = ? WHERE id = ?`, elapsed, now, entry.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		slog.Info("Checkpointed active playback", slog.Int("count", len(entries)))
+	}
+	return nil
+}
+
 func (ps *PlaybackSystem) GetHistory(limit int) ([]FullPlaybackEntry, error) {
 	var results []FullPlaybackEntry
 
@@ -254,8 +380,8 @@ func (ps *PlaybackSystem) GetHistory(limit int) ([]FullPlaybackEntry, error) {
 
 	err := ps.db.Select(&results, `
 	  SELECT
-	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours,
-		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at
+	    m.id, m.title, m.subtitle, m.category, m.duration, m.source, m.image, m.dominant_colours, m.palette, m.blurhash,
+		p.id as playback_id, p.created_at, p.elapsed, p.status, p.is_active, p.updated_at, p.state_changed_at, p.user_id
 	  FROM media_items m
 	  JOIN playback_entries p ON m.id = p.media_id
 	  WHERE p.is_active = FALSE
@@ -269,24 +395,68 @@ func (ps *PlaybackSystem) GetHistory(limit int) ([]FullPlaybackEntry, error) {
 func (ps *PlaybackSystem) GetMediaItemByID(id string) (MediaItem, error) {
 	var item MediaItem
 	err := ps.db.Get(&item, `
-	  SELECT id, title, subtitle, category, duration, source, image, dominant_colours
+	  SELECT id, title, subtitle, category, duration, source, image, dominant_colours, palette, blurhash
 	  FROM media_items WHERE id = ?`, id)
 	return item, err
 }
 
-func (ps *PlaybackSystem) ResolveCover(cfg config.Config, hash, imageURL string) (string, models.SerializableColours, error) {
+// SetCoverStorage swaps out where covers are kept, which is otherwise the local storage dir
+func (ps *PlaybackSystem) SetCoverStorage(backend storage.Backend) {
+	ps.covers = backend
+}
+
+func (ps *PlaybackSystem) CoverStorage(cfg config.Config) storage.Backend {
+	if ps.covers == nil {
+		return storage.Filesystem{Root: cfg.Gunslinger.StorageDir}
+	}
+	return ps.covers
+}
+
+// Cover is everything we derive from a piece of artwork that gets stored alongside a media item
+type Cover struct {
+	URL             string
+	DominantColours models.SerializableColours
+	Palette         models.Palette
+	BlurHash        string
+}
+
+func (c Cover) ApplyTo(item *MediaItem) {
+	item.Image = c.URL
+	item.DominantColours = c.DominantColours
+	item.Palette = c.Palette
+	item.BlurHash = c.BlurHash
+}
+
+func (ps *PlaybackSystem) ResolveCover(cfg config.Config, hash, imageURL string) (Cover, error) {
 	if existing, err := ps.GetMediaItemByID(hash); err == nil {
-		return existing.Image, existing.DominantColours, nil
+		return Cover{
+			URL:             existing.Image,
+			DominantColours: existing.DominantColours,
+			Palette:         existing.Palette,
+			BlurHash:        existing.BlurHash,
+		}, nil
 	}
-	image, extension, domColours, err := utils.ExtractImageContent(imageURL)
+	image, _, domColours, err := utils.ExtractImageContent(imageURL)
 	if err != nil {
-		return "", nil, err
+		return Cover{}, err
+	}
+	// The source goes in first so the orphan sweep knows about this cover before any of it is written
+	if err := ps.recordCoverSource(hash, imageURL, covers.Digest(image)); err != nil {
+		// Not being able to refetch later isn't worth losing the cover over
+		slog.Warn("Failed to record cover source", slog.String("media_id", hash), slog.String("error", err.Error()))
 	}
-	coverUrl, err := utils.SaveCover(cfg, hash, image, extension)
+	digest, err := covers.Save(ps.CoverStorage(cfg), image)
 	if err != nil {
-		return "", nil, err
+		return Cover{}, err
 	}
-	return coverUrl, domColours, nil
+	cover := Cover{URL: covers.URL(digest), DominantColours: domColours}
+	// Placeholders are a nicety so a cover we can't analyse is still worth keeping
+	if palette, blurHash, err := covers.Analyse(image); err == nil {
+		cover.Palette, cover.BlurHash = palette, blurHash
+	} else {
+		slog.Warn("Failed to analyse cover", slog.String("media_id", hash), slog.String("error", err.Error()))
+	}
+	return cover, nil
 }
 
 func (ps *PlaybackSystem) HasPlaybackEntry(mediaID string) (bool, error) {
@@ -295,6 +465,12 @@ func (ps *PlaybackSystem) HasPlaybackEntry(mediaID string) (bool, error) {
 	return count > 0, err
 }
 
+func (ps *PlaybackSystem) HasUserPlaybackEntry(userID int64, mediaID string) (bool, error) {
+	var count int
+	err := ps.db.Get(&count, `SELECT COUNT(*) FROM playback_entries WHERE media_id = ? AND user_id = ?`, mediaID, userID)
+	return count > 0, err
+}
+
 func (ps *PlaybackSystem) DeleteItem(playback_id int) error {
 	if _, err := ps.db.Exec(`DELETE FROM playback_entries WHERE id = ?`, playback_id); err != nil {
 		return err
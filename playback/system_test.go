@@ -1,32 +1,30 @@
 package playback
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
 	"github.com/marcus-crane/gunslinger/events"
-	"github.com/marcus-crane/gunslinger/migrations"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
 	"github.com/marcus-crane/gunslinger/models"
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/pressly/goose/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func setupTestDB(t *testing.T) *sqlx.DB {
-	db, err := sqlx.Connect("sqlite3", ":memory:")
-	require.NoError(t, err)
-
-	// embed is defined in main.go
-	goose.SetBaseFS(migrations.GetMigrations())
-
-	err = goose.SetDialect("sqlite3")
-	require.NoError(t, err)
-
-	err = goose.Up(db.DB, ".")
-	require.NoError(t, err)
+	db := testdb.Open(t)
 
 	// Gross, PlaybackSystem should handle this
 	events.Init()
@@ -352,6 +350,120 @@ func TestPlaybackSystem_DeactivateBySource(t *testing.T) {
 	assert.Equal(t, "steam", activePlayback[0].Source)
 }
 
+func TestPlaybackSystem_DeactivateUserSource(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	ownerUpdate := Update{
+		MediaItem: MediaItem{
+			Title:    "wobbledogs",
+			Subtitle: "game maker",
+			Category: string(Gaming),
+			Source:   string(Steam),
+		},
+		Status: StatusPlaying,
+	}
+	require.NoError(t, ps.UpdatePlaybackState(ownerUpdate))
+
+	// Two people playing the same game shouldn't end up sharing a playback entry
+	friendUpdate := ownerUpdate
+	friendUpdate.UserID = 2
+	require.NoError(t, ps.UpdatePlaybackState(friendUpdate))
+
+	activePlayback, err := ps.GetActivePlaybackBySource(string(Steam))
+	require.NoError(t, err)
+	assert.Len(t, activePlayback, 2)
+	assert.Len(t, ps.ActiveForUser(models.OwnerUserID), 1)
+	assert.Len(t, ps.ActiveForUser(2), 1)
+
+	// The friend stopping playing leaves the owner alone
+	require.NoError(t, ps.DeactivateUserSource(2, string(Steam)))
+	assert.Len(t, ps.ActiveForUser(models.OwnerUserID), 1)
+	assert.Len(t, ps.ActiveForUser(2), 0)
+
+	history, _, err := ps.QueryHistory(HistoryFilter{UserID: 2}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, int64(2), history[0].UserID)
+
+	seen, err := ps.HasUserPlaybackEntry(3, GenerateMediaID(&ownerUpdate))
+	require.NoError(t, err)
+	assert.False(t, seen)
+}
+
+func TestPlaybackSystem_SourceRules(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	var sources config.SourcesConfig
+	sources.Steam.Ignore = []string{"^Wallpaper Engine$"}
+	sources.Spotify.Priority = 10
+	// Categories are checked by config.Validate so it needs to know about all of ours
+	for _, category := range categories {
+		assert.Contains(t, config.Categories, string(category))
+	}
+	assert.Len(t, config.Categories, len(categories))
+
+	sources.Plex.Categories = []string{string(Episode)}
+	rules, err := NewSourceRules(sources)
+	require.NoError(t, err)
+	ps.SetSourceRules(rules)
+
+	updates := []Update{
+		{MediaItem: MediaItem{Title: "Wallpaper Engine", Category: string(Gaming), Source: string(Steam)}, Status: StatusPlaying},
+		{MediaItem: MediaItem{Title: "a song", Subtitle: "artist", Category: string(Track), Source: string(Plex)}, Status: StatusPlaying},
+		{MediaItem: MediaItem{Title: "another song", Subtitle: "artist", Category: string(Track), Source: string(Spotify)}, Status: StatusPlaying},
+		{MediaItem: MediaItem{Title: "wobbledogs", Category: string(Gaming), Source: string(Steam)}, Status: StatusPlaying},
+	}
+	for _, update := range updates {
+		require.NoError(t, ps.UpdatePlaybackState(update))
+	}
+
+	// Spotify was updated before Steam but it has the higher priority
+	require.Len(t, ps.State, 2)
+	assert.Equal(t, "another song", ps.State[0].Title)
+	assert.Equal(t, "wobbledogs", ps.State[1].Title)
+
+	outcome, err := ps.BackfillPlayback(HistoricalPlayback{MediaItem: updates[0].MediaItem, PlayedAt: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Equal(t, BackfillSkipped, outcome)
+}
+
+func TestPlaybackSystem_FilteredUpdateEndsPreviousEntry(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	var sources config.SourcesConfig
+	sources.Steam.Ignore = []string{"^Wallpaper Engine$"}
+	rules, err := NewSourceRules(sources)
+	require.NoError(t, err)
+	ps.SetSourceRules(rules)
+
+	game := Update{MediaItem: MediaItem{Title: "wobbledogs", Category: string(Gaming), Source: string(Steam)}, Status: StatusPlaying}
+	require.NoError(t, ps.UpdatePlaybackState(game))
+	require.Len(t, ps.State, 1)
+
+	// Switching to something we ignore still means the game isn't being played anymore
+	wallpaper := Update{MediaItem: MediaItem{Title: "Wallpaper Engine", Category: string(Gaming), Source: string(Steam)}, Status: StatusPlaying}
+	require.NoError(t, ps.UpdatePlaybackState(wallpaper))
+	assert.Empty(t, ps.State)
+
+	var entry PlaybackEntry
+	require.NoError(t, db.Get(&entry, `SELECT status, is_active FROM playback_entries WHERE media_id = ?`, GenerateMediaID(&game)))
+	assert.Equal(t, StatusStopped, entry.Status)
+	assert.False(t, entry.IsActive)
+
+	var items int
+	require.NoError(t, db.Get(&items, `SELECT COUNT(*) FROM media_items`))
+	assert.Equal(t, 1, items, "nothing is recorded for the ignored update")
+}
+
 func TestPlaybackSystem_GetHistory(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -575,3 +687,500 @@ func TestPlaybackSystem_GetMediaItemByID(t *testing.T) {
 	_, err = ps.GetMediaItemByID("plex:movie:does-not-exist")
 	assert.ErrorIs(t, err, sql.ErrNoRows)
 }
+
+func TestPlaybackSystem_BackfillPlayback(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	playedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	scrobble := HistoricalPlayback{
+		MediaItem: MediaItem{
+			Title:    "a good song",
+			Subtitle: "some artist",
+			Category: string(Track),
+			Duration: 180000,
+			Source:   string(LastFM),
+		},
+		PlayedAt: playedAt,
+		Elapsed:  3 * time.Minute,
+	}
+
+	// 1. A brand new play is inserted as an inactive, completed entry
+	outcome, err := ps.BackfillPlayback(scrobble)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillInserted, outcome)
+
+	history, err := ps.GetHistory(5)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "a good song", history[0].Title)
+	assert.Equal(t, StatusStopped, history[0].Status)
+	assert.Equal(t, 180000, history[0].Elapsed)
+	assert.False(t, history[0].IsActive)
+	assert.True(t, history[0].CreatedAt.Equal(playedAt))
+	assert.True(t, history[0].StateChangedAt.Equal(playedAt.Add(3*time.Minute)))
+	assert.Len(t, ps.State, 0)
+
+	// 2. Importing the same play again is a no-op
+	outcome, err = ps.BackfillPlayback(scrobble)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillSkipped, outcome)
+
+	// 3. The same play reported by another source shortly after is merged
+	listen := scrobble
+	listen.MediaItem.Source = string(ListenBrainz)
+	listen.MediaItem.Title = "A Good Song"
+	listen.PlayedAt = playedAt.Add(20 * time.Second)
+	outcome, err = ps.BackfillPlayback(listen)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillMerged, outcome)
+
+	// 4. Listening again the next day is a separate play
+	replay := scrobble
+	replay.PlayedAt = playedAt.Add(24 * time.Hour)
+	outcome, err = ps.BackfillPlayback(replay)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillInserted, outcome)
+
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM playback_entries")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	var summary BackfillSummary
+	for _, o := range []BackfillOutcome{BackfillInserted, BackfillSkipped, BackfillMerged, BackfillInserted} {
+		summary.Add(o)
+	}
+	assert.Equal(t, BackfillSummary{Inserted: 2, Skipped: 1, Merged: 1}, summary)
+}
+
+func TestPlaybackSystem_BackfillPlaybackDateOnly(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	nz := time.FixedZone("NZST", 12*60*60)
+	trakt := HistoricalPlayback{
+		MediaItem: MediaItem{Title: "Heat", Subtitle: "1995", Category: string(Movie), Duration: 10_200_000, Source: string(Trakt)},
+		PlayedAt:  time.Date(2020, 6, 3, 20, 30, 0, 0, nz),
+	}
+	letterboxd := HistoricalPlayback{
+		MediaItem: MediaItem{Title: "Heat", Subtitle: "1995", Category: string(Movie), Source: string(Letterboxd)},
+		PlayedAt:  time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC),
+	}
+
+	// The diary entry for that evening is the same watch, even though it only has a date
+	outcome, err := ps.BackfillPlayback(trakt)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillInserted, outcome)
+	outcome, err = ps.BackfillPlayback(letterboxd)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillMerged, outcome)
+
+	// and it doesn't matter which one comes in first
+	trakt.UserID, letterboxd.UserID = 2, 2
+	outcome, err = ps.BackfillPlayback(letterboxd)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillInserted, outcome)
+	outcome, err = ps.BackfillPlayback(trakt)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillMerged, outcome)
+
+	// A rewatch a few days later is still its own play
+	letterboxd.PlayedAt = letterboxd.PlayedAt.AddDate(0, 0, 4)
+	outcome, err = ps.BackfillPlayback(letterboxd)
+	require.NoError(t, err)
+	assert.Equal(t, BackfillInserted, outcome)
+}
+
+func TestPlaybackSystem_HistoryFilterAndSnapshot(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	day := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	plays := []HistoricalPlayback{
+		{MediaItem: MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(Track), Source: string(LastFM)}, PlayedAt: day},
+		{MediaItem: MediaItem{Title: "a movie", Subtitle: "1995", Category: string(Movie), Source: string(Plex)}, PlayedAt: day.AddDate(0, 0, 1)},
+		{MediaItem: MediaItem{Title: "another song", Subtitle: "some artist", Category: string(Track), Source: string(LastFM)}, PlayedAt: day.AddDate(0, 0, 5)},
+	}
+	for _, play := range plays {
+		_, err := ps.BackfillPlayback(play)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`INSERT INTO tokens (id, value) VALUES ('spotify', 'secret')`)
+	require.NoError(t, err)
+
+	filter, err := ParseHistoryFilter(map[string][]string{"from": {"2024-01-10"}, "to": {"2024-01-11"}})
+	require.NoError(t, err)
+
+	var titles []string
+	err = ps.EachHistoryEntry(filter, func(entry FullPlaybackEntry) error {
+		titles = append(titles, entry.Title)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a good song", "a movie"}, titles)
+
+	filter.Category = string(Track)
+	path := t.TempDir() + "/snapshot.db"
+	require.NoError(t, ps.Snapshot(path, filter))
+
+	snapshot, err := sqlx.Connect("sqlite", path)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	var items []string
+	require.NoError(t, snapshot.Select(&items, `SELECT title FROM media_items`))
+	assert.Equal(t, []string{"a good song"}, items)
+
+	var tokens int
+	require.NoError(t, snapshot.Get(&tokens, `SELECT COUNT(*) FROM tokens`))
+	assert.Equal(t, 0, tokens)
+
+	_, err = ParseHistoryFilter(map[string][]string{"from": {"last tuesday"}})
+	assert.Error(t, err)
+}
+
+func TestPlaybackSystem_SnapshotStripsUserCredentials(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	_, err := db.Exec(`INSERT INTO users (id, name) VALUES (2, 'friend')`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO user_sources (user_id, source, identity, credential) VALUES
+	  (1, 'steam', '111', 'owner-steam-key'), (2, 'steam', '222', 'friend-steam-key')`)
+	require.NoError(t, err)
+
+	path := t.TempDir() + "/snapshot.db"
+	require.NoError(t, ps.Snapshot(path, HistoryFilter{}))
+	snapshot, err := sqlx.Connect("sqlite", path)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	var credentials []string
+	require.NoError(t, snapshot.Select(&credentials, `SELECT credential FROM user_sources ORDER BY user_id`))
+	assert.Equal(t, []string{"", ""}, credentials)
+
+	// A snapshot for one user doesn't give away anyone else either
+	path = t.TempDir() + "/snapshot.db"
+	require.NoError(t, ps.Snapshot(path, HistoryFilter{UserID: 2}))
+	snapshot, err = sqlx.Connect("sqlite", path)
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	var identities []string
+	require.NoError(t, snapshot.Select(&identities, `SELECT identity || ':' || credential FROM user_sources`))
+	assert.Equal(t, []string{"222:"}, identities)
+	var users []string
+	require.NoError(t, snapshot.Select(&users, `SELECT name FROM users`))
+	assert.Equal(t, []string{"friend"}, users)
+}
+
+func TestPlaybackSystem_QueryHistory(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 5; i++ {
+		source := LastFM
+		if i%2 == 1 {
+			source = Plex
+		}
+		_, err := ps.BackfillPlayback(HistoricalPlayback{
+			MediaItem: MediaItem{Title: fmt.Sprintf("song %d", i), Subtitle: "100% artist", Category: string(Track), Source: string(source)},
+			PlayedAt:  start.Add(time.Duration(i) * time.Hour),
+		})
+		require.NoError(t, err)
+	}
+
+	// Paging through everything, newest first, until there's no cursor left
+	var titles []string
+	var cursor *HistoryCursor
+	for {
+		page, next, err := ps.QueryHistory(HistoryFilter{}, cursor, 2)
+		require.NoError(t, err)
+		for _, entry := range page {
+			titles = append(titles, entry.Title)
+		}
+		if next == nil {
+			break
+		}
+		parsed, err := ParseHistoryCursor(next.String())
+		require.NoError(t, err)
+		cursor = &parsed
+	}
+	assert.Equal(t, []string{"song 4", "song 3", "song 2", "song 1", "song 0"}, titles)
+
+	page, next, err := ps.QueryHistory(HistoryFilter{Source: string(Plex)}, nil, 10)
+	require.NoError(t, err)
+	assert.Nil(t, next)
+	require.Len(t, page, 2)
+	assert.Equal(t, "song 3", page[0].Title)
+
+	page, _, err = ps.QueryHistory(HistoryFilter{Query: "0% ART"}, nil, 10)
+	require.NoError(t, err)
+	assert.Len(t, page, 5)
+
+	page, _, err = ps.QueryHistory(HistoryFilter{Query: "1_"}, nil, 10)
+	require.NoError(t, err)
+	assert.Len(t, page, 0)
+
+	_, err = ParseHistoryCursor("nonsense")
+	assert.Error(t, err)
+}
+
+func TestPlaybackSystem_SearchMediaItems(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	watchedAt := time.Date(2024, 1, 10, 20, 0, 0, 0, time.Local)
+	for i, title := range []string{"Blade Runner", "Blade Runner", "Amélie"} {
+		_, err := ps.BackfillPlayback(HistoricalPlayback{
+			MediaItem: MediaItem{Title: title, Subtitle: "film", Category: string(Movie), Source: string(Letterboxd)},
+			PlayedAt:  watchedAt.AddDate(0, 0, i),
+		})
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`INSERT INTO media_items (id, title, subtitle, category, duration, source, image, dominant_colours) VALUES ('unplayed', 'Blade Runner 2049', 'film', 'movie', 0, 'letterboxd', '', '[]')`)
+	require.NoError(t, err)
+
+	results, err := ps.SearchMediaItems("blade ru", 10)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		if result.ID == "unplayed" {
+			assert.Equal(t, 0, result.PlayCount)
+			assert.Nil(t, result.LastPlayedAt)
+			continue
+		}
+		assert.Equal(t, "Blade Runner", result.Title)
+		assert.Equal(t, 2, result.PlayCount)
+		require.NotNil(t, result.LastPlayedAt)
+		assert.True(t, result.LastPlayedAt.Equal(watchedAt.AddDate(0, 0, 1)))
+	}
+
+	// Diacritics are folded and quotes can't break out of the match expression
+	results, err = ps.SearchMediaItems(`amelie"`, 10)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	// Renamed items are kept in sync by triggers
+	_, err = db.Exec(`UPDATE media_items SET title = 'Something Else' WHERE id = 'unplayed'`)
+	require.NoError(t, err)
+	results, err = ps.SearchMediaItems("2049", 10)
+	require.NoError(t, err)
+	assert.Len(t, results, 0)
+
+	_, err = ps.SearchMediaItems("   ", 10)
+	assert.Error(t, err)
+}
+
+func TestPlaybackSystem_GetItemDetail(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	item := MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(Track), Duration: 200000, Source: string(LastFM)}
+	first := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	for i, elapsed := range []time.Duration{200 * time.Second, 30 * time.Second} {
+		_, err := ps.BackfillPlayback(HistoricalPlayback{MediaItem: item, PlayedAt: first.AddDate(0, 0, i), Elapsed: elapsed})
+		require.NoError(t, err)
+	}
+	var mediaID string
+	require.NoError(t, db.Get(&mediaID, `SELECT id FROM media_items`))
+
+	detail, err := ps.GetItemDetail(mediaID)
+	require.NoError(t, err)
+	assert.Equal(t, "a good song", detail.Title)
+	assert.Equal(t, 2, detail.PlayCount)
+	assert.Equal(t, 1, detail.CompletionCount)
+	assert.Equal(t, 230000, detail.TotalElapsed)
+	require.Len(t, detail.Plays, 2)
+	assert.False(t, detail.Plays[0].Completed)
+	assert.True(t, detail.Plays[1].Completed)
+	assert.True(t, detail.FirstPlayedAt.Equal(first))
+	assert.True(t, detail.LastPlayedAt.Equal(first.AddDate(0, 0, 1)))
+
+	_, err = ps.GetItemDetail("nope")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestPlaybackSystem_CheckCovers(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	var artwork bytes.Buffer
+	require.NoError(t, png.Encode(&artwork, image.NewRGBA(image.Rect(0, 0, 64, 64))))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(artwork.Bytes())
+	}))
+	defer upstream.Close()
+
+	cfg := config.Config{Gunslinger: config.GunslingerConfig{StorageDir: t.TempDir()}}
+	store := ps.CoverStorage(cfg)
+
+	// An item whose processed cover has lost one of its variants
+	item := MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(Track), Source: string(Spotify)}
+	mediaID := GenerateMediaID(&Update{MediaItem: item})
+	cover, err := ps.ResolveCover(cfg, mediaID, upstream.URL+"/cover.png")
+	require.NoError(t, err)
+	assert.NotEmpty(t, cover.BlurHash)
+	cover.ApplyTo(&item)
+	_, err = ps.BackfillPlayback(HistoricalPlayback{MediaItem: item, PlayedAt: time.Now()})
+	require.NoError(t, err)
+	digest, _ := covers.DigestFromURL(cover.URL)
+	require.NoError(t, store.Delete(covers.Key(digest, covers.Small, covers.WebP)))
+
+	// A legacy cover that's gone missing with nowhere to get it from again
+	legacy := MediaItem{Title: "an old song", Subtitle: "some artist", Category: string(Track), Source: string(Plex), Image: "/static/plex.track.1.jpeg"}
+	_, err = ps.BackfillPlayback(HistoricalPlayback{MediaItem: legacy, PlayedAt: time.Now()})
+	require.NoError(t, err)
+
+	// Leftovers nothing points at, plus something that isn't a cover at all
+	require.NoError(t, store.Put("plex.track.2.jpeg", artwork.Bytes()))
+	require.NoError(t, store.Put(covers.Key(fmt.Sprintf("%064d", 1), covers.Small, covers.JPEG), artwork.Bytes()))
+	require.NoError(t, store.Put("gunslinger.db", []byte("database")))
+	for _, key := range []string{"plex.track.2.jpeg", covers.Key(fmt.Sprintf("%064d", 1), covers.Small, covers.JPEG)} {
+		old := time.Now().Add(-2 * orphanGracePeriod)
+		require.NoError(t, os.Chtimes(filepath.Join(cfg.Gunslinger.StorageDir, key), old, old))
+	}
+	// and one that was only just written, which could still be on its way into the database
+	fresh := covers.Key(fmt.Sprintf("%064d", 2), covers.Small, covers.JPEG)
+	require.NoError(t, store.Put(fresh, artwork.Bytes()))
+
+	report, err := ps.CheckCovers(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, 2, report.Missing)
+	assert.Equal(t, 1, report.Refetched)
+	assert.Equal(t, 2, report.OrphansRemoved)
+	require.Len(t, report.Unrecoverable, 1)
+	assert.Equal(t, "an old song", report.Unrecoverable[0].Title)
+	assert.Equal(t, &report, ps.LastCoverReport())
+
+	assert.NoError(t, covers.Verify(store, digest))
+	exists, err := store.Exists("gunslinger.db")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = store.Exists(fresh)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Everything that could be fixed was so a second run finds nothing new
+	report, err = ps.CheckCovers(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Refetched)
+	assert.Equal(t, 0, report.OrphansRemoved)
+}
+
+func TestPlaybackSystem_ActiveIsACopy(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := NewPlaybackSystem(db)
+	require.NoError(t, ps.UpdatePlaybackState(Update{
+		MediaItem: MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(Track), Source: string(Spotify), Image: "/static/covers/abc"},
+		Status:    StatusPlaying,
+	}))
+
+	// Handlers rewrite covers into public URLs before sending them out, which shouldn't leak
+	// back into the shared state
+	active := ps.Active()
+	require.Len(t, active, 1)
+	active[0].Image = "https://example.com/static/covers/abc"
+	assert.Equal(t, "/static/covers/abc", ps.Active()[0].Image)
+
+	before := ps.Active()
+	require.NoError(t, ps.Resync())
+	assert.Equal(t, before, ps.Active())
+}
+
+func TestPlaybackSystem_Version(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := NewPlaybackSystem(db)
+	initial := ps.Version()
+	assert.NotZero(t, initial)
+
+	update := Update{
+		MediaItem: MediaItem{Title: "a good song", Subtitle: "some artist", Category: string(Track), Source: string(Spotify)},
+		Elapsed:   time.Second,
+		Status:    StatusPlaying,
+	}
+	require.NoError(t, ps.UpdatePlaybackState(update))
+	playing := ps.Version()
+	assert.Greater(t, playing, initial)
+
+	// Sources report the same thing over and over which shouldn't look like a change
+	require.NoError(t, ps.UpdatePlaybackState(update))
+	assert.Equal(t, playing, ps.Version())
+
+	require.NoError(t, ps.DeactivateBySource(string(Spotify)))
+	stopped := ps.Version()
+	assert.Greater(t, stopped, playing)
+	require.NoError(t, ps.DeactivateBySource(string(Spotify)))
+	assert.Equal(t, stopped, ps.Version())
+
+	history, err := ps.GetHistory(1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.NoError(t, ps.DeleteItem(history[0].PlaybackID))
+	deleted := ps.Version()
+	assert.Greater(t, deleted, stopped)
+
+	// Writes from somewhere else sharing the database, like an import from the command line
+	// or the instance holding the lease, show up here too
+	elsewhere := NewPlaybackSystem(db)
+	_, err = elsewhere.BackfillPlayback(HistoricalPlayback{MediaItem: update.MediaItem, PlayedAt: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Greater(t, ps.Version(), deleted)
+	assert.Equal(t, elsewhere.Version(), ps.Version())
+}
+
+func TestStripCoverSecrets(t *testing.T) {
+	cfg := config.Config{Plex: config.PlexConfig{URL: "http://plex.local:32400", Token: "secret"}}
+	stored := stripCoverSecrets("http://plex.local:32400/library/metadata/1/thumb/2?X-Plex-Token=secret")
+	assert.Equal(t, "http://plex.local:32400/library/metadata/1/thumb/2", stored)
+	assert.Equal(t, "http://plex.local:32400/library/metadata/1/thumb/2?X-Plex-Token=secret", restoreCoverSecrets(cfg, stored))
+	assert.Equal(t, "https://i.scdn.co/image/abc", restoreCoverSecrets(cfg, "https://i.scdn.co/image/abc"))
+}
+
+func TestPlaybackSystem_Checkpoint(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	ps := &PlaybackSystem{db: db}
+
+	update := Update{
+		MediaItem: MediaItem{Title: "a song", Subtitle: "artist", Category: string(Track), Source: string(Plex)},
+		Elapsed:   20 * time.Second,
+		Status:    StatusPlaying,
+	}
+	require.NoError(t, ps.UpdatePlaybackState(update))
+	// Pretend we last heard about it ten seconds ago
+	_, err := db.Exec("UPDATE playback_entries SET updated_at = ?", time.Now().Add(-10*time.Second))
+	require.NoError(t, err)
+
+	require.NoError(t, ps.Checkpoint())
+
+	var entry PlaybackEntry
+	require.NoError(t, db.Get(&entry, "SELECT elapsed, is_active, updated_at FROM playback_entries"))
+	assert.True(t, entry.IsActive)
+	assert.InDelta(t, 30000, entry.Elapsed, 1000)
+	assert.WithinDuration(t, time.Now(), entry.UpdatedAt, time.Second)
+}
@@ -2,21 +2,27 @@ package plex
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/users"
 	"github.com/marcus-crane/gunslinger/utils"
 )
 
 const (
 	plexSessionEndpoint = "/status/sessions"
+	plexHistoryEndpoint = "/status/sessions/history/all"
+	plexHistoryPageSize = 100
+	plexHistoryLookback = 24 * time.Hour
 )
 
 type PlexResponse struct {
@@ -24,12 +30,16 @@ type PlexResponse struct {
 }
 
 type MediaContainer struct {
-	Size     int        `json:"size"`
-	Metadata []Metadata `json:"Metadata"`
+	Size      int        `json:"size"`
+	TotalSize int        `json:"totalSize"`
+	Metadata  []Metadata `json:"Metadata"`
 }
 
 type Metadata struct {
 	Attribution         string     `json:"attribution"`
+	Key                 string     `json:"key"`
+	AccountID           int        `json:"accountID"` // Only present on history entries
+	ViewedAt            int64      `json:"viewedAt"`  // Only present on history entries
 	Duration            int        `json:"duration"`
 	GrandparentTitle    string     `json:"grandparentTitle"`
 	LibrarySectionTitle string     `json:"librarySectionTitle"`
@@ -61,12 +71,13 @@ func buildPlexURL(cfg config.Config, endpoint string) string {
 	return fmt.Sprintf("%s%s?X-Plex-Token=%s", cfg.Plex.URL, endpoint, cfg.Plex.Token)
 }
 
-func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client) {
+// GetCurrentlyPlaying polls the server's sessions once and sorts them out between everyone
+// with a Plex account. Sessions from anyone else on the server are ignored.
+func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, accounts []users.Account) error {
 	sessionURL := buildPlexURL(cfg, plexSessionEndpoint)
 	req, err := http.NewRequest("GET", sessionURL, nil)
 	if err != nil {
-		slog.Error("Failed to prepare Plex request", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to prepare Plex request: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":       []string{"application/json"},
@@ -75,63 +86,39 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		slog.Error("Failed to contact Plex for updates", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to contact Plex for updates: %w", err)
 	}
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		slog.Error("Failed to parse Plex response", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to parse Plex response: %w", err)
 	}
 	var plexResponse PlexResponse
 
 	if err = json.Unmarshal(body, &plexResponse); err != nil {
-		slog.Error("Error fetching Plex data", slog.String("error", err.Error()))
+		return fmt.Errorf("error fetching Plex data: %w", err)
 	}
 
 	// index := 0
 
-	if plexResponse.MediaContainer.Size == 0 {
-		// Nothing is playing so mark all existing items as inactive
-		ps.DeactivateBySource(string(playback.Plex))
-		return
+	byAccount := map[string]users.Account{}
+	for _, account := range accounts {
+		byAccount[account.Identity] = account
 	}
+	watching := map[int64]bool{}
 
-	for idx, entry := range plexResponse.MediaContainer.Metadata {
-		// We don't want to capture movie trailers as historical items
-		if entry.Type == "clip" {
+	var errs []error
+	for _, mediaItem := range plexResponse.MediaContainer.Metadata {
+		account, ok := byAccount[mediaItem.User.Id]
+		if !ok {
 			continue
 		}
-		// Skip sessions that aren't from my own account
-		if entry.User.Id != "1" {
+		// Anything we don't record doesn't count, so a trailer rolling ends whatever came before
+		if !shouldRecord(mediaItem) || !ps.Allows(buildMediaItem(mediaItem)) {
 			continue
 		}
-		// Don't surface downloaded YouTube videos since they're mostly low quality junk
-		if entry.LibrarySectionTitle == "YouTube" {
-			continue
-		}
-		mediaItem := plexResponse.MediaContainer.Metadata[idx]
-
-		title := mediaItem.Title
-
-		if mediaItem.Type == "episode" {
-			title = fmt.Sprintf(
-				"%02dx%02d %s",
-				mediaItem.ParentIndex, // Season number
-				mediaItem.Index,       // Episode number
-				mediaItem.Title,
-			)
-		}
-
-		var subtitle string
-
-		if mediaItem.Type == "movie" {
-			subtitle = mediaItem.Director[0].Name
-		} else {
-			subtitle = mediaItem.GrandparentTitle
-		}
+		watching[account.UserID] = true
 
 		// If an item is stopped, it'll just not be here at all
 		status := playback.StatusPlaying
@@ -143,41 +130,204 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 		elapsed := mediaItem.ViewOffset * int(time.Millisecond)
 
 		update := playback.Update{
-			MediaItem: playback.MediaItem{
-				Title:    title,
-				Subtitle: subtitle,
-				Category: mediaItem.Type,
-				Duration: mediaItem.Duration,
-				Source:   string(playback.Plex),
-			},
-			Elapsed: time.Duration(elapsed),
-			Status:  status,
+			MediaItem: buildMediaItem(mediaItem),
+			Elapsed:   time.Duration(elapsed),
+			Status:    status,
+			UserID:    account.UserID,
 		}
 
 		hash := playback.GenerateMediaID(&update)
 
-		thumbnail := mediaItem.Thumb
-		// Tracks generally don't have a unique cover so we should use the album cover instead
-		// This should hold true even for singles though
-		if mediaItem.Type == "track" {
-			thumbnail = mediaItem.ParentThumb
-		}
-
-		coverUrl, domColours, err := ps.ResolveCover(cfg, hash, buildPlexURL(cfg, thumbnail))
+		cover, err := ps.ResolveCover(cfg, hash, buildPlexURL(cfg, thumbnailFor(mediaItem)))
 		if err != nil {
-			slog.Error("Failed to resolve cover for Plex",
-				slog.String("error", err.Error()),
-				slog.String("title", title),
-			)
+			errs = append(errs, fmt.Errorf("failed to resolve cover for Plex (%s): %w", update.MediaItem.Title, err))
 			continue
 		}
-		update.MediaItem.Image = coverUrl
-		update.MediaItem.DominantColours = domColours
+		cover.ApplyTo(&update.MediaItem)
 
 		if err := ps.UpdatePlaybackState(update); err != nil {
-			slog.Error("Failed to save Plex update",
+			errs = append(errs, fmt.Errorf("failed to save Plex update (%s): %w", update.MediaItem.Title, err))
+		}
+	}
+
+	// Nothing showing up for someone means whatever they had going has stopped
+	for _, account := range accounts {
+		if !watching[account.UserID] {
+			ps.DeactivateUserSource(account.UserID, string(playback.Plex))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func shouldRecord(mediaItem Metadata) bool {
+	// We don't want to capture movie trailers as historical items
+	if mediaItem.Type == "clip" {
+		return false
+	}
+	// Don't surface downloaded YouTube videos since they're mostly low quality junk
+	if mediaItem.LibrarySectionTitle == "YouTube" {
+		return false
+	}
+	return true
+}
+
+func buildMediaItem(mediaItem Metadata) playback.MediaItem {
+	title := mediaItem.Title
+
+	if mediaItem.Type == "episode" {
+		title = fmt.Sprintf(
+			"%02dx%02d %s",
+			mediaItem.ParentIndex, // Season number
+			mediaItem.Index,       // Episode number
+			mediaItem.Title,
+		)
+	}
+
+	var subtitle string
+
+	if mediaItem.Type == "movie" {
+		if len(mediaItem.Director) > 0 {
+			subtitle = mediaItem.Director[0].Name
+		}
+	} else {
+		subtitle = mediaItem.GrandparentTitle
+	}
+
+	return playback.MediaItem{
+		Title:    title,
+		Subtitle: subtitle,
+		Category: mediaItem.Type,
+		Duration: mediaItem.Duration,
+		Source:   string(playback.Plex),
+	}
+}
+
+func thumbnailFor(mediaItem Metadata) string {
+	// Tracks generally don't have a unique cover so we should use the album cover instead
+	// This should hold true even for singles though
+	if mediaItem.Type == "track" {
+		return mediaItem.ParentThumb
+	}
+	return mediaItem.Thumb
+}
+
+// BackfillRecentHistory is run on a schedule to fill in anything watched during the last day that
+// we missed, usually because Gunslinger was down or mid-deploy while something was playing
+func BackfillRecentHistory(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, account users.Account) error {
+	summary, err := BackfillHistory(cfg, ps, client, account, time.Now().Add(-plexHistoryLookback))
+	if err != nil {
+		return fmt.Errorf("failed to backfill Plex history for %s: %w", account.UserName, err)
+	}
+	slog.Debug("Backfilled Plex history",
+		slog.String("user", account.UserName),
+		slog.Int("inserted", summary.Inserted),
+		slog.Int("skipped", summary.Skipped),
+		slog.Int("merged", summary.Merged),
+	)
+	return nil
+}
+
+// BackfillHistory pages through the Plex server's watch history for an account, newest first,
+// and records every play since the given time. Plays we already know about are left untouched.
+func BackfillHistory(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, account users.Account, since time.Time) (playback.BackfillSummary, error) {
+	var summary playback.BackfillSummary
+
+	for start := 0; ; start += plexHistoryPageSize {
+		historyURL := fmt.Sprintf("%s%s?sort=viewedAt:desc&accountID=%s&viewedAt>=%d&X-Plex-Container-Start=%d&X-Plex-Container-Size=%d&X-Plex-Token=%s",
+			cfg.Plex.URL, plexHistoryEndpoint, url.QueryEscape(account.Identity), since.Unix(), start, plexHistoryPageSize, cfg.Plex.Token)
+
+		var page PlexResponse
+		if err := fetchPlex(client, historyURL, &page); err != nil {
+			return summary, fmt.Errorf("failed to fetch Plex history: %w", err)
+		}
+
+		for _, entry := range page.MediaContainer.Metadata {
+			if fmt.Sprint(entry.AccountID) != account.Identity || entry.ViewedAt < since.Unix() {
+				continue
+			}
+			outcome, err := backfillEntry(cfg, ps, client, account, entry)
+			if err != nil {
+				return summary, err
+			}
+			summary.Add(outcome)
+		}
+
+		if len(page.MediaContainer.Metadata) < plexHistoryPageSize || start+plexHistoryPageSize >= page.MediaContainer.TotalSize {
+			break
+		}
+	}
+
+	return summary, nil
+}
+
+func backfillEntry(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, account users.Account, entry Metadata) (playback.BackfillOutcome, error) {
+	// History entries are pretty sparse so we fetch the full metadata where we can to make
+	// sure we build the same media item (and so the same ID) as live polling would have
+	mediaItem := entry
+	if entry.Key != "" {
+		var detail PlexResponse
+		err := fetchPlex(client, buildPlexURL(cfg, entry.Key), &detail)
+		if err == nil && len(detail.MediaContainer.Metadata) > 0 {
+			mediaItem = detail.MediaContainer.Metadata[0]
+		} else if err != nil {
+			slog.Debug("Failed to fetch metadata for Plex history entry, falling back to history data",
 				slog.String("error", err.Error()),
-				slog.String("title", title))
+				slog.String("key", entry.Key),
+			)
 		}
 	}
+
+	if !shouldRecord(mediaItem) {
+		return playback.BackfillSkipped, nil
+	}
+
+	item := buildMediaItem(mediaItem)
+	duration := time.Duration(item.Duration) * time.Millisecond
+
+	update := playback.Update{MediaItem: item}
+	hash := playback.GenerateMediaID(&update)
+	cover, err := ps.ResolveCover(cfg, hash, buildPlexURL(cfg, thumbnailFor(mediaItem)))
+	if err != nil {
+		slog.Warn("Failed to resolve cover for Plex history entry",
+			slog.String("error", err.Error()),
+			slog.String("title", item.Title),
+		)
+	} else {
+		cover.ApplyTo(&item)
+	}
+
+	// Plex records viewedAt once something is marked as watched so we work backwards to the start
+	return ps.BackfillPlayback(playback.HistoricalPlayback{
+		MediaItem: item,
+		PlayedAt:  time.Unix(entry.ViewedAt, 0).Add(-duration),
+		Elapsed:   duration,
+		UserID:    account.UserID,
+	})
+}
+
+func fetchPlex(client http.Client, url string, v any) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = http.Header{
+		"Accept":       []string{"application/json"},
+		"Content-Type": []string{"application/json"},
+		"User-Agent":   []string{utils.UserAgent},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from Plex: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
 }
@@ -0,0 +1,106 @@
+package plex
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+	"github.com/marcus-crane/gunslinger/models"
+	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/users"
+)
+
+// fakePlexServer serves a watch history of one movie, one episode from another account
+// and one episode of our own, split across two pages
+func fakePlexServer(t *testing.T, viewedAt int64) *httptest.Server {
+	cover, err := os.ReadFile("../fixtures/dog.jpg")
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(plexHistoryEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.URL.Query().Get("X-Plex-Token"))
+		assert.Contains(t, r.URL.RawQuery, "accountID=1")
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("X-Plex-Container-Start") {
+		case "0":
+			entries := []string{
+				fmt.Sprintf(`{"key": "/library/metadata/1", "type": "movie", "title": "Heat", "accountID": 1, "viewedAt": %d}`, viewedAt),
+				fmt.Sprintf(`{"key": "/library/metadata/2", "type": "episode", "title": "Pilot", "accountID": 2, "viewedAt": %d}`, viewedAt),
+			}
+			// Pad out the first page so the backfill has to ask for a second one
+			for i := len(entries); i < plexHistoryPageSize; i++ {
+				entries = append(entries, fmt.Sprintf(`{"key": "/library/metadata/2", "type": "episode", "title": "Pilot", "accountID": 2, "viewedAt": %d}`, viewedAt))
+			}
+			fmt.Fprintf(w, `{"MediaContainer": {"size": %d, "totalSize": %d, "Metadata": [%s]}}`, len(entries), len(entries)+1, strings.Join(entries, ","))
+		case fmt.Sprint(plexHistoryPageSize):
+			fmt.Fprintf(w, `{"MediaContainer": {"size": 1, "totalSize": %d, "Metadata": [{"key": "/library/metadata/3", "type": "episode", "title": "Pilot", "accountID": 1, "viewedAt": %d}]}}`, plexHistoryPageSize+1, viewedAt-86400)
+		default:
+			t.Errorf("unexpected page requested: %s", r.URL.RawQuery)
+		}
+	})
+	mux.HandleFunc("/library/metadata/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"MediaContainer": {"size": 1, "Metadata": [{"type": "movie", "title": "Heat", "duration": 10200000, "thumb": "/thumbs/1", "Director": [{"tag": "Michael Mann"}]}]}}`)
+	})
+	mux.HandleFunc("/library/metadata/3", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"MediaContainer": {"size": 1, "Metadata": [{"type": "episode", "title": "Pilot", "grandparentTitle": "Some Show", "parentIndex": 1, "index": 1, "duration": 2700000, "thumb": "/thumbs/3"}]}}`)
+	})
+	mux.HandleFunc("/thumbs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(cover)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBackfillHistory(t *testing.T) {
+	db := testdb.Open(t)
+
+	viewedAt := time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC).Unix()
+	srv := fakePlexServer(t, viewedAt)
+
+	cfg := config.Config{
+		Gunslinger: config.GunslingerConfig{StorageDir: t.TempDir()},
+		Plex:       config.PlexConfig{URL: srv.URL, Token: "secret"},
+	}
+	ps := playback.NewPlaybackSystem(db)
+	owner := users.Account{UserID: models.OwnerUserID, UserName: "owner", Source: users.Plex, Identity: "1"}
+
+	summary, err := BackfillHistory(cfg, ps, *srv.Client(), owner, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, playback.BackfillSummary{Inserted: 2}, summary)
+
+	history, err := ps.GetHistory(10)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	assert.Equal(t, "Heat", history[0].Title)
+	assert.Equal(t, "Michael Mann", history[0].Subtitle)
+	assert.Equal(t, string(playback.Plex), history[0].Source)
+	assert.Equal(t, 10200000, history[0].Elapsed)
+	assert.Equal(t, viewedAt, history[0].StateChangedAt.Unix())
+	assert.NotEmpty(t, history[0].Image)
+	assert.NotEmpty(t, history[0].DominantColours)
+
+	assert.Equal(t, "01x01 Pilot", history[1].Title)
+	assert.Equal(t, "Some Show", history[1].Subtitle)
+
+	// Running the backfill again shouldn't record anything new
+	summary, err = BackfillHistory(cfg, ps, *srv.Client(), owner, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, playback.BackfillSummary{Skipped: 2}, summary)
+
+	// Plays older than our cutoff are ignored even if the server sends them back
+	summary, err = BackfillHistory(cfg, ps, *srv.Client(), owner, time.Unix(viewedAt-3600, 0))
+	require.NoError(t, err)
+	assert.Equal(t, playback.BackfillSummary{Skipped: 1}, summary)
+}
@@ -0,0 +1,211 @@
+package poll
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Failures back off exponentially up to this long between attempts
+	maxBackoff = 15 * time.Minute
+	// While nothing is playing we check in this many times less often
+	idleMultiplier = 4
+	// but never less often than this, unless the interval itself is longer
+	maxIdleInterval = 5 * time.Minute
+	// We double our interval once an upstream says we've used up this share of our requests
+	lowRemaining = 0.1
+)
+
+// ErrNotDue is returned by Due when a poller is waiting. Jobs that get it should skip their run.
+var ErrNotDue = errors.New("not due yet")
+
+// Poller decides when a source should next be polled. It's ticked at the source's interval and
+// skips ticks while backing off from failures, waiting out an upstream rate limit or idling
+// because nothing is playing.
+type Poller struct {
+	name     string
+	interval time.Duration
+	playing  func() bool
+
+	mu        sync.Mutex
+	started   time.Time
+	next      time.Time
+	waitUntil time.Time
+	slow      bool
+	failures  int
+
+	now    func() time.Time
+	jitter func(time.Duration) time.Duration
+}
+
+// New creates a poller for a source checked every interval. If playing is set, we slow down
+// while it reports that nothing is playing.
+func New(name string, interval time.Duration, playing func() bool) *Poller {
+	return &Poller{
+		name:     name,
+		interval: interval,
+		playing:  playing,
+		now:      time.Now,
+		// Full jitter over the top half so failing pollers don't line up with each other
+		jitter: func(d time.Duration) time.Duration {
+			return d/2 + rand.N(d/2+1)
+		},
+	}
+}
+
+// Due reports whether we should poll now, returning ErrNotDue if not
+func (p *Poller) Due() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if now.Before(p.waitUntil) {
+		return ErrNotDue
+	}
+	// Ticks don't land exactly on time so anything within half an interval counts as due
+	if now.Add(p.interval / 2).Before(p.next) {
+		return ErrNotDue
+	}
+	p.started = now
+	return nil
+}
+
+// Done works out when we're next due based on how a poll went, passing its error through
+func (p *Poller) Done(err error) error {
+	idle := err == nil && p.playing != nil && !p.playing()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delay := p.interval
+	switch {
+	case err != nil:
+		p.failures++
+		delay = p.backoff()
+	case idle:
+		p.failures = 0
+		delay = min(p.interval*idleMultiplier, max(p.interval, maxIdleInterval))
+	default:
+		p.failures = 0
+	}
+	if err == nil && p.slow {
+		delay *= 2
+	}
+	p.next = p.started.Add(delay)
+	return err
+}
+
+func (p *Poller) backoff() time.Duration {
+	delay := p.interval
+	for i := 0; i < p.failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return p.jitter(min(delay, max(p.interval, maxBackoff)))
+}
+
+// Client wraps an HTTP client so that we see the rate limit headers on everything it gets back
+func (p *Poller) Client(client http.Client) http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = transport{poller: p, base: base}
+	return client
+}
+
+type transport struct {
+	poller *Poller
+	base   http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.poller.observe(res)
+	}
+	return res, err
+}
+
+// observe picks up Retry-After and rate limit headers. There isn't really a standard for the
+// latter so we handle the usual X-RateLimit-* trio (AniList, GitHub style) as well as Trakt's.
+func (p *Poller) observe(res *http.Response) {
+	now := p.now()
+	var until time.Time
+	if wait, ok := RetryAfter(res.Header, now); ok {
+		until = now.Add(wait)
+	}
+	limit, ok := RateLimit(res.Header, now)
+	if ok && limit.Remaining == 0 && limit.Reset.After(until) {
+		until = limit.Reset
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slow = ok && limit.Limit > 0 && float64(limit.Remaining) < float64(limit.Limit)*lowRemaining
+	if until.After(p.waitUntil) {
+		p.waitUntil = until
+		slog.Warn("Upstream asked us to slow down",
+			slog.String("job", p.name),
+			slog.String("host", res.Request.URL.Host),
+			slog.Int("status", res.StatusCode),
+			slog.Time("until", until),
+		)
+	}
+}
+
+// RetryAfter reads a Retry-After header, which can either be a number of seconds or a date
+func RetryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// Limit is how much of a rate limit is left and when it resets
+type Limit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// RateLimit reads whatever rate limit headers an upstream sent, if any
+func RateLimit(header http.Header, now time.Time) (Limit, bool) {
+	// Trakt sends everything as JSON in one header
+	if value := header.Get("X-Ratelimit"); value != "" {
+		var trakt struct {
+			Limit     int       `json:"limit"`
+			Remaining int       `json:"remaining"`
+			Until     time.Time `json:"until"`
+		}
+		if err := json.Unmarshal([]byte(value), &trakt); err == nil {
+			return Limit{Limit: trakt.Limit, Remaining: trakt.Remaining, Reset: trakt.Until}, true
+		}
+	}
+
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return Limit{}, false
+	}
+	limit := Limit{Remaining: remaining}
+	limit.Limit, _ = strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		// Some send a timestamp and some send how many seconds are left
+		if reset > 1_000_000_000 {
+			limit.Reset = time.Unix(reset, 0)
+		} else {
+			limit.Reset = now.Add(time.Duration(reset) * time.Second)
+		}
+	}
+	return limit, true
+}
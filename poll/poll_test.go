@@ -0,0 +1,197 @@
+package poll
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPoller(interval time.Duration, playing func() bool) (*Poller, *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := New("test", interval, playing)
+	p.now = func() time.Time { return now }
+	// No randomness so we can tell exactly when we're next due
+	p.jitter = func(d time.Duration) time.Duration { return d }
+	return p, &now
+}
+
+// runs ticks the poller every interval for a while, counting how many ticks actually polled
+func runs(p *Poller, now *time.Time, ticks int, result error) int {
+	polled := 0
+	for range ticks {
+		*now = now.Add(p.interval)
+		if p.Due() == nil {
+			polled++
+			p.Done(result)
+		}
+	}
+	return polled
+}
+
+func TestPoller_PollsEveryTickWhilePlaying(t *testing.T) {
+	p, now := newTestPoller(time.Second, func() bool { return true })
+	assert.Equal(t, 10, runs(p, now, 10, nil))
+}
+
+func TestPoller_SlowsDownWhileIdle(t *testing.T) {
+	playing := false
+	p, now := newTestPoller(15*time.Second, func() bool { return playing })
+	// Polls land on ticks 1, 5 and 9
+	assert.Equal(t, 3, runs(p, now, 10, nil))
+
+	// Once something starts, we're back to every tick after the next poll notices
+	playing = true
+	assert.Equal(t, 10, runs(p, now, 12, nil))
+}
+
+func TestPoller_IdleIsCapped(t *testing.T) {
+	p, now := newTestPoller(time.Minute, func() bool { return false })
+	require.NoError(t, p.Due())
+	p.Done(nil)
+	*now = now.Add(3 * time.Minute)
+	assert.ErrorIs(t, p.Due(), ErrNotDue)
+	*now = now.Add(time.Minute)
+	assert.NoError(t, p.Due())
+
+	// Slow sources don't get any slower than five minutes
+	p, now = newTestPoller(10*time.Minute, func() bool { return false })
+	require.NoError(t, p.Due())
+	p.Done(nil)
+	*now = now.Add(10 * time.Minute)
+	assert.NoError(t, p.Due())
+}
+
+func TestPoller_BacksOffOnFailure(t *testing.T) {
+	p, now := newTestPoller(time.Second, nil)
+	failure := errors.New("upstream is down")
+
+	// Polls land on ticks 1, 3, 7 and 15 as the wait doubles each time
+	assert.Equal(t, 4, runs(p, now, 15, failure))
+	assert.Equal(t, 4, p.failures)
+
+	// Backoff tops out rather than growing forever
+	for range 20 {
+		p.Done(failure)
+	}
+	assert.Equal(t, maxBackoff, p.backoff())
+
+	// and one success puts us straight back to normal
+	*now = now.Add(maxBackoff)
+	require.NoError(t, p.Due())
+	assert.NoError(t, p.Done(nil))
+	assert.Equal(t, 5, runs(p, now, 5, nil))
+}
+
+func TestPoller_DonePassesErrorThrough(t *testing.T) {
+	p, _ := newTestPoller(time.Second, nil)
+	failure := errors.New("oops")
+	assert.ErrorIs(t, p.Done(failure), failure)
+	assert.NoError(t, p.Done(nil))
+}
+
+func TestPoller_HonoursRetryAfter(t *testing.T) {
+	p, now := newTestPoller(time.Second, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := p.Client(http.Client{})
+	require.NoError(t, p.Due())
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	p.Done(errors.New("got a 429"))
+
+	*now = now.Add(29 * time.Second)
+	assert.ErrorIs(t, p.Due(), ErrNotDue)
+	*now = now.Add(time.Second)
+	assert.NoError(t, p.Due())
+}
+
+func TestPoller_WaitsForRateLimitReset(t *testing.T) {
+	p, now := newTestPoller(time.Second, nil)
+	remaining := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "90")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(time.Minute).Unix(), 10))
+	}))
+	defer server.Close()
+
+	client := p.Client(http.Client{})
+	require.NoError(t, p.Due())
+	res, err := client.Get(server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	p.Done(nil)
+
+	*now = now.Add(59 * time.Second)
+	assert.ErrorIs(t, p.Due(), ErrNotDue)
+	*now = now.Add(time.Second)
+	require.NoError(t, p.Due())
+
+	// Running low on requests halves how often we poll
+	remaining = 5
+	res, err = client.Get(server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+	p.Done(nil)
+	assert.Equal(t, 5, runs(p, now, 10, nil))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		"seconds": {"120", 2 * time.Minute, true},
+		"date":    {now.Add(time.Hour).Format(http.TimeFormat), time.Hour, true},
+		"past":    {now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		"missing": {"", 0, false},
+		"junk":    {"soon", 0, false},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			got, ok := RetryAfter(header, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	header := http.Header{}
+	header.Set("X-RateLimit-Limit", "90")
+	header.Set("X-RateLimit-Remaining", "0")
+	header.Set("X-RateLimit-Reset", "45")
+	limit, ok := RateLimit(header, now)
+	require.True(t, ok)
+	assert.Equal(t, Limit{Limit: 90, Remaining: 0, Reset: now.Add(45 * time.Second)}, limit)
+
+	header = http.Header{}
+	header.Set("X-Ratelimit", `{"name":"AUTHED_API_GET_LIMIT","period":300,"limit":1000,"remaining":0,"until":"2026-01-01T00:05:00Z"}`)
+	limit, ok = RateLimit(header, now)
+	require.True(t, ok)
+	assert.Equal(t, 1000, limit.Limit)
+	assert.Equal(t, 0, limit.Remaining)
+	assert.True(t, limit.Reset.Equal(now.Add(5*time.Minute)))
+
+	_, ok = RateLimit(http.Header{}, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,259 @@
+package ratelimit
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/marcus-crane/gunslinger/apierror"
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/middleware"
+)
+
+// Route groups that share a limit
+const (
+	Public = "public"
+	Static = "static"
+	Events = "events"
+	API    = "api"
+)
+
+// These are generous enough that the site and any widgets polling us never notice them
+var defaults = map[string]string{
+	Public: "5/s:20",
+	Static: "20/s:60",
+	Events: "10/m:5",
+	API:    "2/s:10",
+}
+
+const (
+	// Clients we haven't heard from in a while are forgotten so the map doesn't grow forever
+	idleTimeout   = 10 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// metrics counts allowed and limited requests per group, served up at /debug/vars
+var metrics = expvar.NewMap("ratelimit")
+
+type Limit struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+// ParseLimit reads a limit like 5/s, 300/m or 5/s:20 where the number after the colon is the burst.
+// Without one, the burst is the same as the number of requests.
+func ParseLimit(spec string) (Limit, error) {
+	spec = strings.TrimSpace(spec)
+	perPeriod, burstSpec, hasBurst := strings.Cut(spec, ":")
+	countSpec, periodSpec, ok := strings.Cut(perPeriod, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected something like 5/s or 300/m:50", spec)
+	}
+	count, err := strconv.Atoi(countSpec)
+	if err != nil || count <= 0 {
+		return Limit{}, fmt.Errorf("invalid request count in rate limit %q", spec)
+	}
+	var period time.Duration
+	switch periodSpec {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid period in rate limit %q, expected s, m or h", spec)
+	}
+	burst := count
+	if hasBurst {
+		burst, err = strconv.Atoi(burstSpec)
+		if err != nil || burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid burst in rate limit %q", spec)
+		}
+	}
+	return Limit{Rate: rate.Limit(float64(count) / period.Seconds()), Burst: burst}, nil
+}
+
+// Limiter is a token bucket per client for a single group of routes
+type Limiter struct {
+	group     string
+	limit     Limit
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewLimiter(group string, limit Limit) *Limiter {
+	return &Limiter{group: group, limit: limit, clients: map[string]*client{}, lastSweep: time.Now()}
+}
+
+// Allow takes a token for the client if there's one to take, otherwise saying how long until there will be
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	c := l.client(key, now)
+
+	reservation := c.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// We're turning them away rather than making them wait so the token goes back
+		reservation.CancelAt(now)
+		metrics.Add(l.group+"_limited", 1)
+		return false, delay
+	}
+	metrics.Add(l.group+"_allowed", 1)
+	return true, 0
+}
+
+// Exhausted says whether the client has run out of tokens without taking one
+func (l *Limiter) Exhausted(key string) (bool, time.Duration) {
+	now := time.Now()
+	tokens := l.client(key, now).limiter.TokensAt(now)
+	if tokens >= 1 {
+		return false, 0
+	}
+	return true, time.Duration((1 - tokens) / float64(l.limit.Rate) * float64(time.Second))
+}
+
+func (l *Limiter) client(key string, now time.Time) *client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(l.limit.Rate, l.limit.Burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// Set holds a limiter for each route group and works out who each request belongs to
+type Set struct {
+	limiters       map[string]*Limiter
+	clientIPHeader string
+	disabled       bool
+}
+
+func NewSet(cfg config.RateLimitConfig) (*Set, error) {
+	configured := map[string]string{Public: cfg.Public, Static: cfg.Static, Events: cfg.Events, API: cfg.API}
+	set := &Set{
+		limiters:       map[string]*Limiter{},
+		clientIPHeader: cfg.ClientIPHeader,
+		disabled:       cfg.Disabled,
+	}
+	for group, spec := range configured {
+		if spec == "" {
+			spec = defaults[group]
+		}
+		limit, err := ParseLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", group, err)
+		}
+		set.limiters[group] = NewLimiter(group, limit)
+	}
+	return set, nil
+}
+
+// Keep carries over every client's bucket from a previous set for any group whose limit hasn't
+// changed, so rebuilding routes on a reload doesn't hand everyone a fresh burst
+func (s *Set) Keep(previous *Set) {
+	if previous == nil {
+		return
+	}
+	for group, limiter := range s.limiters {
+		if old, ok := previous.limiters[group]; ok && old.limit == limiter.limit {
+			s.limiters[group] = old
+		}
+	}
+}
+
+// Middleware limits requests to a route group. Anything presenting an API key gets a bucket for
+// that key while everyone else shares one per IP address. Keys are taken at face value so that
+// checking them is left until after the limit, so anyone whose keys get turned away is charged
+// for it against their IP and cut off once they've made too many bad guesses.
+func (s *Set) Middleware(group string) func(http.Handler) http.Handler {
+	limiter := s.limiters[group]
+	return func(next http.Handler) http.Handler {
+		if s.disabled || limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := ClientIP(r, s.clientIPHeader)
+			key, presented := auth.PresentedKey(r)
+			if !presented {
+				s.serve(w, r, next, limiter, "ip:"+ip)
+				return
+			}
+			if exhausted, retryAfter := limiter.Exhausted("rejected:" + ip); exhausted {
+				tooManyRequests(w, r, retryAfter)
+				return
+			}
+			recorder := &middleware.StatusRecorder{ResponseWriter: w}
+			s.serve(recorder, r, next, limiter, "key:"+key)
+			if recorder.Status() == http.StatusUnauthorized {
+				limiter.Allow("rejected:" + ip)
+			}
+		})
+	}
+}
+
+func (s *Set) serve(w http.ResponseWriter, r *http.Request, next http.Handler, limiter *Limiter, bucket string) {
+	if allowed, retryAfter := limiter.Allow(bucket); !allowed {
+		tooManyRequests(w, r, retryAfter)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	apierror.Write(w, r, apierror.TooManyRequests())
+}
+
+// ClientIP finds the address a request came from. IPv6 clients are grouped by /64 as that's
+// usually what a single household or server is handed.
+func ClientIP(r *http.Request, trustedHeader string) string {
+	raw := ""
+	if trustedHeader != "" {
+		raw, _, _ = strings.Cut(r.Header.Get(trustedHeader), ",")
+		raw = strings.TrimSpace(raw)
+	}
+	if raw == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		raw = host
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return raw
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
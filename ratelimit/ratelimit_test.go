@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("5/s")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 5, Burst: 5}, limit)
+
+	limit, err = ParseLimit("120/m:10")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: rate.Limit(2), Burst: 10}, limit)
+
+	for _, spec := range []string{"", "5", "5/d", "0/s", "five/s", "5/s:0", "5/s:many"} {
+		_, err := ParseLimit(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	assert.Equal(t, "203.0.113.7", ClientIP(r, ""))
+
+	// The header is only believed when we've been told to
+	r.Header.Set("Fly-Client-IP", "198.51.100.1")
+	assert.Equal(t, "203.0.113.7", ClientIP(r, ""))
+	assert.Equal(t, "198.51.100.1", ClientIP(r, "Fly-Client-IP"))
+
+	r.Header.Set("Fly-Client-IP", "2001:db8:1:2:aaaa::1")
+	assert.Equal(t, "2001:db8:1:2::/64", ClientIP(r, "Fly-Client-IP"))
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := auth.NewStore(testdb.Open(t))
+	_, secret, err := keys.Create("widget", auth.Scopes{auth.ScopeReadHistory})
+	require.NoError(t, err)
+
+	set, err := NewSet(config.RateLimitConfig{Public: "1/h:2"})
+	require.NoError(t, err)
+	authorizer := auth.NewAuthorizer(keys, "")
+	h := set.Middleware(Public)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			return
+		}
+		if _, err := authorizer.Identify(r); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+
+	request := func(remoteAddr, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v4/playing", nil)
+		r.RemoteAddr = remoteAddr
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("203.0.113.7:1000", "").Code)
+	assert.Equal(t, http.StatusOK, request("203.0.113.7:2000", "").Code)
+	limited := request("203.0.113.7:3000", "")
+	assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.Contains(t, limited.Body.String(), `"code":"rate_limited"`)
+	retryAfter, err := strconv.Atoi(limited.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), retryAfter, 60)
+
+	// Other addresses and valid keys have buckets of their own but a made up key doesn't get around anything
+	assert.Equal(t, http.StatusOK, request("198.51.100.1:1000", "").Code)
+	assert.Equal(t, http.StatusOK, request("203.0.113.7:1000", "Bearer "+secret).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("203.0.113.7:1000", "Bearer gs_nope_nope").Code)
+
+	// Keys that look real are only checked once they're through, so a new one each time gets
+	// turned away by whatever checks them until the address has made too many bad guesses
+	assert.Equal(t, http.StatusUnauthorized, request("192.0.2.1:1000", "Bearer gs_aaaaaaaa_nope").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("192.0.2.1:1000", "Bearer gs_bbbbbbbb_nope").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("192.0.2.1:1000", "Bearer gs_cccccccc_nope").Code)
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1000", "").Code)
+
+	assert.NotNil(t, metrics.Get(Public+"_limited"))
+}
+
+func TestLimiterForgetsIdleClients(t *testing.T) {
+	limiter := NewLimiter("test", Limit{Rate: 1, Burst: 1})
+	limiter.Allow("old")
+	limiter.clients["old"].lastSeen = time.Now().Add(-2 * idleTimeout)
+	limiter.lastSweep = time.Now().Add(-2 * sweepInterval)
+
+	limiter.Allow("new")
+	assert.NotContains(t, limiter.clients, "old")
+	assert.Contains(t, limiter.clients, "new")
+}
+
+func TestSetKeepsBucketsAcrossRebuilds(t *testing.T) {
+	old, err := NewSet(config.RateLimitConfig{Public: "1/h:1", API: "1/h:1"})
+	require.NoError(t, err)
+	allowed, _ := old.limiters[Public].Allow("203.0.113.7")
+	require.True(t, allowed)
+	allowed, _ = old.limiters[API].Allow("203.0.113.7")
+	require.True(t, allowed)
+
+	// Public is unchanged so its bucket is still empty while API starts over with its new limit
+	rebuilt, err := NewSet(config.RateLimitConfig{Public: "1/h:1", API: "2/h:2"})
+	require.NoError(t, err)
+	rebuilt.Keep(old)
+	allowed, _ = rebuilt.limiters[Public].Allow("203.0.113.7")
+	assert.False(t, allowed)
+	allowed, _ = rebuilt.limiters[API].Allow("203.0.113.7")
+	assert.True(t, allowed)
+
+	// There's nothing to keep on startup
+	rebuilt.Keep(nil)
+}
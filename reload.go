@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/auth"
+	"github.com/marcus-crane/gunslinger/config"
+	gdb "github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/health"
+	"github.com/marcus-crane/gunslinger/lease"
+	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/ratelimit"
+	"github.com/marcus-crane/gunslinger/spotify"
+	"github.com/marcus-crane/gunslinger/users"
+)
+
+// How often an instance without the lease picks up playback written by the one holding it
+const followerSync = 5 * time.Second
+
+// These are only read once on startup so changing them needs a restart
+var restartOnly = []string{"gunslinger.db_path", "gunslinger.storage_dir", "gunslinger.token_keys", "storage"}
+
+// ReloadResult describes what a reload changed, by the name each section has in the config file
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reloader applies a new config to a running server. Routes are rebuilt and swapped in
+// underneath the server, so anyone subscribed to /events stays connected, and background
+// jobs are rescheduled. Spotify is only reconnected if its own settings changed so that we
+// don't go through the OAuth dance for nothing.
+//
+// Background jobs and Spotify only run while we hold the lease, so that two instances sharing a
+// database don't both poll. Without it, we serve reads and keep up with what the holder writes.
+type Reloader struct {
+	mu      sync.Mutex
+	cfg     config.Config
+	handler atomic.Pointer[http.Handler]
+
+	ps        *playback.PlaybackSystem
+	store     *gdb.SqliteStore
+	keys      *auth.Store
+	auditLog  *audit.Log
+	userStore *users.Store
+	tracker   *health.Tracker
+	limits    *ratelimit.Set
+	lease     *lease.Lease
+	leading   atomic.Bool
+
+	scheduler   gocron.Scheduler
+	stopSpotify context.CancelFunc
+	spotifyDone chan struct{}
+	stopFollow  context.CancelFunc
+	stopped     bool
+}
+
+func NewReloader(cfg config.Config, ps *playback.PlaybackSystem, store *gdb.SqliteStore, keys *auth.Store, auditLog *audit.Log, userStore *users.Store, lease *lease.Lease) *Reloader {
+	return &Reloader{cfg: cfg, ps: ps, store: store, keys: keys, auditLog: auditLog, userStore: userStore, tracker: health.NewTracker(), lease: lease}
+}
+
+// Start sets everything up for the first time
+func (rl *Reloader) Start() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if err := rl.apply(rl.cfg, true); err != nil {
+		return err
+	}
+	if rl.cfg.Gunslinger.BackgroundJobsEnabled {
+		slog.Debug("Background jobs will start once we hold the lease.")
+	} else {
+		slog.Debug("Background jobs are disabled so we'll leave them to someone else.")
+	}
+	return nil
+}
+
+// WantsLead is whether we should be trying for the lease at all. A copy with background jobs
+// turned off shouldn't stop the real thing from polling.
+func (rl *Reloader) WantsLead() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.cfg.Gunslinger.BackgroundJobsEnabled && !rl.stopped
+}
+
+// SetLeader starts or stops everything that only the lease holder should be doing
+func (rl *Reloader) SetLeader(leading bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.stopped {
+		return
+	}
+	rl.leading.Store(leading)
+	if err := rl.apply(rl.cfg, true); err != nil {
+		slog.Error("Failed to hand over background jobs", slog.String("error", err.Error()))
+		return
+	}
+	switch {
+	case leading:
+		slog.Info("We hold the lease so background jobs are running here")
+	case rl.cfg.Gunslinger.BackgroundJobsEnabled:
+		slog.Info("Someone else holds the lease so we're only serving reads")
+	}
+}
+
+// Leading reports whether we hold the lease
+func (rl *Reloader) Leading() bool {
+	return rl.leading.Load()
+}
+
+// Writable is whether requests that change things should be let through. That's us if we hold
+// the lease or anyone at all if nobody does, like a lone copy with background jobs turned off.
+func (rl *Reloader) Writable() bool {
+	if rl.leading.Load() {
+		return true
+	}
+	vacant, err := rl.lease.Vacant(context.Background())
+	if err != nil {
+		slog.Error("Failed to check the lease", slog.String("error", err.Error()))
+		return false
+	}
+	return vacant
+}
+
+// Reload reads the config file and .env again and applies whatever changed. If the new config
+// is no good, we keep running with the old one. Our own environment can't change underneath us
+// so anything set there, like CORS_ORIGINS, stays as it was until a restart and keeps winning
+// over the file.
+func (rl *Reloader) Reload() (ReloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.stopped {
+		return ReloadResult{}, errors.New("we're shutting down")
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	result := ReloadResult{Changed: changedSections(rl.cfg, cfg), RestartRequired: []string{}}
+	for _, key := range restartOnly {
+		if slices.Contains(result.Changed, key) {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+
+	if err := rl.apply(cfg, rl.spotifyChanged(cfg)); err != nil {
+		return ReloadResult{}, err
+	}
+	rl.cfg = cfg
+
+	slog.Info("Reloaded config", slog.Any("changed", result.Changed))
+	if len(result.RestartRequired) > 0 {
+		slog.Warn("Some changes won't take effect until a restart", slog.Any("settings", result.RestartRequired))
+	}
+	return result, nil
+}
+
+// ReloadOnSignal reloads whenever we're sent a SIGHUP ie; fly ssh console -C "kill -HUP 1"
+func (rl *Reloader) ReloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := rl.Reload(); err != nil {
+				slog.Error("Failed to reload config", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// Stop winds down background jobs and Spotify, giving up on Spotify if it doesn't finish before
+// ctx does. Nothing can be reloaded afterwards.
+func (rl *Reloader) Stop(ctx context.Context) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.stopped = true
+	rl.follow(false)
+	if rl.stopSpotify != nil {
+		rl.stopSpotify()
+		rl.stopSpotify = nil
+		select {
+		case <-rl.spotifyDone:
+		case <-ctx.Done():
+			slog.Warn("Gave up waiting for Spotify to disconnect")
+		}
+	}
+	if rl.scheduler == nil {
+		return nil
+	}
+	return rl.scheduler.Shutdown()
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*rl.handler.Load()).ServeHTTP(w, r)
+}
+
+// apply builds everything that depends on config before swapping any of it in, so that a
+// mistake partway through leaves the old setup running
+func (rl *Reloader) apply(cfg config.Config, restartSpotify bool) error {
+	rules, err := playback.NewSourceRules(cfg.Sources)
+	if err != nil {
+		return err
+	}
+	limits, err := ratelimit.NewSet(cfg.RateLimit)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit: %w", err)
+	}
+	// Clients keep whatever they've used up unless their limit changed
+	limits.Keep(rl.limits)
+	handler, err := RegisterRoutes(http.NewServeMux(), cfg, rl.ps, rl.store, rl.keys, rl.auditLog, rl.userStore, limits, rl)
+	if err != nil {
+		return err
+	}
+	scheduler, err := SetupInBackground(cfg, rl.ps, rl.store, rl.userStore, rl.auditLog, rl.tracker)
+	if err != nil {
+		return err
+	}
+
+	rl.ps.SetSourceRules(rules)
+	rl.limits = limits
+	rl.handler.Store(&handler)
+
+	if rl.scheduler != nil {
+		if err := rl.scheduler.Shutdown(); err != nil {
+			slog.Error("Failed to stop old background jobs", slog.String("error", err.Error()))
+		}
+	}
+	rl.scheduler = scheduler
+	leading := rl.leading.Load()
+	if cfg.Gunslinger.BackgroundJobsEnabled && leading {
+		scheduler.Start()
+	} else {
+		// Jobs that are never going to run shouldn't be reported as stale
+		rl.tracker.Retain(nil)
+	}
+	rl.follow(!leading)
+
+	if restartSpotify {
+		if rl.stopSpotify != nil {
+			rl.stopSpotify()
+			rl.stopSpotify = nil
+		}
+		if cfg.Sources.Spotify.IsEnabled() && leading {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			rl.stopSpotify, rl.spotifyDone = cancel, done
+			go func() {
+				defer close(done)
+				if err := spotify.SetupSpotifyPoller(ctx, cfg, rl.ps, rl.store); err != nil && ctx.Err() == nil {
+					slog.Error("Failed to start Spotify", slog.String("error", err.Error()))
+				}
+			}()
+		}
+	}
+	return nil
+}
+
+// follow keeps our playback state in line with the database while someone else is writing to it
+func (rl *Reloader) follow(following bool) {
+	if !following {
+		if rl.stopFollow != nil {
+			rl.stopFollow()
+			rl.stopFollow = nil
+		}
+		return
+	}
+	if rl.stopFollow != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rl.stopFollow = cancel
+	go func() {
+		ticker := time.NewTicker(followerSync)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rl.ps.Resync(); err != nil {
+					slog.Error("Failed to catch up on playback", slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+func (rl *Reloader) spotifyChanged(cfg config.Config) bool {
+	return rl.cfg.Spotify != cfg.Spotify || rl.cfg.Sources.Spotify.IsEnabled() != cfg.Sources.Spotify.IsEnabled()
+}
+
+// changedSections compares two configs a section at a time, going one level deeper for
+// gunslinger since it's a grab bag of unrelated settings
+func changedSections(old, updated config.Config) []string {
+	changed := []string{}
+	o, u := reflect.ValueOf(old), reflect.ValueOf(updated)
+	for i := 0; i < o.NumField(); i++ {
+		field := o.Type().Field(i)
+		name := field.Tag.Get("toml")
+		if field.Name != "Gunslinger" {
+			if !reflect.DeepEqual(o.Field(i).Interface(), u.Field(i).Interface()) {
+				changed = append(changed, name)
+			}
+			continue
+		}
+		for j := 0; j < o.Field(i).NumField(); j++ {
+			if o.Field(i).Field(j).Interface() != u.Field(i).Field(j).Interface() {
+				changed = append(changed, name+"."+field.Type.Field(j).Tag.Get("toml"))
+			}
+		}
+	}
+	return changed
+}
@@ -40,15 +40,12 @@ type LastPlayedGame struct {
 	Developer   string `json:"Developer"`
 }
 
-func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client) {
+func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client) error {
 	slog.Debug("Processing Retroachievements")
 	url := fmt.Sprintf(ProfileURL, cfg.RetroAchievements.Username, cfg.RetroAchievements.Token)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		slog.Error("Failed to prepare RetroAchievements request",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to prepare RetroAchievements request: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":       []string{"application/json"},
@@ -56,35 +53,23 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 		"User-Agent":   []string{utils.UserAgent},
 	}
 	slog.Debug("RA: Built request. About to request")
-	res, err := http.DefaultClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
-		slog.Error("Failed to contact RetroAchievements for updates",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to contact RetroAchievements for updates: %w", err)
 	}
+	defer res.Body.Close()
 	slog.Debug("Got RA response back", slog.String("status", res.Status))
 	if res.StatusCode != 200 {
-		slog.Error("Received a non-200 status code from Retroachievements",
-			slog.String("status", res.Status),
-		)
-		return
+		return fmt.Errorf("received a non-200 status code from RetroAchievements: %s", res.Status)
 	}
-	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		slog.Error("Failed to read RetroAchievements response",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to read RetroAchievements response: %w", err)
 	}
 	var raProfile Profile
 	if err = json.Unmarshal(body, &raProfile); err != nil {
-		slog.Error("Error fetching RetroAchievements data",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("error fetching RetroAchievements data: %w", err)
 	}
 	var lastPlayed RecentlyPlayedGame
 	slog.Debug("Found recently played titles",
@@ -99,7 +84,7 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	if lastPlayed.GameID == 0 {
 		slog.Debug("Found no last played title for RA")
 		ps.DeactivateBySource(string(playback.RetroAchievements))
-		return
+		return nil
 	}
 
 	slog.Debug("Found title", slog.Int("game_id", lastPlayed.GameID))
@@ -108,17 +93,14 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 		slog.Debug("Last played segment for RA didn't match latest entry in history list")
 		// We know the last game but seemingly a newer game exists. We need the timestamp to know whether it's active.
 		ps.DeactivateBySource(string(playback.RetroAchievements))
-		return
+		return nil
 	}
 
 	lastSeen, err := time.Parse("2006-01-02 15:04:05", lastPlayed.LastPlayed)
 	if err != nil {
-		slog.Error("Failed to parse time for last seen",
-			slog.String("last_seen", lastPlayed.LastPlayed),
-		)
 		// We have no idea when this was last played so assume it was ages ago
 		ps.DeactivateBySource(string(playback.RetroAchievements))
-		return
+		return fmt.Errorf("failed to parse time for last seen %q: %w", lastPlayed.LastPlayed, err)
 	}
 
 	slog.Debug("Saw a recently played title on RA",
@@ -132,7 +114,7 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 		// If we haven't seen this game in at least 5 minutes, we assume we're not playing anymore.
 		// RA appears to update each minute while connected via WiFi so this should be more than enough.
 		ps.DeactivateBySource(string(playback.RetroAchievements))
-		return
+		return nil
 	}
 
 	// 2024-09-23 10:12:39
@@ -152,21 +134,14 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	}
 
 	hash := playback.GenerateMediaID(&update)
-	coverUrl, domColours, err := ps.ResolveCover(cfg, hash, imageUrl)
+	cover, err := ps.ResolveCover(cfg, hash, imageUrl)
 	if err != nil {
-		slog.Error("Failed to resolve cover for RetroAchievements",
-			slog.String("error", err.Error()),
-			slog.String("title", update.MediaItem.Title),
-		)
-		return
+		return fmt.Errorf("failed to resolve cover for RetroAchievements (%s): %w", update.MediaItem.Title, err)
 	}
-	update.MediaItem.Image = coverUrl
-	update.MediaItem.DominantColours = domColours
+	cover.ApplyTo(&update.MediaItem)
 
 	if err := ps.UpdatePlaybackState(update); err != nil {
-		slog.Error("Failed to save RetroAchievements update",
-			slog.String("error", err.Error()),
-			slog.String("title", update.MediaItem.Title))
-		return
+		return fmt.Errorf("failed to save RetroAchievements update (%s): %w", update.MediaItem.Title, err)
 	}
+	return nil
 }
@@ -2,26 +2,45 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antchfx/htmlquery"
+	"github.com/jmoiron/sqlx"
 	"github.com/rs/cors"
 
+	"github.com/marcus-crane/gunslinger/apierror"
+	"github.com/marcus-crane/gunslinger/audit"
+	"github.com/marcus-crane/gunslinger/auth"
 	"github.com/marcus-crane/gunslinger/beeminder"
 	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/covers"
 	"github.com/marcus-crane/gunslinger/db"
 	"github.com/marcus-crane/gunslinger/debug"
 	"github.com/marcus-crane/gunslinger/events"
+	"github.com/marcus-crane/gunslinger/export"
+	"github.com/marcus-crane/gunslinger/health"
+	"github.com/marcus-crane/gunslinger/importer"
 	"github.com/marcus-crane/gunslinger/kagi"
+	"github.com/marcus-crane/gunslinger/middleware"
+	"github.com/marcus-crane/gunslinger/models"
 	"github.com/marcus-crane/gunslinger/obsidian"
 	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/ratelimit"
 	"github.com/marcus-crane/gunslinger/readwise"
+	"github.com/marcus-crane/gunslinger/users"
 	"github.com/marcus-crane/gunslinger/utils"
 )
 
@@ -41,6 +60,12 @@ type readerPayload struct {
 	Notes           string   `json:"notes,omitempty"`
 }
 
+const (
+	defaultHistoryLimit = 7
+	defaultSearchLimit  = 20
+	maxHistoryLimit     = 100
+)
+
 var requestsRe = regexp.MustCompile(`(?m).*Marcus\W+(\d+).*requests`)
 
 func renderJSONMessage(w http.ResponseWriter, message string) {
@@ -49,42 +74,120 @@ func renderJSONMessage(w http.ResponseWriter, message string) {
 	json.NewEncoder(w).Encode(res)
 }
 
-func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.PlaybackSystem, store db.Store) http.Handler {
+// publicCoverURL leaves processed covers as they are while legacy covers are pointed at
+// their media ID based path, which also papers over any that were saved as png
+func publicCoverURL(mediaID, image string) string {
+	if _, ok := covers.DigestFromURL(image); ok {
+		return image
+	}
+	return "/static/" + strings.ReplaceAll(mediaID, ":", ".") + ".jpeg"
+}
+
+func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.PlaybackSystem, store db.Store, keys *auth.Store, auditLog *audit.Log, userStore *users.Store, limits *ratelimit.Set, reloader *Reloader) (http.Handler, error) {
 
 	events.Server.CreateStream("playback")
 
+	// Followers serve reads against a database someone else is writing to, see Reloader.Writable
+	authorizer := auth.NewAuthorizer(keys, cfg.Gunslinger.SuperSecretToken).WritesWhen(reloader.Writable)
+
+	// handle registers a route behind whatever checks it needs, which run in the order given
+	handle := func(pattern string, h http.Handler, mw ...middleware.Middleware) {
+		mux.Handle(pattern, middleware.Chain(h, mw...))
+	}
+	scope := func(s auth.Scope) middleware.Middleware {
+		return middleware.RequireScope(authorizer, s)
+	}
+	// audited records anything that changes data or needs admin access. Admin only reads that
+	// widgets poll, like the Beeminder glance, are left out so they don't drown everything else.
+	// It always sits behind a limit so nobody can flood the log.
+	audited := audit.NewRecorder(auditLog, authorizer, cfg.RateLimit.ClientIPHeader).WritesWhen(reloader.Writable).Middleware
+	get := middleware.Methods(http.MethodGet)
+	// Only whoever holds the lease writes to the database, see Reloader.Writable
+	writable := middleware.RequireWritable(reloader.Writable)
+	// Limits come before scope checks so guessing at secrets is throttled too. Keys get a bucket of
+	// their own going by what they look like, while turned away ones count against their IP.
+	limit := limits.Middleware
+	post := middleware.Methods(http.MethodPost)
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprintf(w, "Welcome to Gunslinger, my handy do-everything API.\nYou can find the source code on <a href=\"https://github.com/marcus-crane/gunslinger\">Github</a>\n")
 	})
 
+	// Liveness only cares that we can reach the database, readiness also wants every background
+	// job to be keeping up. Both are left unlimited so a busy health checker never sees a 429.
+	handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, reloader.store.DB, reloader.tracker, reloader.Leading(), false)
+	}), get)
+	handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, reloader.store.DB, reloader.tracker, reloader.Leading(), true)
+	}), get)
+
 	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
 		// TODO: Properly set up text/template and what not
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintf(w, "User-agent: *\nDisallow: /")
 	})
 
-	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+	handle("/static/covers/{digest}", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		size, err := covers.ParseSize(r.URL.Query().Get("size"))
+		if err != nil {
+			return apierror.BadRequest(err.Error())
+		}
+		format := covers.Negotiate(r.Header.Get("Accept"))
+		// Covers are content addressed so a given URL will never change underneath anyone and
+		// we can answer a revalidation without going anywhere near storage
+		w.Header().Set("Cache-Control", "public, max-age=31622400, immutable")
+		w.Header().Set("Vary", "Accept")
+		if notModified(w, r, fmt.Sprintf(`"%s-%s-%s"`, r.PathValue("digest"), size, format)) {
+			return nil
+		}
+		image, err := covers.Load(ps.CoverStorage(cfg), r.PathValue("digest"), size, format)
+		if err != nil {
+			w.Header().Del("Cache-Control")
+			return apierror.NotFound("No cover exists with that digest")
+		}
+		// The WebP variant holds a JPEG whenever that came out smaller
+		w.Header().Set("Content-Type", http.DetectContentType(image))
+		w.Write(image)
+		return nil
+	}), get, limit(ratelimit.Static))
+
+	handle("/static/", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		cover := strings.ReplaceAll(r.URL.Path, "/static/", "")
 		// plex:track:8080643347135712210.jpeg
 		// translated into plex.track.<id>.jpeg internally as colons are valid in URIs but not all filesystems
 		coverSegments := strings.Split(cover, ".")
 		if len(coverSegments) != 4 {
 			slog.With(slog.String("cover", cover)).Error("Request for cover art with invalid segment length")
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return apierror.BadRequest("That doesn't look like a cover")
+		}
+		// Links to the old media ID based paths are still out there so we send them along to the processed cover
+		mediaID := fmt.Sprintf("%s:%s:%s", coverSegments[0], coverSegments[1], coverSegments[2])
+		if item, err := ps.GetMediaItemByID(mediaID); err == nil {
+			if digest, ok := covers.DigestFromURL(item.Image); ok {
+				target := covers.URL(digest)
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return nil
+			}
 		}
 		filename := fmt.Sprintf("%s.%s.%s", coverSegments[0], coverSegments[1], coverSegments[2])
 		extension := coverSegments[3]
-		image, err := utils.LoadCover(cfg, filename, extension)
+		image, err := utils.LoadCover(ps.CoverStorage(cfg), filename, extension)
 		if err != nil {
-			w.WriteHeader(http.StatusGone)
-			return
+			return apierror.New(http.StatusGone, "gone", "That cover is no longer available")
 		}
 		w.Header().Set("Cache-Control", "public, max-age=31622400")
+		if notModified(w, r, fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(image)))) {
+			return nil
+		}
 		w.Header().Set("Content-Type", fmt.Sprintf("image/%s", extension))
 		w.Write([]byte(image))
-	})
+		return nil
+	}), get, limit(ratelimit.Static))
 
 	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		renderJSONMessage(w, "This is the base of Gunslinger's various APIs")
@@ -96,35 +199,20 @@ func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.Playback
 
 	// Yes, this is garbage and doesn't deserve to be put in here
 	// It works for now though
-	mux.HandleFunc("/api/v4/readwise_ingest", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
+	handle("/api/v4/readwise_ingest", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		rwToken := cfg.Readwise.Token
 		if rwToken == "" {
-			json.NewEncoder(w).Encode(map[string]string{"error": "this endpoint is not properly configured"})
-			return
-		}
-
-		ingestSecret := cfg.Gunslinger.SuperSecretToken
-		if ingestSecret == "" {
-			json.NewEncoder(w).Encode(map[string]string{"error": "this endpoint is not properly configured"})
-			return
+			return apierror.NotConfigured("This endpoint is not properly configured")
 		}
 
-		qVal := r.URL.Query()
-
-		if qVal.Get("token") != ingestSecret {
-			json.NewEncoder(w).Encode(map[string]string{"error": "ingest secret was incorrect"})
-			return
-		}
-
-		url := qVal.Get("url")
+		url := r.URL.Query().Get("url")
 
 		if url == "" {
-			json.NewEncoder(w).Encode(map[string]string{"error": "url was not provided"})
-			return
+			return apierror.BadRequest("A url was not provided")
 		}
 
+		audit.Note(r.Context(), "saved %s", url)
+
 		payload := readerPayload{
 			URL:        url,
 			SavedUsing: "Gunslinger",
@@ -132,14 +220,12 @@ func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.Playback
 
 		data, err := json.Marshal(payload)
 		if err != nil {
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to marshal payload"})
-			return
+			return apierror.Internal("Failed to marshal payload", err)
 		}
 
 		req, err := http.NewRequest("POST", "https://readwise.io/api/v3/save/", bytes.NewReader(data))
 		if err != nil {
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to build request"})
-			return
+			return apierror.Internal("Failed to build request", err)
 		}
 
 		req.Header.Add("Authorization", fmt.Sprintf("Token %s", rwToken))
@@ -148,211 +234,245 @@ func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.Playback
 		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to send request"})
-			return
+			return apierror.BadGateway("Failed to send request to Readwise", err)
 		}
 		defer resp.Body.Close()
 
-		json.NewEncoder(w).Encode(map[string]string{"status": resp.Status})
-	})
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(map[string]string{"status": resp.Status})
+	}), limit(ratelimit.API), audited("readwise.ingest"), middleware.Methods(http.MethodGet, http.MethodPost), scope(auth.ScopeReadwiseIngest))
 
-	mux.HandleFunc("/api/v4/playing", func(w http.ResponseWriter, r *http.Request) {
+	handle("/api/v4/playing", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		w.Header().Set("Content-Type", "application/json")
-		if len(ps.State) == 0 {
+		// Clients poll this constantly so they're made to check in every time, which is cheap
+		// when nothing has changed since we only send back a 304
+		w.Header().Set("Cache-Control", "no-cache")
+		if notModified(w, r, stateETag(ps.Version())) {
+			return nil
+		}
+		active := ps.Active()
+		if len(active) == 0 {
 			// If nothing is playing, we'll return the most recent item
 			// TODO: Should return all that were playing? Maybe not
 			results, err := ps.GetHistory(1)
 			if err != nil {
-				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-				return
+				return apierror.Internal("Something went wrong trying to load playback", err)
 			}
 			if len(results) == 0 {
-				json.NewEncoder(w).Encode([]string{})
-				return
+				return json.NewEncoder(w).Encode([]string{})
 			}
 			for i, result := range results {
-				results[i].Image = "/static/" + strings.ReplaceAll(result.ID, ":", ".") + ".jpeg"
+				results[i].Image = publicCoverURL(result.ID, result.Image)
 			}
-			json.NewEncoder(w).Encode(results)
-			return
+			return json.NewEncoder(w).Encode(results)
 		}
-		mutatingState := ps.State
-		for i, result := range mutatingState {
-			mutatingState[i].Image = "/static/" + strings.ReplaceAll(result.ID, ":", ".") + ".jpeg"
+		for i, result := range active {
+			active[i].Image = publicCoverURL(result.ID, result.Image)
 		}
-		json.NewEncoder(w).Encode(mutatingState)
-	})
+		return json.NewEncoder(w).Encode(active)
+	}), get, limit(ratelimit.Public))
 
-	mux.HandleFunc("/api/v4/history", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		results, err := ps.GetHistory(7)
-		// If nothing is playing, the "now playing" will likely be the same as the
-		// first history item so we skip it if now playing and index 0 of history match.
-		// We don't fully do an offset jump though as an item is only committed to the DB
-		// when it changes to inactive so we don't want to hide a valid item in that state
+	handle("/api/v4/history", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return writeHistory(w, r, ps, 0)
+	}), get, limit(ratelimit.Public))
+
+	// Everyone's playback is mixed together above so these are for showing off just your own
+	handle("/u/{name}/playing", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := lookupUser(userStore, r.PathValue("name"))
 		if err != nil {
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if notModified(w, r, stateETag(ps.Version())) {
+			return nil
 		}
+		results := ps.ActiveForUser(user.ID)
 		if len(results) == 0 {
-			json.NewEncoder(w).Encode([]string{})
-			return
+			// Like /api/v4/playing, we fall back to whatever they finished last
+			results, _, err = ps.QueryHistory(playback.HistoryFilter{UserID: user.ID}, nil, 1)
+			if err != nil {
+				return apierror.Internal("Something went wrong trying to load playback", err)
+			}
+		}
+		if len(results) == 0 {
+			return json.NewEncoder(w).Encode([]string{})
 		}
 		for i, result := range results {
-			results[i].Image = "/static/" + strings.ReplaceAll(result.ID, ":", ".") + ".jpeg"
+			results[i].Image = publicCoverURL(result.ID, result.Image)
 		}
-		json.NewEncoder(w).Encode(results)
-	})
+		return json.NewEncoder(w).Encode(results)
+	}), get, limit(ratelimit.Public))
 
-	mux.HandleFunc("/api/v4/readwise/tags", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			renderJSONMessage(w, "This endpoint is misconfigured and can not be used currently")
-			return
+	handle("/u/{name}/history", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		user, err := lookupUser(userStore, r.PathValue("name"))
+		if err != nil {
+			return err
 		}
+		return writeHistory(w, r, ps, user.ID)
+	}), get, limit(ratelimit.Public))
+
+	handle("/api/v4/search", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
+		limit, err := parseLimit(qVal, defaultSearchLimit)
+		if err != nil {
+			return err
 		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
+		results, err := ps.SearchMediaItems(qVal.Get("q"), limit)
+		if err != nil {
+			return apierror.Internal("Something went wrong trying to search", err)
 		}
-		if r.Method != http.MethodGet {
-			renderJSONMessage(w, "That method is invalid for this endpoint")
-			return
+		w.Header().Set("Content-Type", "application/json")
+		if len(results) == 0 {
+			return json.NewEncoder(w).Encode([]string{})
+		}
+		return json.NewEncoder(w).Encode(results)
+	}), get, limit(ratelimit.Public))
+
+	handle("/api/v4/items/{id}", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		detail, err := ps.GetItemDetail(r.PathValue("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			return apierror.NotFound("No item exists with that ID")
 		}
-		tags, err := readwise.CountTags(cfg)
 		if err != nil {
-			renderJSONMessage(w, "Something went wrong trying to count tags")
-			return
+			return apierror.Internal("Something went wrong trying to load that item", err)
 		}
-		json.NewEncoder(w).Encode(tags)
-	})
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(detail)
+	}), get, limit(ratelimit.Public))
 
-	mux.HandleFunc("/api/v4/readwise/document_counts", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			renderJSONMessage(w, "This endpoint is misconfigured and can not be used currently")
+	// This one is a page for people rather than an API so errors are left as plain text
+	handle("/items/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		detail, err := ps.GetItemDetail(r.PathValue("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
 			return
 		}
-		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			renderJSONMessage(w, "Your request was not authorized")
+		if err != nil {
+			slog.Error("Failed to load item", slog.String("error", err.Error()))
+			http.Error(w, "Something went wrong trying to load that item", http.StatusInternalServerError)
 			return
 		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := itemPageTmpl.Execute(w, detail); err != nil {
+			slog.Error("Failed to render item page", slog.String("error", err.Error()))
 		}
-		if r.Method != http.MethodGet {
-			renderJSONMessage(w, "That method is invalid for this endpoint")
-			return
+	}), get, limit(ratelimit.Public))
+
+	handle("/api/v4/readwise/tags", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		tags, err := readwise.CountTags(cfg)
+		if err != nil {
+			return apierror.BadGateway("Something went wrong trying to count tags", err)
 		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(tags)
+	}), get, limit(ratelimit.API), scope(auth.ScopeAdmin))
+
+	handle("/api/v4/readwise/document_counts", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		documentCounts, err := readwise.GetDocumentCounts(cfg)
 		if err != nil {
-			renderJSONMessage(w, "Something went wrong trying to count documents")
-			return
+			return apierror.BadGateway("Something went wrong trying to count documents", err)
 		}
-		json.NewEncoder(w).Encode(documentCounts)
-	})
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(documentCounts)
+	}), get, limit(ratelimit.API), scope(auth.ScopeAdmin))
 
-	mux.HandleFunc("/api/v4/item", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			renderJSONMessage(w, "This endpoint is misconfigured and can not be used currently")
-			return
-		}
+	handle("/api/v4/item", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
-		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
-		}
-		if r.Method != http.MethodDelete {
-			renderJSONMessage(w, "That method is invalid for this endpoint")
-			return
-		}
 		if !qVal.Has("playback_id") {
-			renderJSONMessage(w, "An ID did not appear to be provided")
-			return
+			return apierror.BadRequest("An ID did not appear to be provided")
 		}
 		playback_id, err := strconv.ParseInt(qVal.Get("playback_id"), 10, 0)
 		if err != nil {
-			renderJSONMessage(w, "That ID could not be converted into an integer")
-			return
+			return apierror.BadRequest("That ID could not be converted into an integer")
 		}
+		audit.Note(r.Context(), "playback entry %d", playback_id)
 		if err := ps.DeleteItem(int(playback_id)); err != nil {
-			renderJSONMessage(w, "Something went wrong trying to delete that item")
-			return
+			return apierror.Internal("Something went wrong trying to delete that item", err)
 		}
 		renderJSONMessage(w, "Operation was successfully executed")
-	})
+		return nil
+	}), limit(ratelimit.API), audited("playback.delete"), middleware.Methods(http.MethodDelete), scope(auth.ScopeDelete), writable)
 
-	mux.HandleFunc("/beeminder/oias", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			renderJSONMessage(w, "This endpoint is misconfigured and can not be used currently")
-			return
+	handle("/api/v4/import", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		format, err := importer.ParseFormat(r.FormValue("format"))
+		if err != nil {
+			return apierror.BadRequest(err.Error())
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return apierror.BadRequest("An export file did not appear to be provided")
+		}
+		defer file.Close()
+		audit.Note(r.Context(), "%s export", format)
+		summary, err := importer.Import(cfg, ps, format, file, importer.Options{FetchCovers: r.FormValue("covers") == "true"})
+		if err != nil {
+			return apierror.Internal("Something went wrong trying to import that file", err)
 		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(summary)
+	}), limit(ratelimit.API), audited("playback.import"), post, scope(auth.ScopeWritePlayback), writable)
+
+	handle("/api/v4/export", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
+		format, err := export.ParseFormat(qVal.Get("format"))
+		if err != nil {
+			return apierror.BadRequest(err.Error())
 		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
+		filter, err := playback.ParseHistoryFilter(qVal)
+		if err != nil {
+			return apierror.BadRequest(err.Error())
 		}
-		if r.Method != http.MethodPost {
-			renderJSONMessage(w, "That method is invalid for this endpoint")
-			return
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", format.Filename()))
+		// Headers are already sent by the time anything goes wrong so all we can do is log it
+		if err := export.Write(cfg, ps, format, filter, w); err != nil {
+			slog.Error("Failed to export history", slog.String("error", err.Error()))
 		}
+		return nil
+	}), get, limit(ratelimit.API), scope(auth.ScopeReadHistory))
+
+	handle("/beeminder/oias", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		doc, err := htmlquery.LoadURL("https://fyi.org.nz/categorise/play")
 		if err != nil {
-			panic(err)
+			return apierror.BadGateway("Failed to load the categorisation leaderboard", err)
 		}
 		topLeaders := htmlquery.FindOne(doc, "//body/div[1]/div[4]/div/div[1]/div[1]/table[2]")
+		if topLeaders == nil {
+			return apierror.BadGateway("Failed to find the categorisation leaderboard", nil)
+		}
 		match := requestsRe.FindAllStringSubmatch(htmlquery.InnerText(topLeaders), -1)
+		if len(match) == 0 {
+			return apierror.BadGateway("Failed to find a request count on the leaderboard", nil)
+		}
 		matchCount := match[0][1]
-		err = beeminder.SubmitDatapoint(cfg, "oiacategorisation", matchCount, fmt.Sprintf("%s requests categorised", matchCount))
+		account, err := ownerAccount(cfg, userStore, users.Beeminder)
 		if err != nil {
-			w.WriteHeader(422)
+			return err
 		}
-		w.WriteHeader(200)
-	})
+		err = beeminder.SubmitDatapoint(cfg, account, "oiacategorisation", matchCount, fmt.Sprintf("%s requests categorised", matchCount))
+		if err != nil {
+			return apierror.BadGateway("Failed to submit datapoint to Beeminder", err)
+		}
+		audit.Note(r.Context(), "%s requests categorised", matchCount)
+		renderJSONMessage(w, fmt.Sprintf("Submitted %s requests categorised", matchCount))
+		return nil
+	}), limit(ratelimit.API), audited("beeminder.submit"), post, scope(auth.ScopeAdmin))
 
-	mux.HandleFunc("/events", events.Server.ServeHTTP)
+	handle("/events", http.HandlerFunc(events.Server.ServeHTTP), limit(ratelimit.Events))
 
 	mux.HandleFunc("/glance", func(w http.ResponseWriter, r *http.Request) {
 		renderJSONMessage(w, "This is the glance endpoint of the API")
 	})
 
-	mux.HandleFunc("/glance/beeminder", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Widget-Title", "Beeminder")
-		w.Header().Set("Widget-Content-Type", "html")
-		w.Header().Set("Content-Type", "text/html")
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			w.Write([]byte("This endpoint is misconfigured and can not be used currently"))
-			return
-		}
-		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			w.Write([]byte("Your request was not authorized"))
-			return
-		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			w.Write([]byte("Your request was not authorized"))
-			return
-		}
-		if r.Method != http.MethodGet {
-			w.Write([]byte("That method is invalid for this endpoint"))
-			return
+	handle("/glance/beeminder", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		account, err := ownerAccount(cfg, userStore, users.Beeminder)
+		if err != nil {
+			return err
 		}
-		goals, err := beeminder.FetchGoals(cfg)
+		goals, err := beeminder.FetchGoals(cfg, account)
 		if err != nil {
-			w.Write([]byte("Something went wrong trying to fetch Beeminder goals"))
-			return
+			return apierror.BadGateway("Something went wrong trying to fetch Beeminder goals", err)
 		}
 		resp := `<ul class="list collapsible-container" data-collapse-after="5">`
 		for _, goal := range goals {
@@ -369,7 +489,7 @@ func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.Playback
 			if goal.RoadStatusColor == "green" {
 				colorClass = "color-subdue"
 			}
-			goalUrl := fmt.Sprintf("https://www.beeminder.com/utf9k/%s", goal.Slug)
+			goalUrl := fmt.Sprintf("https://www.beeminder.com/%s/%s", account.Identity, goal.Slug)
 			resp += `<li><div class="flex gap-10 row-reverse-on-mobile thumbnail-parent">`
 			resp += fmt.Sprintf(`<a href="%s"><img class="forum-post-list-thumbnail thumbnail loaded finished-transition" src="%s" loading="lazy"></a>`, goal.GraphUrl, goal.ThumbUrl)
 			resp += fmt.Sprintf(`<div class="grow min-width-0"><a class="size-title-dynamic %s" href="%s" target="_blank" rel="noreferrer">%s</a>`, colorClass, goalUrl, goal.Slug)
@@ -377,62 +497,209 @@ func RegisterRoutes(mux *http.ServeMux, cfg config.Config, ps *playback.Playback
 			resp += `</div></div></li>`
 		}
 		resp += `</ul>`
+		w.Header().Set("Widget-Title", "Beeminder")
+		w.Header().Set("Widget-Content-Type", "html")
+		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(resp))
-	})
+		return nil
+	}), get, limit(ratelimit.API), scope(auth.ScopeAdmin))
 
-	mux.HandleFunc("/obsidian-web-clipper/kagi-summarizer", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.Gunslinger.SuperSecretToken == "" {
-			renderJSONMessage(w, "This endpoint is misconfigured and can not be used currently")
-			return
-		}
-		qVal := r.URL.Query()
-		if !qVal.Has("token") {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
-		}
-		if qVal.Get("token") != cfg.Gunslinger.SuperSecretToken {
-			renderJSONMessage(w, "Your request was not authorized")
-			return
-		}
-		if r.Method != http.MethodPost {
-			renderJSONMessage(w, "That method is invalid for this endpoint")
-			return
-		}
+	handle("/obsidian-web-clipper/kagi-summarizer", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
 		url, err := obsidian.ExtractURLFromWebClipperRequest(r)
 		if err != nil {
-			slog.Error("Failed to extract URL from web clipper request", slog.String("error", err.Error()))
-			w.WriteHeader(500)
-			renderJSONMessage(w, err.Error())
-			return
+			return apierror.BadRequest(err.Error())
 		}
 		slog.Debug("Received Kagi summarization request", slog.String("url", url))
+		audit.Note(r.Context(), "summarized %s", url)
 		summary, err := kagi.SummarizeURL(cfg, url)
 		if err != nil {
-			slog.Error("Failed to summarize URL via Kagi", slog.String("error", err.Error()))
-			w.WriteHeader(500)
-			renderJSONMessage(w, err.Error())
-			return
+			return apierror.BadGateway("Failed to summarize URL via Kagi", err)
 		}
-		res := obsidian.FormatWebClipperResponse(summary)
-		b, _ := json.Marshal(res)
-		w.WriteHeader(200)
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
-	})
+		return json.NewEncoder(w).Encode(obsidian.FormatWebClipperResponse(summary))
+	}), limit(ratelimit.API), audited("kagi.summarize"), post, scope(auth.ScopeAdmin))
 
-	debugHandler := debug.NewHandler(cfg, ps, store)
-	mux.HandleFunc("/debug", debugHandler.ServeDebugPage)
-	mux.HandleFunc("/oauth/reauth", debugHandler.ServeReauth)
-	mux.HandleFunc("/oauth/spotify/callback", debugHandler.ServeOAuthCallback)
-	mux.HandleFunc("/oauth/trakt/callback", debugHandler.ServeOAuthCallback)
+	handle("/api/v4/audit", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		qVal := r.URL.Query()
+		format, err := export.ParseFormat(qVal.Get("format"))
+		if err != nil {
+			return apierror.BadRequest(err.Error())
+		}
+		if format == export.Bundle {
+			return apierror.BadRequest("The audit log can only be exported as csv or jsonl")
+		}
+		var since time.Time
+		if qVal.Has("since") {
+			if since, err = time.Parse(time.DateOnly, qVal.Get("since")); err != nil {
+				return apierror.BadRequest("since must be a date like 2006-01-02")
+			}
+		}
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "gunslinger-audit-"+time.Now().Format(time.DateOnly)+"."+string(format)))
+		if err := auditLog.Write(format, since, w); err != nil {
+			slog.Error("Failed to export audit log", slog.String("error", err.Error()))
+		}
+		return nil
+	}), limit(ratelimit.API), audited("audit.export"), get, scope(auth.ScopeAdmin))
+
+	handle("/api/v4/reload", apierror.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		result, err := reloader.Reload()
+		if err != nil {
+			return apierror.BadRequest("Failed to reload config: " + err.Error())
+		}
+		audit.Note(r.Context(), "changed %s", strings.Join(result.Changed, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(result)
+	}), limit(ratelimit.API), audited("config.reload"), post, scope(auth.ScopeAdmin))
+
+	debugHandler := debug.NewHandler(cfg, ps, store, authorizer, keys, auditLog, reloader.tracker)
+	handle("/debug", http.HandlerFunc(debugHandler.ServeDebugPage), limit(ratelimit.API), audited("debug.view"))
+	handle("/debug/audit", http.HandlerFunc(debugHandler.ServeAuditExport), limit(ratelimit.API), audited("audit.export"), get)
+	handle("/debug/keys", http.HandlerFunc(debugHandler.ServeKeys), limit(ratelimit.API), audited("keys.manage"), writable)
+	handle("/debug/vars", expvar.Handler(), limit(ratelimit.API), audited("debug.vars"), get, scope(auth.ScopeAdmin))
+	handle("/oauth/reauth", http.HandlerFunc(debugHandler.ServeReauth), limit(ratelimit.API), audited("oauth.reauth"), writable)
+	handle("/oauth/spotify/callback", http.HandlerFunc(debugHandler.ServeOAuthCallback), limit(ratelimit.API), audited("oauth.callback"), writable)
+	handle("/oauth/trakt/callback", http.HandlerFunc(debugHandler.ServeOAuthCallback), limit(ratelimit.API), audited("oauth.callback"), writable)
 
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"https://utf9k.net", "http://localhost:1313", "https://b.utf9k.net", "https://next.utf9k.net"},
+		AllowedOrigins: corsOrigins(cfg),
 		AllowedMethods: []string{"GET"},
-		AllowedHeaders: []string{"Origin, Content-Type, Accept"},
+		AllowedHeaders: []string{"Origin, Content-Type, Accept", "If-None-Match", "Authorization"},
+		ExposedHeaders: []string{"X-Next-Cursor", "ETag", "Retry-After", apierror.RequestIDHeader},
 	})
 
-	handler := c.Handler(mux)
+	// Request IDs come first so everything after, including the logs, can refer to them
+	return middleware.Chain(c.Handler(mux), middleware.RequestID, middleware.Logger, middleware.Recover), nil
+}
+
+var defaultCORSOrigins = []string{"https://utf9k.net", "http://localhost:1313", "https://b.utf9k.net", "https://next.utf9k.net"}
+
+func corsOrigins(cfg config.Config) []string {
+	if cfg.Gunslinger.CORSOrigins == "" {
+		return defaultCORSOrigins
+	}
+	origins := []string{}
+	for _, origin := range strings.Split(cfg.Gunslinger.CORSOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// writeHistory serves a page of history, for just one user if userID is set
+func writeHistory(w http.ResponseWriter, r *http.Request, ps *playback.PlaybackSystem, userID int64) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if notModified(w, r, stateETag(ps.Version())) {
+		return nil
+	}
+	qVal := r.URL.Query()
+	filter, err := playback.ParseHistoryFilter(qVal)
+	if err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	filter.UserID = userID
+	limit, err := parseLimit(qVal, defaultHistoryLimit)
+	if err != nil {
+		return err
+	}
+	var after *playback.HistoryCursor
+	if qVal.Has("cursor") {
+		cursor, err := playback.ParseHistoryCursor(qVal.Get("cursor"))
+		if err != nil {
+			return apierror.BadRequest(err.Error())
+		}
+		after = &cursor
+	}
+	results, next, err := ps.QueryHistory(filter, after, limit)
+	// If nothing is playing, the "now playing" will likely be the same as the
+	// first history item so we skip it if now playing and index 0 of history match.
+	// We don't fully do an offset jump though as an item is only committed to the DB
+	// when it changes to inactive so we don't want to hide a valid item in that state
+	if err != nil {
+		return apierror.Internal("Something went wrong trying to load history", err)
+	}
+	// The body stays a plain array for older clients so the next page is advertised in a header
+	if next != nil {
+		w.Header().Set("X-Next-Cursor", next.String())
+	}
+	if len(results) == 0 {
+		return json.NewEncoder(w).Encode([]string{})
+	}
+	for i, result := range results {
+		results[i].Image = publicCoverURL(result.ID, result.Image)
+	}
+	return json.NewEncoder(w).Encode(results)
+}
+
+type healthReport struct {
+	Status   string       `json:"status"`
+	Database string       `json:"database"`
+	Leader   bool         `json:"leader"`
+	Jobs     []health.Job `json:"jobs"`
+}
+
+// writeHealth reports on the database and background jobs. Unhealthy jobs only count against
+// us when checking readiness, otherwise they just mark us as degraded.
+func writeHealth(w http.ResponseWriter, r *http.Request, database *sqlx.DB, tracker *health.Tracker, leader bool, readiness bool) {
+	report := healthReport{Status: "ok", Database: "ok", Leader: leader, Jobs: tracker.Jobs()}
+	code := http.StatusOK
+	// Errors can include upstream URLs with tokens in them so they're kept to the debug page
+	for i := range report.Jobs {
+		report.Jobs[i].LastError = ""
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := database.PingContext(ctx); err != nil {
+		slog.Error("Health check failed to reach the database", slog.String("error", err.Error()))
+		report.Status, report.Database = "unavailable", "unreachable"
+		code = http.StatusServiceUnavailable
+	} else if len(tracker.Unhealthy()) > 0 {
+		report.Status = "degraded"
+		if readiness {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+func lookupUser(userStore *users.Store, name string) (users.User, error) {
+	user, err := userStore.ByName(name)
+	if errors.Is(err, users.ErrUserNotFound) {
+		return user, apierror.NotFound("No user exists with that name")
+	}
+	if err != nil {
+		return user, apierror.Internal("Something went wrong trying to find that user", err)
+	}
+	return user, nil
+}
+
+// ownerAccount is for the endpoints that only make sense for whoever runs the instance
+func ownerAccount(cfg config.Config, userStore *users.Store, source string) (users.Account, error) {
+	account, err := userStore.Account(cfg, models.OwnerUserID, source)
+	if errors.Is(err, users.ErrAccountNotFound) {
+		return account, apierror.NotConfigured(fmt.Sprintf("No %s account has been set up", source))
+	}
+	if err != nil {
+		return account, apierror.Internal("Something went wrong trying to load account details", err)
+	}
+	return account, nil
+}
 
-	return handler
+// parseLimit reads an optional ?limit= for endpoints that return a list
+func parseLimit(qVal url.Values, fallback int) (int, error) {
+	if !qVal.Has("limit") {
+		return fallback, nil
+	}
+	limit, err := strconv.Atoi(qVal.Get("limit"))
+	if err != nil || limit <= 0 || limit > maxHistoryLimit {
+		return 0, apierror.BadRequest(fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit))
+	}
+	return limit, nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/marcus-crane/gunslinger/events"
+	"github.com/marcus-crane/gunslinger/lease"
+	"github.com/marcus-crane/gunslinger/playback"
+)
+
+const (
+	// fly gives us kill_timeout (5s) after the signal before it pulls the plug
+	shutdownTimeout = 4 * time.Second
+	// Browsers wait this long before reconnecting to /events, by which point we should be back
+	reconnectAfter = 10 * time.Second
+	// Another instance can take over background jobs this long after we stop renewing our lease
+	leaseTTL = 30 * time.Second
+)
+
+// shutdown winds everything down in order so that nothing is left writing to the database
+// once it's closed
+func shutdown(ctx context.Context, server *http.Server, reloader *Reloader, leader *lease.Lease, ps *playback.PlaybackSystem, db *sqlx.DB) error {
+	var errs []error
+
+	// Shutdown stops taking new requests straight away but waits for everything in flight,
+	// which event streams never are, so we hang up on them while it waits
+	served := make(chan error, 1)
+	go func() { served <- server.Shutdown(ctx) }()
+	events.Drain(reconnectAfter)
+	if err := <-served; err != nil {
+		errs = append(errs, fmt.Errorf("failed to stop serving: %w", err))
+	}
+
+	if err := reloader.Stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to stop background jobs: %w", err))
+	}
+	// Playback belongs to whoever holds the lease so we leave it alone otherwise
+	if reloader.Leading() {
+		if err := ps.Checkpoint(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to checkpoint playback: %w", err))
+		}
+	}
+	// Letting go means whoever's next doesn't have to wait for the lease to expire
+	if err := leader.Release(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to release the lease: %w", err))
+	}
+	if err := db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close the database: %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Info("Shut down cleanly")
+	return nil
+}
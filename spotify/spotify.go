@@ -77,14 +77,10 @@ type Client struct {
 	mu           sync.Mutex
 }
 
-func SetupSpotifyPoller(cfg config.Config, ps *playback.PlaybackSystem, store db.Store) {
-	var client *Client
-	var err error
-
-	redirectUri := cfg.Spotify.RedirectUri
-
-	if redirectUri == "" {
-		panic("Empty redirect URI configured")
+// SetupSpotifyPoller follows along with Spotify Connect until ctx is cancelled
+func SetupSpotifyPoller(ctx context.Context, cfg config.Config, ps *playback.PlaybackSystem, store db.Store) error {
+	if cfg.Spotify.RedirectUri == "" {
+		return fmt.Errorf("empty redirect URI configured")
 	}
 
 	accessToken := store.GetTokenByID(accessTokenID)
@@ -92,52 +88,45 @@ func SetupSpotifyPoller(cfg config.Config, ps *playback.PlaybackSystem, store db
 
 	if accessToken == "" || refreshToken == "" {
 		// Locally support using oauth instead of having a token (for server side)
-		token, err := performOAuth2Flow(cfg, 8081)
+		token, err := performOAuth2Flow(ctx, cfg, 8081)
 		if err != nil {
-			slog.With("error", err).Error("failed to generate access tokens")
-		}
-		// Save our newly generated token
-		if err := store.UpsertToken(accessTokenID, token.AccessToken); err != nil {
-			slog.With("error", err).Error("failed to save access token")
-		}
-		if err := store.UpsertToken(refreshTokenID, token.RefreshToken); err != nil {
-			slog.With("error", err).Error("failed to save refresh token")
-		}
-		if err := store.UpsertTokenMetadata(accessTokenID, token.CreatedAt, token.ExpiresIn); err != nil {
-			slog.With("error", err).Error("failed to save access token metadata")
+			return fmt.Errorf("failed to generate access tokens: %w", err)
 		}
+		saveToken(store, token)
 		accessToken = token.AccessToken
 		refreshToken = token.RefreshToken
 	}
 
-	client, err = NewClient(cfg, store, accessToken, refreshToken)
+	client, err := NewClient(ctx, cfg, store, accessToken, refreshToken)
 	if err != nil {
 		// we'll try oauth (which will ping my phone + let me auth remote) and see if we make it in time otherwise we'll need manual intervention
-		// also this should be made less repetitive but whatever
-		token, err := performOAuth2Flow(cfg, 8081)
+		token, err := performOAuth2Flow(ctx, cfg, 8081)
 		if err != nil {
-			slog.With("error", err).Error("failed to perform oauth flow as fallback")
-			return
+			return fmt.Errorf("failed to perform oauth flow as fallback: %w", err)
 		}
-		if err := store.UpsertToken(accessTokenID, token.AccessToken); err != nil {
-			slog.With("error", err).Error("failed to save access token")
-		}
-		if err := store.UpsertToken(refreshTokenID, token.RefreshToken); err != nil {
-			slog.With("error", err).Error("failed to save refresh token")
-		}
-		if err := store.UpsertTokenMetadata(accessTokenID, token.CreatedAt, token.ExpiresIn); err != nil {
-			slog.With("error", err).Error("failed to save access token metadata")
-		}
-		client, err = NewClient(cfg, store, accessToken, refreshToken)
+		saveToken(store, token)
+		client, err = NewClient(ctx, cfg, store, token.AccessToken, token.RefreshToken)
 		if err != nil {
-			slog.With("error", err).Error("failed to create spotify client and fallback to oauth")
-			return
+			return fmt.Errorf("failed to create spotify client and fallback to oauth: %w", err)
 		}
 	}
-	client.Run(ps)
+	client.Run(ctx, ps)
+	return nil
+}
+
+func saveToken(store db.Store, token *shared.TokenResponse) {
+	if err := store.UpsertToken(accessTokenID, token.AccessToken); err != nil {
+		slog.With("error", err).Error("failed to save access token")
+	}
+	if err := store.UpsertToken(refreshTokenID, token.RefreshToken); err != nil {
+		slog.With("error", err).Error("failed to save refresh token")
+	}
+	if err := store.UpsertTokenMetadata(accessTokenID, token.CreatedAt, token.ExpiresIn); err != nil {
+		slog.With("error", err).Error("failed to save access token metadata")
+	}
 }
 
-func NewClient(cfg config.Config, store db.Store, accessToken, refreshToken string) (*Client, error) {
+func NewClient(ctx context.Context, cfg config.Config, store db.Store, accessToken, refreshToken string) (*Client, error) {
 	librespotLogger := &SlogAdapter{slog.Default()}
 	opts := &session.Options{
 		DeviceType: devicespb.DeviceType_SMARTWATCH,
@@ -149,7 +138,7 @@ func NewClient(cfg config.Config, store db.Store, accessToken, refreshToken stri
 		},
 	}
 
-	sess, err := session.NewSessionFromOptions(context.Background(), opts)
+	sess, err := session.NewSessionFromOptions(ctx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %v", err)
 	}
@@ -164,22 +153,25 @@ func NewClient(cfg config.Config, store db.Store, accessToken, refreshToken stri
 		tokenExpiry:  time.Now().Add(time.Hour), // default is 1 hour
 	}
 
-	go client.tokenRefreshLoop(store)
+	go client.tokenRefreshLoop(ctx, store)
 
 	return client, nil
 }
 
-func performOAuth2Flow(cfg config.Config, port int) (*shared.TokenResponse, error) {
+// performOAuth2Flow waits for us to sign in again on a listener of its own. It can run more than once
+// in the same process, as Spotify restarts on reloads, so nothing is registered globally and the
+// listener is shut down once we're done or ctx is cancelled.
+func performOAuth2Flow(ctx context.Context, cfg config.Config, port int) (*shared.TokenResponse, error) {
 	state := shared.GenerateRandomString(16)
-	ch := make(chan *shared.TokenResponse)
-	var srv *http.Server
+	ch := make(chan *shared.TokenResponse, 1)
 
 	pushoverApp := pushover.New(cfg.Pushover.Token)
 	recipient := pushover.NewRecipient(cfg.Pushover.Recipient)
 
 	// TODO: Ideally integrate with existing router to make life easier + support
 	// possibly oauth refreshing server side (for bootstrapping)
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Query().Get("state") != state {
 			http.Error(w, "State mismatch", http.StatusBadRequest)
 			return
@@ -190,16 +182,22 @@ func performOAuth2Flow(cfg config.Config, port int) (*shared.TokenResponse, erro
 			http.Error(w, "Error exchanging code for token", http.StatusInternalServerError)
 			return
 		}
-		ch <- token
+		select {
+		case ch <- token:
+		default:
+			// Someone beat us to it
+		}
 		fmt.Fprintf(w, "Authentication successful! You can close this window.")
-		go func() {
-			time.Sleep(time.Second)
-			srv.Shutdown(r.Context())
-		}()
 	})
 
-	srv = &http.Server{Addr: fmt.Sprintf(":%d", port)}
-	go func() { _ = srv.ListenAndServe() }()
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	listening := make(chan error, 1)
+	go func() { listening <- srv.ListenAndServe() }()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
 
 	// TODO: Extend when fetching initial state via API
 	scopes := []string{
@@ -222,11 +220,17 @@ func performOAuth2Flow(cfg config.Config, port int) (*shared.TokenResponse, erro
 	_, err := pushoverApp.SendMessage(message, recipient)
 	if err != nil {
 		slog.Error("Failed to send Pushover notification for Spotify auth", slog.String("error", err.Error()))
-		return &shared.TokenResponse{}, fmt.Errorf("failed to notify about oauth request")
+		return nil, fmt.Errorf("failed to notify about oauth request")
 	}
 
-	token := <-ch
-	return token, nil
+	select {
+	case token := <-ch:
+		return token, nil
+	case err := <-listening:
+		return nil, fmt.Errorf("failed to listen for oauth callback: %w", err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func ExchangeCodeForToken(cfg config.Config, code string) (*shared.TokenResponse, error) {
@@ -307,7 +311,7 @@ func (c *Client) refreshTokens() (int64, error) {
 	return newTokens.ExpiresIn, nil
 }
 
-func (c *Client) tokenRefreshLoop(store db.Store) {
+func (c *Client) tokenRefreshLoop(ctx context.Context, store db.Store) {
 	for {
 		c.mu.Lock()
 		timeUntilExpiry := time.Until(c.tokenExpiry)
@@ -318,7 +322,7 @@ func (c *Client) tokenRefreshLoop(store db.Store) {
 			refreshedTokens := false
 			if expiry, err := c.refreshTokens(); err != nil {
 				slog.Error("Failed to refresh token", slog.String("error", err.Error()))
-				if expiry, err := c.reauthenticate(); err != nil {
+				if expiry, err := c.reauthenticate(ctx); err != nil {
 					slog.Error("Failed to reauthenticate", slog.String("error", err.Error()))
 				} else {
 					refreshedTokens = true
@@ -342,12 +346,16 @@ func (c *Client) tokenRefreshLoop(store db.Store) {
 			}
 		}
 
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
 	}
 }
 
-func (c *Client) reauthenticate() (int64, error) {
-	token, err := performOAuth2Flow(c.cfg, 8888)
+func (c *Client) reauthenticate(ctx context.Context) (int64, error) {
+	token, err := performOAuth2Flow(ctx, c.cfg, 8888)
 	if err != nil {
 		return 0, fmt.Errorf("failed to reauthenticate: %v", err)
 	}
@@ -383,8 +391,8 @@ func (c *Client) reauthenticate() (int64, error) {
 	return token.ExpiresIn, nil
 }
 
-func (c *Client) Run(ps *playback.PlaybackSystem) {
-	if err := c.sess.Dealer().Connect(context.TODO()); err != nil {
+func (c *Client) Run(ctx context.Context, ps *playback.PlaybackSystem) {
+	if err := c.sess.Dealer().Connect(ctx); err != nil {
 		slog.With(slog.String("error", err.Error())).Error("Failed to connect to dealer")
 	}
 	apRecv := c.sess.Accesspoint().Receive(ap.PacketTypeProductInfo, ap.PacketTypeCountryCode)
@@ -411,6 +419,10 @@ func (c *Client) Run(ps *playback.PlaybackSystem) {
 			c.handleMessage(msg, ps)
 		case req := <-reqRecv:
 			c.handleDealerRequest(req, ps)
+		case <-ctx.Done():
+			_ = s.Shutdown()
+			c.sess.Close()
+			return
 		}
 	}
 }
@@ -622,7 +634,7 @@ func (c *Client) handleMessage(msg dealer.Message, ps *playback.PlaybackSystem)
 		ps.DeactivateBySource(string(playback.Spotify))
 
 		hash := playback.GenerateMediaID(&update)
-		coverUrl, domColours, err := ps.ResolveCover(c.cfg, hash, c.prodInfo.ImageUrl(coverId))
+		cover, err := ps.ResolveCover(c.cfg, hash, c.prodInfo.ImageUrl(coverId))
 		if err != nil {
 			slog.Error("Failed to resolve cover for Spotify",
 				slog.String("error", err.Error()),
@@ -630,8 +642,7 @@ func (c *Client) handleMessage(msg dealer.Message, ps *playback.PlaybackSystem)
 			)
 			return
 		}
-		update.MediaItem.Image = coverUrl
-		update.MediaItem.DominantColours = domColours
+		cover.ApplyTo(&update.MediaItem)
 
 		if err := ps.UpdatePlaybackState(update); err != nil {
 			slog.Error("Failed to save Spotify update",
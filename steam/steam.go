@@ -4,16 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 
 	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/playback"
+	"github.com/marcus-crane/gunslinger/users"
 	"github.com/marcus-crane/gunslinger/utils"
 )
 
 var (
-	profileEndpoint    = "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v0002/?key=%s&steamids=76561197999386785"
+	profileEndpoint    = "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v0002/?key=%s&steamids=%s"
 	gameDetailEndpoint = "https://store.steampowered.com/api/appdetails?appids=%s"
 )
 
@@ -41,15 +41,12 @@ type SteamAppDetail struct {
 	Developers  []string `json:"developers"`
 }
 
-func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client) {
-	playingUrl := fmt.Sprintf(profileEndpoint, cfg.Steam.Token)
+func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, account users.Account) error {
+	playingUrl := fmt.Sprintf(profileEndpoint, account.CredentialOr(cfg.Steam.Token), account.Identity)
 
 	req, err := http.NewRequest("GET", playingUrl, nil)
 	if err != nil {
-		slog.Error("Failed to prepare Steam request",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to prepare Steam request: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":       []string{"application/json"},
@@ -58,49 +55,37 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		slog.Error("Failed to contact Steam for updates",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to contact Steam for updates: %w", err)
 	}
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		slog.Error("Failed to read Steam response",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to read Steam response: %w", err)
 	}
 	var steamResponse SteamPlayerSummary
 
 	if err = json.Unmarshal(body, &steamResponse); err != nil {
-		slog.Error("Error fetching Steam data",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("error fetching Steam data: %w", err)
 	}
 
 	if len(steamResponse.Response.Players) == 0 {
-		ps.DeactivateBySource(string(playback.Steam))
-		return
+		ps.DeactivateUserSource(account.UserID, string(playback.Steam))
+		return nil
 	}
 
 	gameId := steamResponse.Response.Players[0].GameID
 
 	if gameId == "" {
-		ps.DeactivateBySource(string(playback.Steam))
-		return
+		ps.DeactivateUserSource(account.UserID, string(playback.Steam))
+		return nil
 	}
 
 	gameDetailUrl := fmt.Sprintf(gameDetailEndpoint, gameId)
 
 	req, err = http.NewRequest("GET", gameDetailUrl, nil)
 	if err != nil {
-		slog.Error("Failed to prepare Steam request for more detail",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to prepare Steam request for more detail: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":       []string{"application/json"},
@@ -109,26 +94,18 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	}
 	res, err = client.Do(req)
 	if err != nil {
-		slog.Error("Failed to read Steam detail response",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to read Steam detail response: %w", err)
 	}
 	defer res.Body.Close()
 
 	body, err = io.ReadAll(res.Body)
 	if err != nil {
-		slog.Error("Failed to read Steam detail response",
-			slog.String("error", err.Error()),
-		)
-		return
+		return fmt.Errorf("failed to read Steam detail response: %w", err)
 	}
 	var gameDetailResponse map[string]SteamAppResponse
 
 	if err = json.Unmarshal(body, &gameDetailResponse); err != nil {
-		slog.Error("Error fetching Steam app data",
-			slog.String("error", err.Error()),
-		)
+		return fmt.Errorf("error fetching Steam app data: %w", err)
 	}
 
 	game := gameDetailResponse[gameId].Data
@@ -148,23 +125,18 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 			Source:   string(playback.Steam),
 		},
 		Status: playback.StatusPlaying,
+		UserID: account.UserID,
 	}
 
 	hash := playback.GenerateMediaID(&update)
-	coverUrl, domColours, err := ps.ResolveCover(cfg, hash, game.HeaderImage)
+	cover, err := ps.ResolveCover(cfg, hash, game.HeaderImage)
 	if err != nil {
-		slog.Error("Failed to resolve cover for Steam",
-			slog.String("error", err.Error()),
-			slog.String("title", update.MediaItem.Title),
-		)
-		return
+		return fmt.Errorf("failed to resolve cover for Steam (%s): %w", update.MediaItem.Title, err)
 	}
-	update.MediaItem.Image = coverUrl
-	update.MediaItem.DominantColours = domColours
+	cover.ApplyTo(&update.MediaItem)
 
 	if err := ps.UpdatePlaybackState(update); err != nil {
-		slog.Error("Failed to save Steam update",
-			slog.String("error", err.Error()),
-			slog.String("title", update.MediaItem.Title))
+		return fmt.Errorf("failed to save Steam update (%s): %w", update.MediaItem.Title, err)
 	}
+	return nil
 }
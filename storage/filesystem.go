@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Filesystem keeps objects as plain files underneath a root directory
+type Filesystem struct {
+	Root string
+}
+
+func (f Filesystem) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(f.Root, cleaned), nil
+}
+
+// Put writes to a temporary file first and renames it into place so readers never see half an object
+func (f Filesystem) Put(key string, content []byte) error {
+	location, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(location), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), location)
+}
+
+func (f Filesystem) Get(key string) ([]byte, error) {
+	location, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return content, err
+}
+
+func (f Filesystem) Exists(key string) (bool, error) {
+	location, err := f.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (f Filesystem) Modified(key string) (time.Time, error) {
+	location, err := f.path(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (f Filesystem) Delete(key string) error {
+	location, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(location); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f Filesystem) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(f.Root, func(location string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip over anything still being written
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(f.Root, location)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
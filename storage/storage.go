@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marcus-crane/gunslinger/config"
+)
+
+const (
+	FilesystemBackend = "filesystem"
+	S3Backend         = "s3"
+)
+
+// ErrNotFound is returned by every backend when asking for an object that doesn't exist
+var ErrNotFound = errors.New("object not found")
+
+// Backend is somewhere we can keep covers. Keys are slash separated paths like covers/<digest>/small.webp
+type Backend interface {
+	Put(key string, content []byte) error
+	Get(key string) ([]byte, error)
+	Exists(key string) (bool, error)
+	Delete(key string) error
+	// List returns every key starting with prefix, or everything for an empty prefix
+	List(prefix string) ([]string, error)
+	// Modified is when an object was last written
+	Modified(key string) (time.Time, error)
+}
+
+// New sets up whichever backend has been configured, defaulting to the local storage dir
+func New(cfg config.Config) (Backend, error) {
+	return Named(cfg, cfg.Storage.Backend)
+}
+
+// Named sets up a specific backend regardless of which one is configured as the default,
+// which is handy for moving things from one to another
+func Named(cfg config.Config, name string) (Backend, error) {
+	switch strings.ToLower(name) {
+	case "", FilesystemBackend:
+		if cfg.Gunslinger.StorageDir == "" {
+			return nil, fmt.Errorf("STORAGE_DIR must be set to use filesystem storage")
+		}
+		return Filesystem{Root: cfg.Gunslinger.StorageDir}, nil
+	case S3Backend:
+		return NewS3(cfg.Storage)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected %s or %s", name, FilesystemBackend, S3Backend)
+}
+
+func contentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/config"
+)
+
+func exerciseBackend(t *testing.T, backend Backend) {
+	_, err := backend.Get("covers/missing/small.webp")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	exists, err := backend.Exists("covers/abc/small.webp")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, backend.Put("covers/abc/small.webp", []byte("small")))
+	require.NoError(t, backend.Put("covers/abc/large.webp", []byte("large")))
+	require.NoError(t, backend.Put("legacy.jpeg", []byte("legacy")))
+
+	content, err := backend.Get("covers/abc/small.webp")
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(content))
+
+	exists, err = backend.Exists("covers/abc/small.webp")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	modified, err := backend.Modified("covers/abc/small.webp")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), modified, time.Minute)
+	_, err = backend.Modified("covers/missing/small.webp")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	keys, err := backend.List("covers/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"covers/abc/small.webp", "covers/abc/large.webp"}, keys)
+
+	require.NoError(t, backend.Delete("covers/abc/small.webp"))
+	exists, err = backend.Exists("covers/abc/small.webp")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFilesystem(t *testing.T) {
+	backend := Filesystem{Root: t.TempDir()}
+	exerciseBackend(t, backend)
+
+	_, err := backend.Get("../outside")
+	assert.Error(t, err)
+}
+
+// TestS3 runs against a real bucket, such as a local MinIO, when one is provided ie;
+// docker run -p 9000:9000 minio/minio server /data
+// S3_TEST_ENDPOINT=localhost:9000 S3_TEST_BUCKET=covers go test ./storage
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	accessKey := os.Getenv("S3_TEST_ACCESS_KEY_ID")
+	if accessKey == "" {
+		accessKey = "minioadmin"
+	}
+	secretKey := os.Getenv("S3_TEST_SECRET_ACCESS_KEY")
+	if secretKey == "" {
+		secretKey = "minioadmin"
+	}
+	backend, err := NewS3(config.StorageConfig{
+		S3Endpoint:        endpoint,
+		S3Bucket:          os.Getenv("S3_TEST_BUCKET"),
+		S3AccessKeyID:     accessKey,
+		S3SecretAccessKey: secretKey,
+		S3Insecure:        true,
+		// Keep each run to itself so leftovers from a previous one don't get in the way
+		S3Prefix: "test-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+	})
+	require.NoError(t, err)
+	exerciseBackend(t, backend)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/marcus-crane/gunslinger/db"
 	"github.com/marcus-crane/gunslinger/playback"
 	"github.com/marcus-crane/gunslinger/shared"
+	"github.com/marcus-crane/gunslinger/users"
 	"github.com/marcus-crane/gunslinger/utils"
 )
 
@@ -23,9 +24,11 @@ const (
 	refreshTokenID          = "trakt:refreshtoken"
 	traktOAuthAuthEndpoint  = "https://api.trakt.tv/oauth/authorize"
 	traktOAuthTokenEndpoint = "https://api.trakt.tv/oauth/token"
-	traktPlayingEndpoint    = "https://api.trakt.tv/users/sentry/watching"
+	traktPlayingEndpoint    = "https://api.trakt.tv/users/%s/watching"
 	tmdbMovieEndpoint       = "https://api.themoviedb.org/3/movie/%d/images"
 	tmdbEpisodeEndpoint     = "https://api.themoviedb.org/3/tv/%d/season/%d/episode/%d/images"
+	tmdbSearchMovieEndpoint = "https://api.themoviedb.org/3/search/movie"
+	tmdbImageURL            = "https://image.tmdb.org/t/p/w500%s"
 )
 
 type NowPlayingResponse struct {
@@ -59,6 +62,7 @@ type TraktSummary struct {
 	OverviewPlain string   `json:"overview_plain"`
 	Author        string   `json:"author"`
 	Homepage      string   `json:"homepage"`
+	Runtime       int      `json:"runtime"`
 }
 
 type TraktIDs struct {
@@ -80,6 +84,15 @@ type TMDBImage struct {
 	FilePath string `json:"file_path"`
 }
 
+type TMDBSearchResponse struct {
+	Results []TMDBSearchResult `json:"results"`
+}
+
+type TMDBSearchResult struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
 type TraktAccessTokenPayload struct {
 	Code         string `json:"code"`
 	ClientID     string `json:"client_id"`
@@ -280,58 +293,120 @@ func refreshTokens(cfg config.Config, refreshToken string) (shared.TokenResponse
 	return newTokens, nil
 }
 
-func getArtFromTMDB(apiKey string, traktResponse NowPlayingResponse) (string, error) {
-	url := ""
-	if traktResponse.Type == "movie" {
-		url = fmt.Sprintf(tmdbMovieEndpoint, traktResponse.Movie.IDs.TMDB)
+// MediaItem builds the playback metadata for whatever is being watched. Historical imports
+// lean on this too so that their media IDs line up with anything we captured live.
+func (n NowPlayingResponse) MediaItem() playback.MediaItem {
+	item := playback.MediaItem{
+		Category: n.Type,
+		Source:   string(playback.Trakt),
+	}
+	if n.Type == "movie" {
+		item.Title = n.Movie.Title
+		item.Subtitle = fmt.Sprint(n.Movie.Year)
 	} else {
-		url = fmt.Sprintf(tmdbEpisodeEndpoint, traktResponse.Show.IDs.TMDB, traktResponse.Episode.Season, traktResponse.Episode.Number)
+		item.Title = fmt.Sprintf(
+			"%02dx%02d %s",
+			n.Episode.Season, // Season number
+			n.Episode.Number, // Episode number
+			n.Episode.Title,
+		)
+		item.Subtitle = n.Show.Title
 	}
+	return item
+}
 
-	url = fmt.Sprintf("%s?api_key=%s", url, apiKey)
+func GetArtFromTMDB(apiKey string, traktResponse NowPlayingResponse) (string, error) {
+	if traktResponse.Type == "movie" {
+		return GetMovieArtFromTMDB(apiKey, traktResponse.Movie.IDs.TMDB)
+	}
+	url := fmt.Sprintf(tmdbEpisodeEndpoint, traktResponse.Show.IDs.TMDB, traktResponse.Episode.Season, traktResponse.Episode.Number)
+	images, err := fetchTMDBImages(apiKey, url)
+	if err != nil {
+		return "", err
+	}
+	if len(images.Stills) == 0 {
+		return "", fmt.Errorf("no stills found on TMDB for show %d", traktResponse.Show.IDs.TMDB)
+	}
+	return fmt.Sprintf(tmdbImageURL, images.Stills[0].FilePath), nil
+}
 
-	res, err := http.Get(url)
+func GetMovieArtFromTMDB(apiKey string, tmdbID int) (string, error) {
+	images, err := fetchTMDBImages(apiKey, fmt.Sprintf(tmdbMovieEndpoint, tmdbID))
 	if err != nil {
 		return "", err
 	}
+	if len(images.Posters) == 0 {
+		return "", fmt.Errorf("no posters found on TMDB for movie %d", tmdbID)
+	}
+	return fmt.Sprintf(tmdbImageURL, images.Posters[0].FilePath), nil
+}
+
+// SearchMovieOnTMDB finds the TMDB ID for a movie when all we have is a title and year
+func SearchMovieOnTMDB(apiKey string, title string, year int) (int, error) {
+	searchUrl := fmt.Sprintf("%s?api_key=%s&query=%s", tmdbSearchMovieEndpoint, apiKey, url.QueryEscape(title))
+	if year != 0 {
+		searchUrl = fmt.Sprintf("%s&year=%d", searchUrl, year)
+	}
+
+	res, err := http.Get(searchUrl)
+	if err != nil {
+		return 0, err
+	}
 	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	var searchResponse TMDBSearchResponse
+	if err = json.Unmarshal(body, &searchResponse); err != nil {
+		return 0, err
+	}
+	if len(searchResponse.Results) == 0 {
+		return 0, fmt.Errorf("no movie found on TMDB for %s (%d)", title, year)
 	}
+	return searchResponse.Results[0].ID, nil
+}
+
+func fetchTMDBImages(apiKey string, url string) (TMDBImageResponse, error) {
 	var tmdbImageResponse TMDBImageResponse
 
-	if err = json.Unmarshal(body, &tmdbImageResponse); err != nil {
-		slog.Error("Failed to fetch image data from TMDB", slog.String("body", string(body)))
+	res, err := http.Get(fmt.Sprintf("%s?api_key=%s", url, apiKey))
+	if err != nil {
+		return tmdbImageResponse, err
 	}
+	defer res.Body.Close()
 
-	imagePath := ""
-	if traktResponse.Type == "movie" {
-		imagePath = tmdbImageResponse.Posters[0].FilePath
-	} else {
-		imagePath = tmdbImageResponse.Stills[0].FilePath
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return tmdbImageResponse, err
 	}
 
-	return fmt.Sprintf("https://image.tmdb.org/t/p/w500%s", imagePath), nil
+	if err = json.Unmarshal(body, &tmdbImageResponse); err != nil {
+		slog.Error("Failed to fetch image data from TMDB", slog.String("body", string(body)))
+		return tmdbImageResponse, err
+	}
+
+	return tmdbImageResponse, nil
 }
 
-func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, store db.Store) {
+// GetCurrentlyPlaying checks what a user is watching. Only the owner has signed in with OAuth so
+// anyone else needs their Trakt profile to be public for us to see it.
+func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client http.Client, store db.Store, account users.Account) error {
+	playingEndpoint := fmt.Sprintf(traktPlayingEndpoint, url.PathEscape(account.Identity))
 	accessToken := store.GetTokenByID(accessTokenID)
 	// We don't have an access token so let's request one
 	if accessToken == "" {
 		slog.Info("No trakt token found so prompting to OAuth")
 		newAccessToken, err := initialTokenFetch(cfg, store)
 		if err != nil {
-			slog.Error("Failed to populate initial Trakt token", slog.String("error", err.Error()))
-			return
+			return fmt.Errorf("failed to populate initial Trakt token: %w", err)
 		}
 		accessToken = newAccessToken
 	}
-	req, err := http.NewRequest("HEAD", traktPlayingEndpoint, nil)
+	req, err := http.NewRequest("HEAD", playingEndpoint, nil)
 	if err != nil {
-		slog.Error("Failed to build HEAD request for Trakt", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to build HEAD request for Trakt: %w", err)
 	}
 	req.Header = http.Header{
 		"Accept":            []string{"application/json"},
@@ -343,58 +418,44 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		slog.Error("Failed to make HEAD request to Trakt",
-			slog.String("error", err.Error()),
-			slog.String("code", res.Status),
-		)
-		return
+		return fmt.Errorf("failed to make HEAD request to Trakt: %w", err)
 	}
 	defer res.Body.Close()
 
 	// Nothing is playing so we don't need to do any further work
 	if res.StatusCode == 204 {
-		ps.DeactivateBySource(string(playback.Trakt))
-		return
+		ps.DeactivateUserSource(account.UserID, string(playback.Trakt))
+		return nil
 	}
 
 	// Do a proper, more expensive request now that we've got something fresh
-	req2, err := http.NewRequest("GET", traktPlayingEndpoint, nil)
+	req2, err := http.NewRequest("GET", playingEndpoint, nil)
 	if err != nil {
-		slog.Error("Failed to build GET request for Trakt", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to build GET request for Trakt: %w", err)
 	}
 	req2.Header = req.Header
 	res2, err := client.Do(req2)
 	if err != nil {
-		slog.Error("Failed to make GET request for Trakt", slog.String("error", err.Error()))
-		return
+		return fmt.Errorf("failed to make GET request for Trakt: %w", err)
 	}
 	defer res2.Body.Close()
 
 	// Nothing is playing so we should check if anything needs to be cleaned up
 	// or if we need to do a state transition
 	if res2.StatusCode == 204 {
-		ps.DeactivateBySource(string(playback.Trakt))
-		return
+		ps.DeactivateUserSource(account.UserID, string(playback.Trakt))
+		return nil
 	}
 
 	body, err := io.ReadAll(res2.Body)
 	if err != nil {
-		slog.Error("Failed to read Trakt response",
-			slog.String("error", err.Error()),
-			slog.String("code", res2.Status),
-		)
-		return
+		return fmt.Errorf("failed to read Trakt response (%s): %w", res2.Status, err)
 	}
 	var traktResponse NowPlayingResponse
 
 	if err = json.Unmarshal(body, &traktResponse); err != nil {
 		// TODO: Check status code
-		slog.Error("Failed to unmarshal Trakt response",
-			slog.String("error", err.Error()),
-			slog.String("code", res2.Status),
-		)
-		return
+		return fmt.Errorf("failed to unmarshal Trakt response (%s): %w", res2.Status, err)
 	}
 
 	// We only want to use Trakt to capture movies and TV series that have been
@@ -404,88 +465,49 @@ func GetCurrentlyPlaying(cfg config.Config, ps *playback.PlaybackSystem, client
 	//
 	// TODO: Handle checking for 204 and cleaning up any active resources
 	if traktResponse.Action != "checkin" {
-		return
+		return nil
 	}
 
 	started, err := time.Parse("2006-01-02T15:04:05.999Z", traktResponse.StartedAt)
 	if err != nil {
-		slog.Error("Failed to parse Trakt start time",
-			slog.String("error", err.Error()),
-			slog.String("started_at", traktResponse.StartedAt),
-		)
-		return
+		return fmt.Errorf("failed to parse Trakt start time %q: %w", traktResponse.StartedAt, err)
 	}
 	ends, err := time.Parse("2006-01-02T15:04:05.999Z", traktResponse.ExpiresAt)
 	if err != nil {
-		slog.Error("Failed to parse Trakt expiry time",
-			slog.String("error", err.Error()),
-			slog.String("expires_at", traktResponse.ExpiresAt),
-		)
-		return
+		return fmt.Errorf("failed to parse Trakt expiry time %q: %w", traktResponse.ExpiresAt, err)
 	}
 
 	duration := int(ends.Sub(started).Milliseconds())
 
 	update := playback.Update{
-		MediaItem: playback.MediaItem{
-			Category: traktResponse.Type,
-			Duration: duration,
-			Source:   string(playback.Trakt),
-		},
-		Elapsed: time.Since(started),
-		Status:  playback.StatusPlaying,
-	}
-
-	if traktResponse.Type == "movie" {
-		update.MediaItem.Title = traktResponse.Movie.Title
-		update.MediaItem.Subtitle = fmt.Sprint(traktResponse.Movie.Year)
-	} else {
-		update.MediaItem.Title = fmt.Sprintf(
-			"%02dx%02d %s",
-			traktResponse.Episode.Season, // Season number
-			traktResponse.Episode.Number, // Episode number
-			traktResponse.Episode.Title,
-		)
-		update.MediaItem.Subtitle = traktResponse.Show.Title
+		MediaItem: traktResponse.MediaItem(),
+		Elapsed:   time.Since(started),
+		Status:    playback.StatusPlaying,
+		UserID:    account.UserID,
 	}
+	update.MediaItem.Duration = duration
 
 	hash := playback.GenerateMediaID(&update)
 
 	if existing, err := ps.GetMediaItemByID(hash); err == nil {
 		update.MediaItem.Image = existing.Image
 		update.MediaItem.DominantColours = existing.DominantColours
+		update.MediaItem.Palette = existing.Palette
+		update.MediaItem.BlurHash = existing.BlurHash
 	} else {
-		imageUrl, err := getArtFromTMDB(cfg.Trakt.TMDBToken, traktResponse)
+		imageUrl, err := GetArtFromTMDB(cfg.Trakt.TMDBToken, traktResponse)
 		if err != nil {
-			slog.Error("Failed to retrieve art from TMDB",
-				slog.String("error", err.Error()),
-			)
-			return
+			return fmt.Errorf("failed to retrieve art from TMDB: %w", err)
 		}
-		image, extension, domColours, err := utils.ExtractImageContent(imageUrl)
+		cover, err := ps.ResolveCover(cfg, hash, imageUrl)
 		if err != nil {
-			slog.Error("Failed to extract image content for Trakt",
-				slog.String("error", err.Error()),
-				slog.String("image_url", imageUrl),
-			)
-			return
+			return fmt.Errorf("failed to save cover for Trakt (%s from %s): %w", update.MediaItem.Title, imageUrl, err)
 		}
-		coverUrl, err := utils.SaveCover(cfg, hash, image, extension)
-		if err != nil {
-			slog.Error("Failed to save cover for Trakt",
-				slog.String("error", err.Error()),
-				slog.String("guid", hash),
-				slog.String("title", update.MediaItem.Title),
-			)
-			return
-		}
-		update.MediaItem.Image = coverUrl
-		update.MediaItem.DominantColours = domColours
+		cover.ApplyTo(&update.MediaItem)
 	}
 
 	if err := ps.UpdatePlaybackState(update); err != nil {
-		slog.Error("Failed to save Trakt update",
-			slog.String("error", err.Error()),
-			slog.String("title", update.MediaItem.Title))
+		return fmt.Errorf("failed to save Trakt update (%s): %w", update.MediaItem.Title, err)
 	}
+	return nil
 }
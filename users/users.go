@@ -0,0 +1,270 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+// Sources that are polled per user. Spotify and RetroAchievements still only follow the owner.
+const (
+	Anilist   = "anilist"
+	Beeminder = "beeminder"
+	Plex      = "plex"
+	Steam     = "steam"
+	Trakt     = "trakt"
+)
+
+var Sources = []string{Anilist, Beeminder, Plex, Steam, Trakt}
+
+var (
+	ErrUserNotFound    = errors.New("no user exists with that name")
+	ErrAccountNotFound = errors.New("user has no account set up for that source")
+
+	// Names end up in URLs like /u/{name}/playing so they're kept simple
+	validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+)
+
+type User struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Account is who a user is on a source, like their Steam ID or Trakt username. Credential is
+// empty when the source's instance wide token from config should be used instead.
+type Account struct {
+	UserID     int64  `db:"user_id"`
+	UserName   string `db:"user_name"`
+	Source     string `db:"source"`
+	Identity   string `db:"identity"`
+	Credential string `db:"credential"`
+}
+
+type Store struct {
+	db      *sqlx.DB
+	keyring *db.Keyring
+}
+
+// NewStore keeps credentials encrypted with keyring, or as plaintext if it's nil
+func NewStore(conn *sqlx.DB, keyring *db.Keyring) *Store {
+	return &Store{db: conn, keyring: keyring}
+}
+
+func (s *Store) Create(name string) (User, error) {
+	if !validName.MatchString(name) {
+		return User{}, fmt.Errorf("invalid user name %q, use up to 32 lowercase letters, numbers, dashes or underscores", name)
+	}
+	user := User{Name: name, CreatedAt: time.Now()}
+	result, err := s.db.Exec(`INSERT INTO users (name, created_at) VALUES (?, ?)`, user.Name, user.CreatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = result.LastInsertId()
+	return user, err
+}
+
+func (s *Store) Rename(name, newName string) error {
+	if !validName.MatchString(newName) {
+		return fmt.Errorf("invalid user name %q, use up to 32 lowercase letters, numbers, dashes or underscores", newName)
+	}
+	result, err := s.db.Exec(`UPDATE users SET name = ? WHERE name = ?`, newName, name)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *Store) List() ([]User, error) {
+	users := []User{}
+	err := s.db.Select(&users, `SELECT id, name, created_at FROM users ORDER BY id`)
+	return users, err
+}
+
+func (s *Store) ByName(name string) (User, error) {
+	var user User
+	err := s.db.Get(&user, `SELECT id, name, created_at FROM users WHERE name = ?`, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+// SetAccount links a user to their identity on a source, replacing whatever was there before
+func (s *Store) SetAccount(name, source, identity, credential string) error {
+	if !slices.Contains(Sources, source) {
+		return fmt.Errorf("unknown source %q, expected one of %v", source, Sources)
+	}
+	if identity == "" {
+		return errors.New("an identity is required ie; a Steam ID or Trakt username")
+	}
+	user, err := s.ByName(name)
+	if err != nil {
+		return err
+	}
+	if credential != "" && s.keyring != nil {
+		if credential, err = s.keyring.Seal(credentialID(user.ID, source), credential); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`
+	  INSERT INTO user_sources (user_id, source, identity, credential) VALUES (?, ?, ?, ?)
+	  ON CONFLICT (user_id, source) DO UPDATE SET identity = excluded.identity, credential = excluded.credential`,
+		user.ID, source, identity, credential)
+	return err
+}
+
+func (s *Store) RemoveAccount(name, source string) error {
+	result, err := s.db.Exec(`
+	  DELETE FROM user_sources WHERE source = ? AND user_id = (SELECT id FROM users WHERE name = ?)`,
+		source, name)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+// Accounts returns everyone who has an account on a source. The owner's identity can also come
+// from config, which is how single user instances are set up, but one stored in the database wins.
+func (s *Store) Accounts(cfg config.Config, source string) ([]Account, error) {
+	accounts := []Account{}
+	err := s.db.Select(&accounts, `
+	  SELECT s.user_id, u.name AS user_name, s.source, s.identity, s.credential
+	  FROM user_sources s JOIN users u ON u.id = s.user_id
+	  WHERE s.source = ? ORDER BY s.user_id`, source)
+	if err != nil {
+		return nil, err
+	}
+	for i := range accounts {
+		if err := s.open(&accounts[i]); err != nil {
+			return nil, err
+		}
+	}
+	if identity := ownerIdentity(cfg, source); identity != "" && !slices.ContainsFunc(accounts, func(a Account) bool {
+		return a.UserID == models.OwnerUserID
+	}) {
+		owner := Account{UserID: models.OwnerUserID, Source: source, Identity: identity}
+		if err := s.db.Get(&owner.UserName, `SELECT name FROM users WHERE id = ?`, models.OwnerUserID); err != nil {
+			return nil, err
+		}
+		accounts = append([]Account{owner}, accounts...)
+	}
+	return accounts, nil
+}
+
+// Account finds a single user's account on a source
+func (s *Store) Account(cfg config.Config, userID int64, source string) (Account, error) {
+	accounts, err := s.Accounts(cfg, source)
+	if err != nil {
+		return Account{}, err
+	}
+	for _, account := range accounts {
+		if account.UserID == userID {
+			return account, nil
+		}
+	}
+	return Account{}, ErrAccountNotFound
+}
+
+// EncryptCredentials reseals any credentials that are plaintext or under an older key, the same
+// way stored OAuth tokens are, returning how many were rewritten
+func (s *Store) EncryptCredentials() (int, error) {
+	if s.keyring == nil {
+		return 0, nil
+	}
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	accounts := []Account{}
+	if err := tx.Select(&accounts, `SELECT user_id, source, credential FROM user_sources WHERE credential != ''`); err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, account := range accounts {
+		if s.keyring.Current(account.Credential) {
+			continue
+		}
+		id := credentialID(account.UserID, account.Source)
+		plaintext, err := s.keyring.Open(id, account.Credential)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := s.keyring.Seal(id, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE user_sources SET credential = ? WHERE user_id = ? AND source = ?`, sealed, account.UserID, account.Source); err != nil {
+			return 0, err
+		}
+		rewritten++
+	}
+	return rewritten, tx.Commit()
+}
+
+func (s *Store) open(account *Account) error {
+	if account.Credential == "" {
+		return nil
+	}
+	if s.keyring == nil {
+		if db.IsSealed(account.Credential) {
+			return fmt.Errorf("credential for %s on %s is encrypted but no token keys are configured", account.UserName, account.Source)
+		}
+		return nil
+	}
+	credential, err := s.keyring.Open(credentialID(account.UserID, account.Source), account.Credential)
+	if err != nil {
+		return err
+	}
+	account.Credential = credential
+	return nil
+}
+
+func credentialID(userID int64, source string) string {
+	return "user:" + strconv.FormatInt(userID, 10) + ":" + source
+}
+
+func ownerIdentity(cfg config.Config, source string) string {
+	switch source {
+	case Anilist:
+		return cfg.Anilist.UserID
+	case Beeminder:
+		return cfg.Beeminder.Username
+	case Plex:
+		// Whoever owns a Plex server is always account 1 on it
+		if cfg.Plex.AccountID == "" && cfg.Plex.URL != "" {
+			return "1"
+		}
+		return cfg.Plex.AccountID
+	case Steam:
+		return cfg.Steam.UserID
+	case Trakt:
+		return cfg.Trakt.Username
+	}
+	return ""
+}
+
+// CredentialOr is the account's own credential, or the instance wide one when it doesn't have one
+func (a Account) CredentialOr(fallback string) string {
+	if a.Credential != "" {
+		return a.Credential
+	}
+	return fallback
+}
@@ -0,0 +1,106 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/marcus-crane/gunslinger/config"
+	"github.com/marcus-crane/gunslinger/db"
+	"github.com/marcus-crane/gunslinger/internal/testdb"
+	"github.com/marcus-crane/gunslinger/models"
+)
+
+func newKeyring(t *testing.T) *db.Keyring {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	keyring, err := db.ParseKeyring("1:" + base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestStore_Users(t *testing.T) {
+	conn := testdb.Open(t)
+
+	store := NewStore(conn, nil)
+
+	_, err := store.Create("Not A Valid Name")
+	assert.Error(t, err)
+	_, err = store.Create("owner")
+	assert.Error(t, err, "names are unique")
+
+	friend, err := store.Create("friend")
+	require.NoError(t, err)
+	require.NoError(t, store.Rename("friend", "pal"))
+	assert.ErrorIs(t, store.Rename("friend", "buddy"), ErrUserNotFound)
+
+	user, err := store.ByName("pal")
+	require.NoError(t, err)
+	assert.Equal(t, friend.ID, user.ID)
+	_, err = store.ByName("friend")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	list, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "owner", list[0].Name)
+}
+
+func TestStore_Accounts(t *testing.T) {
+	conn := testdb.Open(t)
+
+	keyring := newKeyring(t)
+	store := NewStore(conn, keyring)
+	cfg := config.Config{}
+	cfg.Steam.UserID = "76561197999386785"
+
+	_, err := store.Create("friend")
+	require.NoError(t, err)
+	assert.Error(t, store.SetAccount("friend", "myspace", "tom", ""))
+	assert.ErrorIs(t, store.SetAccount("nobody", Steam, "123", ""), ErrUserNotFound)
+	require.NoError(t, store.SetAccount("friend", Steam, "76561197960287930", "friend-api-key"))
+
+	// Credentials never sit around as plaintext when there are keys to seal them with
+	var stored string
+	require.NoError(t, conn.Get(&stored, `SELECT credential FROM user_sources WHERE source = ?`, Steam))
+	assert.True(t, db.IsSealed(stored))
+
+	// The owner comes from config as they don't have an account stored yet
+	accounts, err := store.Accounts(cfg, Steam)
+	require.NoError(t, err)
+	require.Len(t, accounts, 2)
+	assert.Equal(t, models.OwnerUserID, accounts[0].UserID)
+	assert.Equal(t, "owner", accounts[0].UserName)
+	assert.Equal(t, "76561197999386785", accounts[0].Identity)
+	assert.Equal(t, "instance-key", accounts[0].CredentialOr("instance-key"))
+	assert.Equal(t, "friend", accounts[1].UserName)
+	assert.Equal(t, "friend-api-key", accounts[1].CredentialOr("instance-key"))
+
+	// One stored in the database takes over from config
+	require.NoError(t, store.SetAccount("owner", Steam, "76561197960287931", ""))
+	owner, err := store.Account(cfg, models.OwnerUserID, Steam)
+	require.NoError(t, err)
+	assert.Equal(t, "76561197960287931", owner.Identity)
+
+	_, err = store.Account(cfg, models.OwnerUserID, Trakt)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	require.NoError(t, store.RemoveAccount("friend", Steam))
+	assert.ErrorIs(t, store.RemoveAccount("friend", Steam), ErrAccountNotFound)
+
+	// Credentials saved before keys were configured get sealed once they are
+	plain := NewStore(conn, nil)
+	require.NoError(t, plain.SetAccount("owner", Trakt, "sentry", "plaintext-token"))
+	rewritten, err := store.EncryptCredentials()
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewritten)
+	owner, err = store.Account(cfg, models.OwnerUserID, Trakt)
+	require.NoError(t, err)
+	assert.Equal(t, "plaintext-token", owner.Credential)
+	_, err = plain.Accounts(cfg, Trakt)
+	assert.Error(t, err, "sealed credentials can't be read without keys")
+}
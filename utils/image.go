@@ -8,11 +8,10 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"strings"
 
-	"github.com/marcus-crane/gunslinger/config"
 	"github.com/marcus-crane/gunslinger/models"
+	"github.com/marcus-crane/gunslinger/storage"
 	color_extractor "github.com/marekm4/color-extractor"
 )
 
@@ -75,29 +74,18 @@ func colorToHexString(c color.Color) string {
 	return fmt.Sprintf("#%.2x%.2x%.2x", rgba.R, rgba.G, rgba.B)
 }
 
-func LoadCover(cfg config.Config, hash string, extension string) (string, error) {
+// LoadCover reads a legacy cover saved before we started processing them into sizes and formats
+func LoadCover(store storage.Backend, hash string, extension string) (string, error) {
 	// TODO: Properly standardise on webp or something
 	if strings.Contains(hash, "retroachievements") {
 		extension = "png"
 	}
-	coverLocation := fmt.Sprintf("%s/%s.%s", cfg.Gunslinger.StorageDir, strings.ReplaceAll(hash, ":", "."), extension)
-	slog.With(slog.String("cover_location", coverLocation)).Debug("Loading cover from disc")
-	img, err := os.ReadFile(coverLocation)
+	key := fmt.Sprintf("%s.%s", strings.ReplaceAll(hash, ":", "."), extension)
+	slog.With(slog.String("cover_key", key)).Debug("Loading legacy cover from storage")
+	img, err := store.Get(key)
 	if err != nil {
 		slog.With(slog.String("error", err.Error())).Error("Failed to load image")
 		return "", err
 	}
 	return string(img), nil
 }
-
-func SaveCover(cfg config.Config, hash string, image []byte, extension string) (string, error) {
-	imageFilename := fmt.Sprintf("%s.%s", strings.ReplaceAll(hash, ":", "."), extension)
-	coverLocation := fmt.Sprintf("%s/%s", cfg.Gunslinger.StorageDir, imageFilename)
-	coverUrl := fmt.Sprintf("/static/%s", imageFilename)
-	slog.With(slog.String("cover_location", coverLocation)).Debug("Saving cover to disc")
-	err := os.WriteFile(coverLocation, image, 0644)
-	if err != nil {
-		return "", err
-	}
-	return coverUrl, nil
-}